@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tufitko/riak-migrator/pkg/migrator"
+)
+
+// backupFileGzip reports whether -backup-file is gzipped, by its extension
+// or -stdout-compression.
+func backupFileGzip() bool {
+	return *stdoutGzip == "gzip" || strings.HasSuffix(*backupFile, ".gz")
+}
+
+// chunkPrefix returns the name -backup-file gives the files of a split
+// backup, which are named prefix-00001.ndjson and on: its name without
+// the .ndjson extension.
+func chunkPrefix(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".ndjson")
+}
+
+// backupToFile writes an NDJSON backup to path. The stream is written to
+// a partial file next to it, named after the run, renamed to path once the
+// backup succeeded, so path never holds an incomplete backup. A failed or
+// interrupted backup leaves the partial file, closed, and logs where it
+// is. The file gets the mode of the other backups: 0666 minus the umask.
+func backupToFile(ctx context.Context, m *migrator.Migrator, path string) error {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	partial := filepath.Join(dir, name+".partial-"+m.RunID())
+	file, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return fmt.Errorf("create backup file: %w", err)
+	}
+
+	var out io.Writer = file
+	var gz *gzipOutput
+	if backupFileGzip() {
+		gz = newGzipOutput(file, name)
+		if *fsync {
+			gz.sync = file.Sync
+		}
+		out = gz
+	}
+	err = m.Backup(ctx, out)
+	if gz != nil {
+		if closeErr := gz.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil && *fsync {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err == nil && *fsync {
+		err = syncDir(dir)
+	}
+	if err != nil {
+		log.Printf("WARN: backup incomplete, partial backup left in %s\n", file.Name())
+		return err
+	}
+	log.Printf("INFO: backup written to %s\n", path)
+	return nil
+}
+
+// syncDir syncs dir, so a file renamed in it survives a host crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/tufitko/riak-migrator/pkg/migrator"
+)
+
+// deletesKeys reports whether the run deletes keys, which the operator
+// confirms first.
+func deletesKeys() bool {
+	return (*deleteRun || *cleanDest) && !*dryRun
+}
+
+// stdinIsTerminal reports whether an operator can answer prompts.
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// confirmDeletion prints what a run deleting keys is about to delete and
+// has the operator type the host name of the cluster to proceed, unless
+// -yes is set.
+func confirmDeletion(ctx context.Context, m *migrator.Migrator) error {
+	if !deletesKeys() || *assumeYes {
+		return nil
+	}
+
+	log.Println("INFO: counting the keys to delete before asking for confirmation")
+	var (
+		plan migrator.DeletionPlan
+		err  error
+	)
+	switch {
+	case *deleteRun:
+		plan, err = m.PlanDelete(ctx)
+	case *restoreBackup:
+		plan, err = m.PlanClean(ctx)
+	default:
+		// Restores of NDJSON streams only know their buckets once read.
+		plan = migrator.DeletionPlan{Cluster: *destination}
+	}
+	if err != nil {
+		return fmt.Errorf("plan deletion: %w", err)
+	}
+	u, err := url.Parse(plan.Cluster)
+	if err != nil {
+		return err
+	}
+	host := u.Hostname()
+
+	fmt.Fprintf(os.Stderr, "\nThis run deletes keys of %s:\n", u.Redacted())
+	if len(plan.Buckets) == 0 {
+		fmt.Fprintln(os.Stderr, "  the destination buckets of the backup, only known once it is read")
+	} else {
+		types := make(map[string]bool)
+		var typeNames []string
+		for _, b := range plan.Buckets {
+			fmt.Fprintf(os.Stderr, "  bucket '%s' (%s): %d keys\n", b.Bucket, b.BucketType, b.Keys)
+			if !types[b.BucketType] {
+				types[b.BucketType] = true
+				typeNames = append(typeNames, b.BucketType)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "  %d buckets of bucket types %s, %d keys in total\n",
+			len(plan.Buckets), strings.Join(typeNames, ","), plan.Keys)
+	}
+	fmt.Fprintf(os.Stderr, "Type the host name of the cluster (%s) to proceed: ", host)
+
+	answer := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer <- strings.TrimSpace(line)
+	}()
+	select {
+	case <-ctx.Done():
+		fmt.Fprintln(os.Stderr)
+		return ctx.Err()
+	case typed := <-answer:
+		if typed != host {
+			return errors.New("deletion not confirmed, the host name typed doesn't match")
+		}
+	}
+	return nil
+}
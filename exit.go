@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/tufitko/riak-migrator/pkg/migrator"
+)
+
+// Exit codes of the migrator. They are stable, scripts rely on them.
+const (
+	exitOK = 0
+	// exitFailure is any failure not covered by the codes below.
+	exitFailure = 1
+	// exitConfig is an invalid flag or environment variable, the same code
+	// the flag package exits with.
+	exitConfig = 2
+	// exitSourceUnreachable and exitDestinationUnreachable are requests
+	// that got no response from the cluster.
+	exitSourceUnreachable      = 3
+	exitDestinationUnreachable = 4
+	// exitPartial is a run in which some keys failed.
+	exitPartial = 5
+	// exitDifferent is a diff that found differences.
+	exitDifferent = 6
+	// exitInterrupted is a run stopped by SIGINT or SIGTERM, as a shell
+	// reports a process killed by SIGINT.
+	exitInterrupted = 130
+)
+
+// configError is an invalid flag or environment variable.
+type configError struct {
+	err error
+}
+
+func (e *configError) Error() string { return e.err.Error() }
+func (e *configError) Unwrap() error { return e.err }
+
+// exitCode classifies the error of run. interrupted reports whether a
+// signal stopped the run.
+func exitCode(err error, interrupted bool) int {
+	var ce *configError
+	switch {
+	case err == nil:
+		return exitOK
+	case interrupted:
+		return exitInterrupted
+	case errors.As(err, &ce):
+		return exitConfig
+	case errors.Is(err, migrator.ErrSourceUnreachable):
+		return exitSourceUnreachable
+	case errors.Is(err, migrator.ErrDestinationUnreachable):
+		return exitDestinationUnreachable
+	case errors.Is(err, migrator.ErrKeysFailed):
+		return exitPartial
+	case errors.Is(err, migrator.ErrDifferent):
+		return exitDifferent
+	default:
+		return exitFailure
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/tufitko/riak-migrator/pkg/migrator"
+)
+
+func TestExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		err         error
+		interrupted bool
+		want        int
+	}{
+		{"ok", nil, false, exitOK},
+		{"ok after a signal", nil, true, exitOK},
+		{"failure", errors.New("boom"), false, exitFailure},
+		{"config", &configError{errors.New("invalid flag")}, false, exitConfig},
+		{"wrapped config", fmt.Errorf("setup: %w", &configError{errors.New("invalid flag")}), false, exitConfig},
+		{"source unreachable", migrator.ErrSourceUnreachable, false, exitSourceUnreachable},
+		{"wrapped source unreachable", fmt.Errorf("list buckets: %w", fmt.Errorf("get: %w", migrator.ErrSourceUnreachable)), false, exitSourceUnreachable},
+		{"destination unreachable", migrator.ErrDestinationUnreachable, false, exitDestinationUnreachable},
+		{"wrapped destination unreachable", fmt.Errorf("put key: %w", migrator.ErrDestinationUnreachable), false, exitDestinationUnreachable},
+		{"partial", migrator.ErrKeysFailed, false, exitPartial},
+		{"wrapped partial", fmt.Errorf("3 of 10 files failed: %w", migrator.ErrKeysFailed), false, exitPartial},
+		{"different", migrator.ErrDifferent, false, exitDifferent},
+		{"wrapped different", fmt.Errorf("2 keys differ: %w", migrator.ErrDifferent), false, exitDifferent},
+		{"interrupted", context.Canceled, true, exitInterrupted},
+		{"interrupted partial", fmt.Errorf("1 of 2 files failed: %w", migrator.ErrKeysFailed), true, exitInterrupted},
+		{"canceled without a signal", context.Canceled, false, exitFailure},
+	} {
+		if got := exitCode(tc.err, tc.interrupted); got != tc.want {
+			t.Errorf("%s: exitCode(%v, %v) = %d, want %d", tc.name, tc.err, tc.interrupted, got, tc.want)
+		}
+	}
+}
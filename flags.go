@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// envPrefix is prepended to a flag name to find its environment variable,
+// e.g. -bucket-types falls back to RIAK_MIGRATOR_BUCKET_TYPES.
+const envPrefix = "RIAK_MIGRATOR_"
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// flagsFromEnv sets every flag of fs missing from the command line from its
+// environment variable, so flags take precedence over the environment and
+// the environment over defaults.
+func flagsFromEnv(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || err != nil {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("invalid value '%s' for %s: %w", value, envName(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+// byteSize is a flag value accepting sizes like 512, 64KB, 10GB or 1TB.
+// Units are binary: 1KB is 1024 bytes.
+type byteSize int64
+
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func (s *byteSize) Set(raw string) error {
+	value := strings.ToUpper(strings.TrimSpace(raw))
+	unit := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value, unit = strings.TrimSpace(strings.TrimSuffix(value, u.suffix)), u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size '%s'", value)
+	}
+	if n > math.MaxInt64/unit {
+		return fmt.Errorf("size '%s' is too large", raw)
+	}
+	*s = byteSize(n * unit)
+	return nil
+}
+
+func (s *byteSize) String() string {
+	for _, u := range sizeUnits {
+		if int64(*s) >= u.size && int64(*s)%u.size == 0 {
+			return fmt.Sprintf("%d%s", int64(*s)/u.size, u.suffix)
+		}
+	}
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+// list is a flag value collecting the values of a repeated flag.
+type list []string
+
+func (l *list) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *list) String() string {
+	return strings.Join(*l, ",")
+}
+
+// mapping is a flag value collecting old=new bucket type or bucket
+// renames. The flag may be repeated and each value may hold several comma
+// separated pairs.
+type mapping map[string]string
+
+func (m mapping) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		from, to, ok := strings.Cut(pair, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return fmt.Errorf("invalid mapping '%s', want old=new", pair)
+		}
+		m[from] = to
+	}
+	return nil
+}
+
+func (m mapping) String() string {
+	pairs := make([]string, 0, len(m))
+	for from, to := range m {
+		pairs = append(pairs, from+"="+to)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// fraction is a flag value accepting a share as a percentage like 0.5% or a
+// fraction like 0.005.
+type fraction float64
+
+func (f *fraction) Set(value string) error {
+	value = strings.TrimSpace(value)
+	scale := 1.0
+	if strings.HasSuffix(value, "%") {
+		value, scale = strings.TrimSpace(strings.TrimSuffix(value, "%")), 100
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 || n/scale > 1 {
+		return fmt.Errorf("invalid share '%s'", value)
+	}
+	*f = fraction(n / scale)
+	return nil
+}
+
+func (f *fraction) String() string {
+	return strconv.FormatFloat(float64(*f)*100, 'g', -1, 64) + "%"
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFlagsFromEnv(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		parallel int
+		timeout  time.Duration
+		size     byteSize
+		err      string
+	}{
+		{
+			name:     "defaults",
+			parallel: 10, timeout: 5 * time.Minute, size: 0,
+		},
+		{
+			name:     "env over defaults",
+			env:      map[string]string{"RIAK_MIGRATOR_PARALLEL": "4", "RIAK_MIGRATOR_TIMEOUT": "30s", "RIAK_MIGRATOR_BACKUP_SPLIT_SIZE": "1GB"},
+			parallel: 4, timeout: 30 * time.Second, size: 1 << 30,
+		},
+		{
+			name:     "flags over env",
+			args:     []string{"-parallel", "8", "-backup-split-size", "10MB"},
+			env:      map[string]string{"RIAK_MIGRATOR_PARALLEL": "4", "RIAK_MIGRATOR_TIMEOUT": "30s", "RIAK_MIGRATOR_BACKUP_SPLIT_SIZE": "1GB"},
+			parallel: 8, timeout: 30 * time.Second, size: 10 << 20,
+		},
+		{
+			name: "flag set to its default over env",
+			args: []string{"-parallel", "10"},
+			env:  map[string]string{"RIAK_MIGRATOR_PARALLEL": "4"},
+			// The flag was given, so the environment doesn't apply.
+			parallel: 10, timeout: 5 * time.Minute,
+		},
+		{
+			name: "invalid int",
+			env:  map[string]string{"RIAK_MIGRATOR_PARALLEL": "many"},
+			err:  "invalid value 'many' for RIAK_MIGRATOR_PARALLEL",
+		},
+		{
+			name: "invalid duration",
+			env:  map[string]string{"RIAK_MIGRATOR_TIMEOUT": "5"},
+			err:  "invalid value '5' for RIAK_MIGRATOR_TIMEOUT",
+		},
+		{
+			name: "invalid size",
+			env:  map[string]string{"RIAK_MIGRATOR_BACKUP_SPLIT_SIZE": "10XB"},
+			err:  "invalid value '10XB' for RIAK_MIGRATOR_BACKUP_SPLIT_SIZE",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			parallel := fs.Int("parallel", 10, "")
+			timeout := fs.Duration("timeout", 5*time.Minute, "")
+			var size byteSize
+			fs.Var(&size, "backup-split-size", "")
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range tc.env {
+				t.Setenv(name, value)
+			}
+
+			err := flagsFromEnv(fs)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("flagsFromEnv = %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("flagsFromEnv: %v", err)
+			}
+			if *parallel != tc.parallel || *timeout != tc.timeout || size != tc.size {
+				t.Errorf("got parallel %d, timeout %s, size %d, want %d, %s, %d",
+					*parallel, *timeout, size, tc.parallel, tc.timeout, tc.size)
+			}
+		})
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if got := envName("key-prefix-add"); got != "RIAK_MIGRATOR_KEY_PREFIX_ADD" {
+		t.Errorf("envName = %s", got)
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  byteSize
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"512", 512, true},
+		{"1B", 1, true},
+		{"64KB", 64 << 10, true},
+		{"64kb", 64 << 10, true},
+		{" 10 MB ", 10 << 20, true},
+		{"10GB", 10 << 30, true},
+		{"1TB", 1 << 40, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"1.5GB", 0, false},
+		{"10XB", 0, false},
+		{"MB", 0, false},
+		{"8388607TB", 8388607 << 40, true},
+		{"8388608TB", 0, false},
+		{"9000000TB", 0, false},
+		{"9223372036854775807", 9223372036854775807, true},
+		{"9223372036854775807KB", 0, false},
+	} {
+		var s byteSize
+		err := s.Set(tc.value)
+		if (err == nil) != tc.ok || tc.ok && s != tc.want {
+			t.Errorf("Set(%q) = %d, %v, want %d, ok %v", tc.value, s, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestByteSizeString(t *testing.T) {
+	for _, tc := range []struct {
+		size byteSize
+		want string
+	}{
+		{0, "0"},
+		{1000, "1000B"},
+		{1 << 10, "1KB"},
+		{10 << 20, "10MB"},
+		{1 << 40, "1TB"},
+		{3 << 29, "1536MB"},
+	} {
+		if got := tc.size.String(); got != tc.want {
+			t.Errorf("String of %d = %s, want %s", int64(tc.size), got, tc.want)
+		}
+	}
+}
+
+func TestFraction(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  fraction
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"0%", 0, true},
+		{"0.5%", 0.005, true},
+		{"0.005", 0.005, true},
+		{"100%", 1, true},
+		{"1", 1, true},
+		{" 50 % ", 0.5, true},
+		{"150%", 0, false},
+		{"1.5", 0, false},
+		{"-1%", 0, false},
+		{"half", 0, false},
+		{"%", 0, false},
+	} {
+		var f fraction
+		err := f.Set(tc.value)
+		if (err == nil) != tc.ok || tc.ok && f != tc.want {
+			t.Errorf("Set(%q) = %g, %v, want %g, ok %v", tc.value, float64(f), err, float64(tc.want), tc.ok)
+		}
+	}
+}
+
+func TestMapping(t *testing.T) {
+	for _, tc := range []struct {
+		values []string
+		want   string
+		ok     bool
+	}{
+		{[]string{"a=b"}, "a=b", true},
+		{[]string{"a=b, c = d"}, "a=b,c=d", true},
+		{[]string{"c=d", "a=b"}, "a=b,c=d", true},
+		{[]string{"a=b", "a=c"}, "a=c", true},
+		{[]string{"a"}, "", false},
+		{[]string{"a="}, "", false},
+		{[]string{"=b"}, "", false},
+		{[]string{"a=b,"}, "", false},
+	} {
+		m := mapping{}
+		var err error
+		for _, value := range tc.values {
+			if err = m.Set(value); err != nil {
+				break
+			}
+		}
+		if (err == nil) != tc.ok || tc.ok && m.String() != tc.want {
+			t.Errorf("Set(%q) = %s, %v, want %s, ok %v", tc.values, m.String(), err, tc.want, tc.ok)
+		}
+	}
+}
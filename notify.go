@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/tufitko/riak-migrator/pkg/migrator"
+)
+
+const (
+	// notifyAttempts is the number of times the webhook is tried,
+	// notifyBackoff the wait between tries.
+	notifyAttempts = 3
+	notifyBackoff  = 2 * time.Second
+	notifyTimeout  = 10 * time.Second
+)
+
+// notification is the JSON payload POSTed to -notify-url.
+type notification struct {
+	Mode     string  `json:"mode"`
+	RunID    string  `json:"run_id,omitempty"`
+	Status   string  `json:"status"`
+	Duration float64 `json:"duration_seconds"`
+	Copied   int64   `json:"copied"`
+	Failed   int64   `json:"failed"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// notify POSTs the outcome of a run started at start which ended with err
+// to url, as a generic JSON payload or, for the slack format, as a Slack
+// message. m is nil when the run wasn't configured.
+func notify(url, format string, m *migrator.Migrator, start time.Time, err error, interrupted bool) error {
+	n := notification{
+		Mode:     runMode(),
+		Status:   runStatus(err, interrupted),
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		n.Error = err.Error()
+	}
+	if m != nil {
+		summary := m.Summary()
+		n.RunID = summary.RunID
+		n.Copied, n.Failed = summary.Keys["copied"], summary.Failed
+	}
+
+	var payload interface{} = n
+	if format == "slack" {
+		text := fmt.Sprintf("riak-migrator %s %s after %s: %d keys copied, %d failed",
+			n.Mode, n.Status, time.Duration(n.Duration*float64(time.Second)).Round(time.Second), n.Copied, n.Failed)
+		if n.Error != "" {
+			text += "\n" + n.Error
+		}
+		payload = map[string]string{"text": text}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+	for attempt := 1; ; attempt++ {
+		err = postJSON(client, url, body)
+		if err == nil || attempt == notifyAttempts {
+			return err
+		}
+		log.Printf("WARN: notify attempt %d failed, retrying: %s\n", attempt, err)
+		time.Sleep(notifyBackoff)
+	}
+}
+
+func postJSON(client *http.Client, url string, body []byte) error {
+	res, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("status code is %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package migrator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Backup writes every key of the configured bucket types from the source
+// to w as an NDJSON stream of records.
+func (m *Migrator) Backup(ctx context.Context, w io.Writer) error {
+	m.mode = modeBackupStream
+	m.output = &recordWriter{w: w}
+	chunks, _ := w.(*ChunkWriter)
+	if chunks != nil {
+		chunks.sync = m.fsync
+	}
+	if m.cfg.ResumeIndex != "" {
+		var err error
+		if m.resume, err = openResumeIndex(m.cfg.ResumeIndex); err != nil {
+			return fmt.Errorf("open resume index: %w", err)
+		}
+		m.log.Printf("INFO: resume index has %d keys, skipping them\n", len(m.resume.done))
+		m.resume.flushOutput = func() error {
+			return m.output.flush(m.fsync)
+		}
+		if chunks != nil {
+			if err = chunks.continueNumbering(); err != nil {
+				_ = m.resume.Close(nil)
+				return err
+			}
+		}
+	}
+
+	err := m.run(ctx)
+	if m.resume != nil {
+		if closeErr := m.resume.Close(m.fsync); err == nil {
+			err = closeErr
+		}
+		m.resume = nil
+	}
+	if chunks != nil {
+		if syncErr := chunks.flush(); err == nil {
+			err = syncErr
+		}
+	}
+	m.logSync()
+	return err
+}
+
+// BackupDir writes every key of the configured bucket types from the
+// source to a file per key under BackupDir, along with a manifest of
+// their checksums.
+func (m *Migrator) BackupDir(ctx context.Context) error {
+	m.mode = modeBackupDir
+	if err := mkdir(m.cfg.BackupDir); err != nil {
+		return err
+	}
+
+	var err error
+	if m.cfg.Incremental {
+		if m.previous, err = m.loadIncremental(m.cfg.BackupDir); err != nil {
+			return err
+		}
+	}
+	if m.manifest, err = openManifest(m.cfg.BackupDir); err != nil {
+		return err
+	}
+	if err = writeDirFormat(m.cfg.BackupDir, m.fsync); err != nil {
+		_ = m.manifest.Close(nil)
+		return err
+	}
+
+	err = m.run(ctx)
+	if closeErr := m.manifest.Close(m.fsync); err == nil {
+		err = closeErr
+	}
+	if err == nil && m.previous != nil {
+		err = m.previous.finish(m.cfg.BackupDir, m.fsync)
+	}
+	m.logSync()
+	return err
+}
+
+// tempPattern names the temp files of backups, see isTempFile.
+const tempPattern = ".migrator-tmp-*"
+
+// isTempFile reports whether name is a temp file of a backup, left behind
+// by a killed run.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".migrator-tmp-")
+}
+
+// writeFileAtomic writes data to path through a temp file renamed into
+// place, so path never holds partial data. s syncs the file and its dir.
+func writeFileAtomic(path string, data []byte, s *syncer) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), tempPattern)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = s.file(tmp)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return s.dir(filepath.Dir(path))
+}
+
+// mkdir creates a backup directory. An existing one is reused, as long as
+// it is a writable directory, so backups can be rerun and resumed.
+func mkdir(path string) error {
+	if err := os.MkdirAll(path, 0777); err != nil {
+		return err
+	}
+
+	probe, err := os.CreateTemp(path, ".migrator-write-*")
+	if err != nil {
+		return fmt.Errorf("backup dir %s is not writable: %w", path, err)
+	}
+	_ = probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// backupKey writes the value of a key to its file in the backup dir. A
+// key too long for a file name is written under a hashed name, recorded
+// in the long keys file of the bucket dir. The value is streamed to a temp
+// file in the bucket dir, which restores and verifications skip, and
+// renamed into place once complete, so values of any size use little
+// memory and a key file exists only once complete, even if the run is
+// killed. It returns the manifest entry written for the key.
+func (m *Migrator) backupKey(bucketType, bucket, key string, obj *object) (outcome, manifestEntry, error) {
+	dir := filepath.Join(m.cfg.BackupDir, bucketDir(bucketType, bucket))
+	tmp, err := os.CreateTemp(dir, tempPattern)
+	if err != nil {
+		return 0, manifestEntry{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), obj.Body)
+	if err == nil {
+		err = m.fsync.file(tmp)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, manifestEntry{}, err
+	}
+
+	name, hashed := keyFileName(key)
+	if hashed {
+		if err = m.addLongKey(dir, name, escapeKey(key)); err != nil {
+			return 0, manifestEntry{}, fmt.Errorf("record long key: %w", err)
+		}
+	}
+	if err = os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return 0, manifestEntry{}, err
+	}
+	if err = m.fsync.dir(dir); err != nil {
+		return 0, manifestEntry{}, err
+	}
+	entry := manifestEntry{
+		BucketType:   bucketType,
+		Bucket:       bucket,
+		Key:          name,
+		Size:         size,
+		SHA256:       hex.EncodeToString(hash.Sum(nil)),
+		LastModified: obj.Header.Get("Last-Modified"),
+		ETag:         obj.Header.Get("ETag"),
+	}
+	return copied, entry, m.manifest.Add(entry)
+}
+
+// spillSize is the largest value writeRecord holds in memory, larger ones
+// are spilled to a temp file first.
+const spillSize = 8 << 20
+
+// writeRecord writes a key with its metadata to the NDJSON output.
+func (m *Migrator) writeRecord(bucketType, bucket, key string, obj *object) (outcome, error) {
+	rec := record{
+		BucketType:   bucketType,
+		Bucket:       bucket,
+		Key:          key,
+		Format:       formatVersion,
+		ContentType:  obj.Header.Get("Content-Type"),
+		Headers:      metadataHeaders(obj.Header),
+		LastModified: obj.Header.Get("Last-Modified"),
+		VClock:       obj.Header.Get("X-Riak-Vclock"),
+	}
+	if len(obj.Siblings) > 0 {
+		rec.ContentType, rec.Headers, rec.LastModified = "", nil, ""
+		rec.Siblings = obj.Siblings
+		for i := range rec.Siblings {
+			rec.Siblings[i].SHA256 = checksum(rec.Siblings[i].Value)
+		}
+		m.log.Printf("INFO: key '%s' of bucket '%s' has %d siblings, backing up all of them\n", key, bucket, len(rec.Siblings))
+		return copied, m.output.Write(rec)
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(obj.Body, spillSize+1))
+	if err != nil {
+		return 0, err
+	}
+	if len(buf) <= spillSize {
+		rec.Value, rec.SHA256 = buf, checksum(buf)
+		return copied, m.output.Write(rec)
+	}
+
+	tmp, err := os.CreateTemp("", "riak-migrator-value-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	w := io.MultiWriter(tmp, hash)
+	if _, err = w.Write(buf); err != nil {
+		return 0, err
+	}
+	if _, err = io.Copy(w, obj.Body); err != nil {
+		return 0, err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	rec.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return copied, m.output.WriteStream(rec, tmp)
+}
@@ -0,0 +1,261 @@
+package migrator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestBackupDirSkipExistingFetchesMissingKeys(t *testing.T) {
+	source := newFakeRiak(t)
+	source.put("default", "b1", "k1", "v1")
+	source.put("default", "b1", "k2", "v2")
+	source.put("default", "b2", "k1", "v1")
+	dir := filepath.Join(t.TempDir(), "backup")
+
+	m := newTestMigrator(t, Config{Source: source.URL, Destination: source.URL, BackupDir: dir})
+	if err := m.BackupDir(context.Background()); err != nil {
+		t.Fatalf("first backup: %v", err)
+	}
+
+	// The backup of b1 is complete, the one of b2 misses a key, and b3 is
+	// new: a skip of the bucket type dir would skip them all.
+	source.put("default", "b2", "k2", "v2")
+	source.put("default", "b3", "k1", "v1")
+	source.resetRequests()
+	m = newTestMigrator(t, Config{Source: source.URL, Destination: source.URL, BackupDir: dir, SkipExisting: true})
+	if err := m.BackupDir(context.Background()); err != nil {
+		t.Fatalf("second backup: %v", err)
+	}
+
+	want := []string{
+		"/types/default/buckets/b2/keys/k2",
+		"/types/default/buckets/b3/keys/k1",
+	}
+	if got := source.requested("GET"); !reflect.DeepEqual(keyRequests(got), want) {
+		t.Errorf("GETs of keys = %q, want %q", keyRequests(got), want)
+	}
+}
+
+func TestBackupParallelLargeValuesWriteWholeLines(t *testing.T) {
+	source := newFakeRiak(t)
+	values := make(map[string][]byte)
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		values[key] = bytes.Repeat([]byte{byte('a' + i%26)}, 256<<10+i)
+		source.put("default", "b1", key, string(values[key]))
+	}
+
+	var out bytes.Buffer
+	m := newTestMigrator(t, Config{Source: source.URL, Destination: source.URL, Parallel: 16})
+	if err := m.Backup(context.Background(), &choppyWriter{w: &out}); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+
+	lines := bytes.Split(bytes.TrimSuffix(out.Bytes(), []byte("\n")), []byte("\n"))
+	if len(lines) != len(values) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(values))
+	}
+	for i, line := range lines {
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			t.Fatalf("line %d is not a record: %v", i+1, err)
+		}
+		if !bytes.Equal(rec.Value, values[rec.Key]) {
+			t.Errorf("line %d: value of %s differs", i+1, rec.Key)
+		}
+		delete(values, rec.Key)
+	}
+	if len(values) > 0 {
+		t.Errorf("%d keys missing from the backup", len(values))
+	}
+}
+
+func TestRecordWriterStreamFailureWritesNothing(t *testing.T) {
+	value := bytes.Repeat([]byte("v"), 1<<20)
+	rec := record{BucketType: "default", Bucket: "b1", Key: "k1"}
+	var out bytes.Buffer
+	rw := &recordWriter{w: &out}
+
+	// The value fails to read after half of it, as a dropped GET would.
+	failing := io.MultiReader(bytes.NewReader(value[:len(value)/2]), iotest.ErrReader(io.ErrUnexpectedEOF))
+	if err := rw.WriteStream(rec, failing); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("WriteStream = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if out.Len() > 0 {
+		t.Fatalf("failed WriteStream wrote %d bytes", out.Len())
+	}
+
+	// The retry writes the record once.
+	if err := rw.WriteStream(rec, bytes.NewReader(value)); err != nil {
+		t.Fatalf("WriteStream: %v", err)
+	}
+	lines := bytes.Split(bytes.TrimSuffix(out.Bytes(), []byte("\n")), []byte("\n"))
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want 1", len(lines))
+	}
+	var got record
+	if err := json.Unmarshal(lines[0], &got); err != nil {
+		t.Fatalf("line is not a record: %v", err)
+	}
+	if got.Key != rec.Key || !bytes.Equal(got.Value, value) {
+		t.Errorf("record of %s with %d bytes, want %s with %d", got.Key, len(got.Value), rec.Key, len(value))
+	}
+}
+
+func TestIsTempFile(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{".migrator-tmp-123456", true},
+		{".migrator-tmp-", true},
+		{"migrator-tmp-123456", false},
+		{"k.migrator-tmp-123456", false},
+		{"%2Emigrator-tmp-123456", false},
+		{versionName, false},
+	} {
+		if got := isTempFile(tc.name); got != tc.want {
+			t.Errorf("isTempFile(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLeftoverTempFilesIgnored(t *testing.T) {
+	source := newFakeRiak(t)
+	source.put("default", "b1", "k1", "v1")
+	source.put("default", "b1", "k2", "v2")
+	dir := t.TempDir()
+	m := newTestMigrator(t, Config{Source: source.URL, Destination: source.URL, BackupDir: dir})
+	if err := m.BackupDir(context.Background()); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+
+	// Writes of a key file and of the manifest killed halfway.
+	for _, d := range []string{filepath.Join(dir, "default", "b1"), dir} {
+		tmp, err := os.CreateTemp(d, tempPattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tmp.WriteString(`{"trunc`)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m = newTestMigrator(t, Config{Source: source.URL, Destination: source.URL, BackupDir: dir})
+	if err := m.VerifyDir(context.Background()); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+
+	destination := newFakeRiak(t)
+	m = newTestMigrator(t, Config{Source: destination.URL, Destination: destination.URL, BackupDir: dir})
+	if err := m.RestoreDir(context.Background()); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if got, want := destination.keys("default", "b1"), []string{"k1", "k2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("restored keys %q, want %q", got, want)
+	}
+	if n := m.totals.get(copied); n != 2 {
+		t.Errorf("restored %d files, want 2", n)
+	}
+}
+
+// choppyWriter writes to w in small pieces, yielding between them, so
+// writes of goroutines racing for it interleave.
+type choppyWriter struct {
+	w io.Writer
+}
+
+func (c *choppyWriter) Write(p []byte) (int, error) {
+	for n := 0; n < len(p); n += 4096 {
+		end := n + 4096
+		if end > len(p) {
+			end = len(p)
+		}
+		if _, err := c.w.Write(p[n:end]); err != nil {
+			return n, err
+		}
+		runtime.Gosched()
+	}
+	return len(p), nil
+}
+
+// keyRequests returns the requests of keys among paths, without their
+// query, sorted.
+func keyRequests(paths []string) []string {
+	var keys []string
+	for _, p := range paths {
+		p, _, _ = strings.Cut(p, "?")
+		if matched, _ := path.Match("/*/*/buckets/*/keys/*", p); matched || strings.HasPrefix(p, "/buckets/") && strings.Contains(p, "/keys/") {
+			keys = append(keys, p)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// flushedOutput is a backup output keeping its writes only once flushed.
+// Every write checks that the resume index at index records no more keys
+// than the records flushed.
+type flushedOutput struct {
+	index            string
+	pending, flushed bytes.Buffer
+	// err is the first check failing.
+	err error
+}
+
+func (o *flushedOutput) Write(p []byte) (int, error) {
+	o.check()
+	return o.pending.Write(p)
+}
+
+func (o *flushedOutput) Flush() error {
+	_, err := o.pending.WriteTo(&o.flushed)
+	return err
+}
+
+func (o *flushedOutput) check() {
+	data, err := os.ReadFile(o.index)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		o.err = err
+	}
+	if indexed, flushed := bytes.Count(data, []byte("\n")), bytes.Count(o.flushed.Bytes(), []byte("\n")); indexed > flushed && o.err == nil {
+		o.err = fmt.Errorf("resume index records %d keys, the backup flushed %d", indexed, flushed)
+	}
+}
+
+func TestResumeIndexFlushesBackupFirst(t *testing.T) {
+	source := newMemClient()
+	const keys = 2*resumeBatch + 500
+	for i := 0; i < keys; i++ {
+		source.put("default", "b1", fmt.Sprintf("k%d", i), "v")
+	}
+	index := filepath.Join(t.TempDir(), "resume.ndjson")
+	out := &flushedOutput{index: index}
+	m := newMemMigrator(t, Config{ResumeIndex: index, Parallel: 8}, source, newMemClient())
+	if err := m.Backup(context.Background(), out); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	if out.check(); out.err != nil {
+		t.Error(out.err)
+	}
+	if n := bytes.Count(out.flushed.Bytes(), []byte("\n")); n != keys || out.pending.Len() > 0 {
+		t.Errorf("flushed %d records, %d bytes left, want %d records", n, out.pending.Len(), keys)
+	}
+}
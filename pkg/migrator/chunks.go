@@ -0,0 +1,139 @@
+package migrator
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ChunkWriter writes an NDJSON stream into sequentially numbered files in
+// a directory, starting a new file whenever a write would grow the current
+// one past a size limit. Backup writes whole records at a time, or
+// reserves the size of a streamed one first, so a record is never split
+// between files; a record larger than the limit gets a file of its own.
+type ChunkWriter struct {
+	dir    string
+	prefix string
+	limit  int64
+
+	n    int
+	size int64
+	file *os.File
+	// reserved is the rest of a reserved record, written without rotating.
+	reserved int64
+	// sync syncs every file once complete, set by Backup with Fsync.
+	sync  *syncer
+	dirty bool
+}
+
+// NewChunkWriter returns a ChunkWriter creating files of up to limit bytes
+// in dir, named prefix-00001.ndjson and on.
+func NewChunkWriter(dir, prefix string, limit int64) *ChunkWriter {
+	return &ChunkWriter{dir: dir, prefix: prefix, limit: limit}
+}
+
+func (c *ChunkWriter) chunkName(n int) string {
+	return fmt.Sprintf("%s-%05d.ndjson", c.prefix, n)
+}
+
+// LastFile returns the path of the last file written, empty before any.
+func (c *ChunkWriter) LastFile() string {
+	if c.n == 0 {
+		return ""
+	}
+	return filepath.Join(c.dir, c.chunkName(c.n))
+}
+
+// continueNumbering makes the files follow the ones already in the dir,
+// instead of replacing them.
+func (c *ChunkWriter) continueNumbering() error {
+	entries, err := os.ReadDir(c.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		var n int
+		name := strings.TrimPrefix(entry.Name(), c.prefix+"-")
+		if _, err := fmt.Sscanf(name, "%05d.ndjson", &n); err == nil && c.chunkName(n) == entry.Name() && n > c.n {
+			c.n = n
+		}
+	}
+	return nil
+}
+
+func (c *ChunkWriter) Write(p []byte) (int, error) {
+	if c.reserved <= 0 {
+		if err := c.reserve(int64(len(p))); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := c.file.Write(p)
+	c.size += int64(n)
+	c.dirty = true
+	c.reserved -= int64(n)
+	return n, err
+}
+
+// reserve starts a new file unless the next n bytes fit in the current
+// one, and writes them to it in any number of writes.
+func (c *ChunkWriter) reserve(n int64) error {
+	if c.file == nil || (c.size > 0 && c.size+n > c.limit) {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+	c.reserved = n
+	return nil
+}
+
+func (c *ChunkWriter) rotate() error {
+	if err := c.Close(); err != nil {
+		return err
+	}
+
+	if c.n == 0 {
+		if err := os.MkdirAll(c.dir, 0777); err != nil {
+			return err
+		}
+	}
+
+	c.n++
+	file, err := os.Create(filepath.Join(c.dir, c.chunkName(c.n)))
+	if err != nil {
+		return fmt.Errorf("create chunk: %w", err)
+	}
+	c.file, c.size = file, 0
+	return nil
+}
+
+// flush syncs the current file and the dir, if written to since the last
+// flush.
+func (c *ChunkWriter) flush() error {
+	if c.file == nil || !c.dirty {
+		return nil
+	}
+	if err := c.sync.file(c.file); err != nil {
+		return err
+	}
+	c.dirty = false
+	return c.sync.dir(c.dir)
+}
+
+func (c *ChunkWriter) Close() error {
+	if c.file == nil {
+		return nil
+	}
+	err := c.flush()
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	c.file = nil
+	return err
+}
@@ -0,0 +1,120 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// cleaner tracks the destination buckets emptied by a restore with
+// CleanDest, so each is emptied once, before the first of its keys is
+// restored.
+type cleaner struct {
+	mu      sync.Mutex
+	buckets map[string]*cleanedBucket
+}
+
+type cleanedBucket struct {
+	once sync.Once
+	err  error
+}
+
+// cleanDestination empties the destination bucket a backed up key of
+// bucketType and bucket restores to, the first time it is called for it.
+// Only keys with KeyPrefixAdd are deleted, the rest aren't the restore's.
+// With DryRun it logs the keys it would delete instead.
+func (m *Migrator) cleanDestination(ctx context.Context, bucketType, bucket string) error {
+	if !m.cfg.CleanDest {
+		return nil
+	}
+	dstType, dstBucket := m.destType(bucketType), m.destBucket(bucket)
+	name := dstType + "/" + dstBucket
+
+	m.cleaned.mu.Lock()
+	if m.cleaned.buckets == nil {
+		m.cleaned.buckets = make(map[string]*cleanedBucket)
+	}
+	b := m.cleaned.buckets[name]
+	if b == nil {
+		b = &cleanedBucket{}
+		m.cleaned.buckets[name] = b
+	}
+	m.cleaned.mu.Unlock()
+
+	b.once.Do(func() {
+		b.err = m.cleanBucket(ctx, dstType, dstBucket)
+	})
+	return b.err
+}
+
+// cleanBucket deletes the keys of a destination bucket on Parallel
+// workers.
+func (m *Migrator) cleanBucket(ctx context.Context, bucketType, bucket string) error {
+	var (
+		deleted     int64
+		failure     error
+		failureOnce sync.Once
+	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	keys := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < m.cfg.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				err := m.retry(ctx, func() error {
+					return m.destination.DeleteObject(m.trace(ctx, bucketType, bucket, key), bucketType, bucket, key)
+				})
+				if err != nil && !errors.Is(err, errNotFound) {
+					atomic.AddInt64(&m.failed, 1)
+					failureOnce.Do(func() {
+						failure = fmt.Errorf("delete key '%s': %w", key, err)
+						cancel()
+					})
+					continue
+				}
+				atomic.AddInt64(&deleted, 1)
+			}
+		}()
+	}
+
+	err := m.listSource(ctx, m.destination, bucketType, bucket, func(key string) error {
+		if !strings.HasPrefix(key, m.cfg.KeyPrefixAdd) {
+			return nil
+		}
+		if m.cfg.DryRun {
+			atomic.AddInt64(&deleted, 1)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case keys <- key:
+			return nil
+		}
+	}, nil)
+	close(keys)
+	wg.Wait()
+	if failure != nil {
+		return failure
+	}
+	if errors.Is(err, errNotFound) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("list destination bucket '%s': %w", bucket, err)
+	}
+
+	if m.cfg.DryRun {
+		m.log.Printf("INFO: dry run: would delete %d keys of destination bucket '%s' (%s)\n", deleted, bucket, bucketType)
+	} else {
+		m.log.Printf("INFO: clean destination: deleted %d keys of bucket '%s' (%s)\n", deleted, bucket, bucketType)
+	}
+	return nil
+}
@@ -0,0 +1,647 @@
+package migrator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSourceUnreachable and ErrDestinationUnreachable match errors of
+// requests that got no response from the cluster.
+var (
+	ErrSourceUnreachable      = errors.New("source unreachable")
+	ErrDestinationUnreachable = errors.New("destination unreachable")
+)
+
+var (
+	errNotFound           = errors.New("not found")
+	errNotModified        = errors.New("not modified")
+	errPreconditionFailed = errors.New("precondition failed")
+)
+
+// statusError is an unexpected HTTP status returned by Riak.
+type statusError struct {
+	code int
+	body []byte
+}
+
+func (e *statusError) Error() string {
+	if len(e.body) == 0 {
+		return fmt.Sprintf("status code is %d", e.code)
+	}
+	return fmt.Sprintf("got unexpected status: %d, %s", e.code, e.body)
+}
+
+// requestError is a request that got no response, kind is one of the
+// unreachable errors.
+type requestError struct {
+	kind error
+	err  error
+}
+
+func (e *requestError) Error() string        { return e.err.Error() }
+func (e *requestError) Unwrap() error        { return e.err }
+func (e *requestError) Is(target error) bool { return target == e.kind }
+
+// object is a Riak object fetched from a cluster. The caller must close
+// Body.
+type object struct {
+	Header http.Header
+	Body   io.ReadCloser
+	// Size is the length of Body, -1 when unknown.
+	Size int64
+	// Siblings are the values of a key with siblings, returned instead of
+	// Body when the GET accepts multipart/mixed.
+	Siblings []sibling
+}
+
+// riakClient is the part of the Riak API the migrator needs from a
+// cluster. Keys are passed unescaped. Missing buckets, keys and props are
+// reported as errNotFound.
+type riakClient interface {
+	BucketTypeExists(ctx context.Context, bucketType string) (bool, error)
+	ListBuckets(ctx context.Context, bucketType string) ([]string, error)
+	// ListKeys calls fn for every key of the bucket while the listing is
+	// read, and stops at the first error fn returns.
+	ListKeys(ctx context.Context, bucketType, bucket string, fn func(key string) error) error
+	// ListKeysPage returns a page of at most maxResults keys of the bucket
+	// from the $bucket index, and the continuation of the next page, empty
+	// after the last one.
+	ListKeysPage(ctx context.Context, bucketType, bucket, continuation string, maxResults int) ([]string, string, error)
+	// MapReduceKeys calls fn for every key of the bucket listed by a
+	// reduce_identity MapReduce job, and stops at the first error fn
+	// returns.
+	MapReduceKeys(ctx context.Context, bucketType, bucket string, fn func(key string) error) error
+	// GetObject sends header along with the GET, a conditional GET that
+	// matched is reported as errNotModified.
+	GetObject(ctx context.Context, bucketType, bucket, key string, header http.Header) (*object, error)
+	// HeadObject returns the headers of an object.
+	HeadObject(ctx context.Context, bucketType, bucket, key string) (http.Header, error)
+	// PutObject stores body with header, a failed If-None-Match is
+	// reported as errPreconditionFailed.
+	PutObject(ctx context.Context, bucketType, bucket, key string, body io.Reader, header http.Header) error
+	DeleteObject(ctx context.Context, bucketType, bucket, key string) error
+	GetProps(ctx context.Context, bucketType, bucket string) ([]byte, error)
+	PutProps(ctx context.Context, bucketType, bucket string, props []byte) error
+	// GetStats returns the node stats of the /stats endpoint.
+	GetStats(ctx context.Context) ([]byte, error)
+	// Ping checks that the node answers its /ping endpoint.
+	Ping(ctx context.Context) error
+}
+
+// httpClient is a riakClient for the Riak HTTP API at baseURL.
+type httpClient struct {
+	baseURL     string
+	client      *http.Client
+	unreachable error
+	layout      urlLayout
+
+	// userAgent is the User-Agent of the requests. Their X-Request-Id is
+	// the one of their context, runID when it has none.
+	userAgent string
+	runID     string
+
+	// getQuery and putQuery are added to the URLs of key GETs and PUTs.
+	getQuery url.Values
+	putQuery url.Values
+	// timeouts bound the requests, a request is only bounded by its
+	// context for a zero timeout.
+	timeouts Timeouts
+	// acceptEncoding is the Accept-Encoding of key GETs, gzip for
+	// responses decoded by GetObject or identity for values as stored, the
+	// transport's when empty. received counts the bytes of their values
+	// when set.
+	acceptEncoding string
+	received       *transferStats
+	// debug logs every request when set.
+	debug *log.Logger
+	// trace logs the requests of keys marked for tracing in full.
+	trace *log.Logger
+	// inFlight counts the requests sent and not done yet when set.
+	inFlight *int64
+	// tracer records the spans of requests made within one, nil when
+	// not tracing.
+	tracer *tracer
+}
+
+func newHTTPClient(baseURL string, client *http.Client, unreachable error) *httpClient {
+	return &httpClient{baseURL: baseURL, client: client, unreachable: unreachable, layout: typesLayout{}}
+}
+
+// do sends a request bounded by timeout. The timeout covers reading the
+// response body too, it is released when the body is closed.
+func (c *httpClient) do(ctx context.Context, timeout time.Duration, method, path string, body io.Reader, header http.Header) (*http.Response, error) {
+	cancel := context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	if c.inFlight != nil {
+		atomic.AddInt64(c.inFlight, 1)
+		release := cancel
+		cancel = func() {
+			release()
+			atomic.AddInt64(c.inFlight, -1)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("new request err: %w", err)
+	}
+	if c.debug != nil {
+		c.debug.Printf("DEBUG: %s %s\n", method, req.URL)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	if id := requestID(ctx, c.runID); id != "" {
+		req.Header.Set("X-Request-Id", id)
+	}
+	span := c.tracer.startRequest(req)
+	trace := newRequestTrace(ctx, c.trace)
+	if trace != nil {
+		trace.request(req)
+	}
+	res, err := c.client.Do(req)
+	if trace != nil {
+		trace.response(res, err)
+	}
+	if err != nil {
+		cancel()
+		span.finish(err)
+		return nil, &requestError{kind: c.unreachable, err: err}
+	}
+	if span != nil {
+		span.status(res.StatusCode)
+		release := cancel
+		cancel = func() {
+			release()
+			span.finish(nil)
+		}
+	}
+	res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// cancelBody releases the timeout of a request when its response body is
+// closed, the first time only.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.cancel)
+	return err
+}
+
+func (c *httpClient) BucketTypeExists(ctx context.Context, bucketType string) (bool, error) {
+	// The default type always exists, and is the only one without types.
+	if bucketType == "default" || !c.layout.hasTypes() {
+		return bucketType == "default", nil
+	}
+	res, err := c.do(ctx, c.timeouts.Props, "GET", c.layout.typePath(bucketType)+"/props", nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	default:
+		return false, &statusError{code: res.StatusCode}
+	}
+}
+
+func (c *httpClient) ListBuckets(ctx context.Context, bucketType string) ([]string, error) {
+	res, err := c.do(ctx, c.timeouts.List, "GET", c.layout.typePath(bucketType)+"/buckets?buckets=true", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, &statusError{code: res.StatusCode}
+	}
+
+	var buckets struct {
+		Buckets []string `json:"buckets"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&buckets); err != nil {
+		return nil, fmt.Errorf("decode bucket list err: %w", err)
+	}
+	return buckets.Buckets, nil
+}
+
+func (c *httpClient) ListKeys(ctx context.Context, bucketType, bucket string, fn func(key string) error) error {
+	res, err := c.do(ctx, c.timeouts.List, "GET", c.layout.bucketPath(bucketType, bucket)+"/keys?keys=true", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		return errNotFound
+	default:
+		return &statusError{code: res.StatusCode}
+	}
+
+	if err = decodeKeys(json.NewDecoder(res.Body), fn); err != nil {
+		return fmt.Errorf("decode keys list err: %w", err)
+	}
+	return nil
+}
+
+func (c *httpClient) ListKeysPage(ctx context.Context, bucketType, bucket, continuation string, maxResults int) ([]string, string, error) {
+	path := c.layout.bucketPath(bucketType, bucket) + fmt.Sprintf("/index/$bucket/_?max_results=%d", maxResults)
+	if continuation != "" {
+		path += "&continuation=" + url.QueryEscape(continuation)
+	}
+	res, err := c.do(ctx, c.timeouts.List, "GET", path, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		body, _ := io.ReadAll(res.Body)
+		return nil, "", &statusError{code: res.StatusCode, body: body}
+	}
+
+	var page struct {
+		Keys         []string `json:"keys"`
+		Continuation string   `json:"continuation"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&page); err != nil {
+		return nil, "", fmt.Errorf("decode index page err: %w", err)
+	}
+	return page.Keys, page.Continuation, nil
+}
+
+// mapredKeysJob lists the keys of a bucket as [bucket, key] pairs.
+const mapredKeysJob = `{"inputs":%s,"query":[{"reduce":{"language":"erlang","module":"riak_kv_mapreduce","function":"reduce_identity","keep":true}}]}`
+
+func (c *httpClient) MapReduceKeys(ctx context.Context, bucketType, bucket string, fn func(key string) error) error {
+	inputs, err := json.Marshal(c.layout.mapredInputs(bucketType, bucket))
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	body := strings.NewReader(fmt.Sprintf(mapredKeysJob, inputs))
+	res, err := c.do(ctx, c.timeouts.List, "POST", "/mapred?chunked=true", body, header)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		body, _ := io.ReadAll(res.Body)
+		return &statusError{code: res.StatusCode, body: body}
+	}
+
+	_, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("mapred content type err: %w", err)
+	}
+	parts := multipart.NewReader(res.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read mapred part err: %w", err)
+		}
+
+		// Pairs are [bucket, key] or [bucket, key, keydata], the bucket of
+		// a typed bucket being a [type, bucket] pair itself.
+		var chunk struct {
+			Data [][]json.RawMessage `json:"data"`
+		}
+		if err = json.NewDecoder(part).Decode(&chunk); err != nil {
+			return fmt.Errorf("decode mapred part err: %w", err)
+		}
+		for _, pair := range chunk.Data {
+			if len(pair) < 2 {
+				return fmt.Errorf("unexpected mapred result of %d elements", len(pair))
+			}
+			var key string
+			if err = json.Unmarshal(pair[1], &key); err != nil {
+				return fmt.Errorf("decode mapred key err: %w", err)
+			}
+			if err = fn(key); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// decodeKeys calls fn for every key of a {"keys": [...]} listing as it is
+// read, so the listing is never held in memory as a whole. It stops at the
+// first error returned by fn.
+func decodeKeys(dec *json.Decoder, fn func(key string) error) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if tok != "keys" {
+			var skip json.RawMessage
+			if err = dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err = expectDelim(dec, '['); err != nil {
+			return err
+		}
+		for dec.More() {
+			var key string
+			if err = dec.Decode(&key); err != nil {
+				return err
+			}
+			if err = fn(key); err != nil {
+				return err
+			}
+		}
+		if err = expectDelim(dec, ']'); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("got %v, want %v", tok, delim)
+	}
+	return nil
+}
+
+// escapePath escapes a bucket type, bucket or key for a URL path. Riak
+// decodes + in paths as a space, so it is escaped as well, and so are the
+// dots of . and .. which would otherwise be resolved as dot segments.
+func escapePath(s string) string {
+	if s == "." || s == ".." {
+		return strings.Repeat("%2E", len(s))
+	}
+	return strings.ReplaceAll(url.PathEscape(s), "+", "%2B")
+}
+
+// withQuery appends query to path, unless it is empty.
+func withQuery(path string, query url.Values) string {
+	if len(query) == 0 {
+		return path
+	}
+	return path + "?" + query.Encode()
+}
+
+func (c *httpClient) GetObject(ctx context.Context, bucketType, bucket, key string, header http.Header) (*object, error) {
+	if c.acceptEncoding != "" && header.Get("Accept-Encoding") == "" {
+		// Set explicitly, the transport leaves decoding the response to
+		// decodeObject.
+		header = header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set("Accept-Encoding", c.acceptEncoding)
+	}
+	res, err := c.do(ctx, c.timeouts.Get, "GET", withQuery(c.layout.keyPath(bucketType, bucket, key), c.getQuery), nil, header)
+	if err != nil {
+		return nil, err
+	}
+
+	switch res.StatusCode {
+	case 200:
+		return c.decodeObject(res)
+	case 300:
+		if strings.Contains(header.Get("Accept"), "multipart/mixed") {
+			return c.decodeSiblings(res)
+		}
+		err = &statusError{code: res.StatusCode}
+	case 304:
+		err = errNotModified
+	case 404:
+		err = errNotFound
+	default:
+		err = &statusError{code: res.StatusCode}
+	}
+	_ = res.Body.Close()
+	return nil, err
+}
+
+// decodeObject returns the object of a key GET response, decoding a gzip
+// encoded body.
+func (c *httpClient) decodeObject(res *http.Response) (*object, error) {
+	obj := &object{Header: res.Header, Body: res.Body, Size: res.ContentLength}
+	if c.received != nil {
+		obj.Body = &countingReader{r: obj.Body, n: &c.received.wire}
+	}
+	if res.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(obj.Body)
+		if err != nil {
+			_ = res.Body.Close()
+			return nil, fmt.Errorf("gzip response err: %w", err)
+		}
+		obj.Body = &gzipBody{Reader: zr, body: obj.Body}
+		obj.Header.Del("Content-Encoding")
+		obj.Header.Del("Content-Length")
+		obj.Size = -1
+	}
+	if c.received != nil {
+		obj.Body = &countingReader{r: obj.Body, n: &c.received.logical}
+	}
+	return obj, nil
+}
+
+// decodeSiblings returns the object of a multipart/mixed 300 response to a
+// key GET, with a sibling per part.
+func (c *httpClient) decodeSiblings(res *http.Response) (*object, error) {
+	obj, err := c.decodeObject(res)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+
+	_, params, err := mime.ParseMediaType(obj.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("siblings content type err: %w", err)
+	}
+	parts := multipart.NewReader(obj.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read sibling err: %w", err)
+		}
+		value, err := io.ReadAll(part)
+		if err != nil {
+			return nil, fmt.Errorf("read sibling err: %w", err)
+		}
+		header := http.Header(part.Header)
+		obj.Siblings = append(obj.Siblings, sibling{
+			Value:        value,
+			ContentType:  header.Get("Content-Type"),
+			Headers:      metadataHeaders(header),
+			VTag:         header.Get("Etag"),
+			LastModified: header.Get("Last-Modified"),
+		})
+	}
+	obj.Body, obj.Size = http.NoBody, 0
+	return obj, nil
+}
+
+// gzipBody decodes a gzip encoded response body.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	return b.body.Close()
+}
+
+func (c *httpClient) HeadObject(ctx context.Context, bucketType, bucket, key string) (http.Header, error) {
+	res, err := c.do(ctx, c.timeouts.Get, "HEAD", c.layout.keyPath(bucketType, bucket, key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case 200:
+		return res.Header, nil
+	case 404:
+		return nil, errNotFound
+	default:
+		return nil, &statusError{code: res.StatusCode}
+	}
+}
+
+func (c *httpClient) PutObject(ctx context.Context, bucketType, bucket, key string, body io.Reader, header http.Header) error {
+	res, err := c.do(ctx, c.timeouts.Put, "PUT", withQuery(c.layout.keyPath(bucketType, bucket, key), c.putQuery), body, header)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case 200, 201, 204:
+		return nil
+	case 412:
+		return errPreconditionFailed
+	default:
+		body, _ := io.ReadAll(res.Body)
+		return &statusError{code: res.StatusCode, body: body}
+	}
+}
+
+func (c *httpClient) DeleteObject(ctx context.Context, bucketType, bucket, key string) error {
+	res, err := c.do(ctx, c.timeouts.Put, "DELETE", c.layout.keyPath(bucketType, bucket, key), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case 204:
+		return nil
+	case 404:
+		return errNotFound
+	default:
+		return &statusError{code: res.StatusCode}
+	}
+}
+
+func (c *httpClient) GetProps(ctx context.Context, bucketType, bucket string) ([]byte, error) {
+	res, err := c.do(ctx, c.timeouts.Props, "GET", c.layout.bucketPath(bucketType, bucket)+"/props", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case 200:
+		return io.ReadAll(res.Body)
+	case 404:
+		return nil, errNotFound
+	default:
+		return nil, &statusError{code: res.StatusCode}
+	}
+}
+
+func (c *httpClient) GetStats(ctx context.Context) ([]byte, error) {
+	res, err := c.do(ctx, c.timeouts.Props, "GET", "/stats", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case 200:
+		return io.ReadAll(res.Body)
+	case 404:
+		return nil, errNotFound
+	default:
+		return nil, &statusError{code: res.StatusCode}
+	}
+}
+
+func (c *httpClient) Ping(ctx context.Context) error {
+	res, err := c.do(ctx, c.timeouts.Props, "GET", "/ping", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return &statusError{code: res.StatusCode}
+	}
+	return nil
+}
+
+func (c *httpClient) PutProps(ctx context.Context, bucketType, bucket string, props []byte) error {
+	header := http.Header{"Content-Type": {"application/json"}}
+	res, err := c.do(ctx, c.timeouts.Props, "PUT", c.layout.bucketPath(bucketType, bucket)+"/props", bytes.NewReader(props), header)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 204 {
+		body, _ := io.ReadAll(res.Body)
+		return &statusError{code: res.StatusCode, body: body}
+	}
+	return nil
+}
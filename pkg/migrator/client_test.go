@@ -0,0 +1,68 @@
+package migrator
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// escapeCases are keys and their escaping in request paths.
+var escapeCases = []struct {
+	key, escaped string
+}{
+	{"k1", "k1"},
+	{"a/b", "a%2Fb"},
+	{"100% data", "100%25%20data"},
+	{"данные", "%D0%B4%D0%B0%D0%BD%D0%BD%D1%8B%D0%B5"},
+	{"a+b", "a%2Bb"},
+	{"a;b,c?d#e", "a%3Bb%2Cc%3Fd%23e"},
+	{".", "%2E"},
+	{"..", "%2E%2E"},
+	{"...", "..."},
+}
+
+func TestEscapePath(t *testing.T) {
+	for _, tc := range escapeCases {
+		if got := escapePath(tc.key); got != tc.escaped {
+			t.Errorf("escapePath(%q) = %s, want %s", tc.key, got, tc.escaped)
+		}
+	}
+}
+
+func TestKeyRequestPaths(t *testing.T) {
+	f := newFakeRiak(t)
+	c := newHTTPClient(f.URL, f.Client(), ErrDestinationUnreachable)
+	ctx := context.Background()
+
+	for _, tc := range escapeCases {
+		t.Run(tc.key, func(t *testing.T) {
+			f.resetRequests()
+			header := http.Header{"Content-Type": {"text/plain"}}
+			if err := c.PutObject(ctx, "default", "b 1", tc.key, strings.NewReader("v"), header); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			obj, err := c.GetObject(ctx, "default", "b 1", tc.key, nil)
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			value, _ := io.ReadAll(obj.Body)
+			obj.Body.Close()
+			if string(value) != "v" {
+				t.Errorf("got %q, want v", value)
+			}
+
+			want := []string{"/types/default/buckets/b%201/keys/" + tc.escaped}
+			for _, method := range []string{"PUT", "GET"} {
+				if got := f.requested(method); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s requests = %q, want %q", method, got, want)
+				}
+			}
+			if f.get("default", "b 1", tc.key) == nil {
+				t.Errorf("key stored as %q, want %q", f.keys("default", "b 1"), tc.key)
+			}
+		})
+	}
+}
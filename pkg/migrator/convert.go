@@ -0,0 +1,339 @@
+package migrator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// convertFile is a key file of a directory backup being converted. key is
+// escaped, entry is its manifest entry if any.
+type convertFile struct {
+	rel                     string
+	bucketType, bucket, key string
+	entry                   *manifestEntry
+}
+
+// ConvertDir writes every key file of the directory backup in BackupDir
+// to w as an NDJSON backup stream, without any cluster. The checksums,
+// sizes and modification times of the manifest are checked and carried
+// over, files not matching them are reported and skipped.
+func (m *Migrator) ConvertDir(ctx context.Context, w io.Writer) error {
+	dir := m.cfg.BackupDir
+	version, err := checkDirFormat(dir)
+	if err != nil {
+		return err
+	}
+	entries, err := readManifest(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		m.log.Println("WARN: no manifest in the backup dir, the key files can't be checked")
+	} else if err != nil {
+		return fmt.Errorf("read manifest: %w", err)
+	}
+
+	var (
+		converted, malformed int64
+		failure              error
+		failureOnce          sync.Once
+	)
+	report := func(rel string, err error) {
+		atomic.AddInt64(&malformed, 1)
+		m.log.Printf("WARN: skip '%s': %s\n", rel, err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	out := &recordWriter{w: w}
+	files := make(chan convertFile)
+	var wg sync.WaitGroup
+	for i := 0; i < m.cfg.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range files {
+				err := m.convertFile(out, file)
+				var invalid *invalidFileError
+				switch {
+				case errors.As(err, &invalid):
+					report(file.rel, invalid.err)
+				case err != nil:
+					failureOnce.Do(func() {
+						failure = fmt.Errorf("convert '%s': %w", file.rel, err)
+						cancel()
+					})
+				default:
+					atomic.AddInt64(&converted, 1)
+					atomic.AddInt64(&m.progress.keys, 1)
+				}
+			}
+		}()
+	}
+
+	tick := time.NewTicker(time.Second * 5)
+	defer tick.Stop()
+
+	// The long keys of the bucket dir being walked.
+	var (
+		longKeysDir string
+		longKeys    map[string]string
+	)
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !isKeyFile(entry.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		bucketType, bucket, key, err := parseBackupPath(rel, version)
+		if err != nil {
+			report(rel, err)
+			return nil
+		}
+		if isHashedFileName(key) {
+			if dir := filepath.Dir(path); dir != longKeysDir {
+				if longKeys, err = readLongKeys(dir); err != nil {
+					return err
+				}
+				longKeysDir = dir
+			}
+			if key = longKeys[key]; key == "" {
+				report(rel, fmt.Errorf("key missing from %s", longKeysName))
+				return nil
+			}
+		}
+
+		file := convertFile{rel: rel, bucketType: bucketType, bucket: bucket, key: key}
+		if e, ok := entries[rel]; ok {
+			file.entry = &e
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-tick.C:
+				m.log.Printf("INFO: convert progress: %d files\n", atomic.LoadInt64(&converted))
+			case files <- file:
+				return nil
+			}
+		}
+	})
+	close(files)
+	wg.Wait()
+	if failure != nil {
+		return failure
+	}
+	if err != nil {
+		return fmt.Errorf("walk backup dir: %w", err)
+	}
+	return m.logConversion(converted, malformed, 0)
+}
+
+// invalidFileError is a key file not matching its manifest entry.
+type invalidFileError struct {
+	err error
+}
+
+func (e *invalidFileError) Error() string { return e.err.Error() }
+
+// convertFile writes a key file as a record to out. Values larger than
+// spillSize are checksummed first and then streamed, so they are never
+// held in memory.
+func (m *Migrator) convertFile(out *recordWriter, file convertFile) error {
+	path := filepath.Join(m.cfg.BackupDir, file.rel)
+	rec := record{
+		BucketType: file.bucketType,
+		Bucket:     file.bucket,
+		Key:        file.key,
+		Format:     formatVersion,
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if size <= spillSize {
+		if rec.Value, err = os.ReadFile(path); err != nil {
+			return err
+		}
+		size, rec.SHA256 = int64(len(rec.Value)), checksum(rec.Value)
+	} else if size, rec.SHA256, err = fileChecksum(path); err != nil {
+		return err
+	}
+
+	if e := file.entry; e != nil {
+		if size != e.Size || rec.SHA256 != e.SHA256 {
+			return &invalidFileError{fmt.Errorf("size %d sha256 %s, manifest size %d sha256 %s", size, rec.SHA256, e.Size, e.SHA256)}
+		}
+		rec.LastModified = e.LastModified
+	}
+
+	if rec.Value != nil || size == 0 {
+		return out.Write(rec)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return out.WriteStream(rec, f)
+}
+
+// ConvertNDJSON writes every record of an NDJSON backup stream read from r
+// as a key file of a directory backup in BackupDir, with its manifest,
+// without any cluster. Malformed records and ones not matching their
+// checksum are reported and skipped. The directory format has no place
+// for the content type, metadata headers and vclock of records, they are
+// dropped, as are all but the last modified sibling of keys with siblings.
+func (m *Migrator) ConvertNDJSON(ctx context.Context, r io.Reader) error {
+	dir := m.cfg.BackupDir
+	if err := mkdir(dir); err != nil {
+		return err
+	}
+	var err error
+	if m.manifest, err = openManifest(dir); err != nil {
+		return err
+	}
+	if err = writeDirFormat(dir, m.fsync); err != nil {
+		_ = m.manifest.Close(nil)
+		return err
+	}
+
+	type line struct {
+		n    int
+		data []byte
+	}
+	var (
+		converted, malformed, dropped int64
+		failure                       error
+		failureOnce                   sync.Once
+		dirsMu                        sync.Mutex
+		dirs                          = make(map[string]bool)
+	)
+	report := func(n int, err error) {
+		atomic.AddInt64(&malformed, 1)
+		m.log.Printf("WARN: skip line %d: %s\n", n, err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lines := make(chan line)
+	var wg sync.WaitGroup
+	for i := 0; i < m.cfg.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ln := range lines {
+				var kv record
+				err := json.Unmarshal(ln.data, &kv)
+				if err == nil {
+					err = checkFormat(kv.Format)
+				}
+				if err != nil {
+					report(ln.n, fmt.Errorf("malformed record: %w", err))
+					continue
+				}
+				key, err := unescapeKey(kv.Key)
+				if err != nil {
+					report(ln.n, fmt.Errorf("unescape key: %w", err))
+					continue
+				}
+				siblings := len(kv.Siblings) > 0
+				kv = kv.resolve()
+				if sum := checksum(kv.Value); kv.SHA256 != "" && sum != kv.SHA256 {
+					report(ln.n, fmt.Errorf("%s/%s/%s: sha256 %s, recorded %s", kv.BucketType, kv.Bucket, kv.Key, sum, kv.SHA256))
+					continue
+				}
+				if kv.ContentType != "" && kv.ContentType != "application/json" || len(kv.Headers) > 0 || kv.VClock != "" || siblings {
+					atomic.AddInt64(&dropped, 1)
+				}
+
+				path := filepath.Join(dir, bucketDir(kv.BucketType, kv.Bucket))
+				dirsMu.Lock()
+				if !dirs[path] {
+					err = os.MkdirAll(path, 0777)
+					dirs[path] = err == nil
+				}
+				dirsMu.Unlock()
+				if err == nil {
+					obj := &object{
+						Header: http.Header{"Last-Modified": {kv.LastModified}},
+						Body:   io.NopCloser(bytes.NewReader(kv.Value)),
+						Size:   int64(len(kv.Value)),
+					}
+					_, _, err = m.backupKey(kv.BucketType, kv.Bucket, key, obj)
+				}
+				if err != nil {
+					failureOnce.Do(func() {
+						failure = fmt.Errorf("line %d: %w", ln.n, err)
+						cancel()
+					})
+					continue
+				}
+				atomic.AddInt64(&converted, 1)
+				atomic.AddInt64(&m.progress.keys, 1)
+			}
+		}()
+	}
+
+	tick := time.NewTicker(time.Second * 5)
+	defer tick.Stop()
+
+	records := NewLineIterator(r)
+	for n := 1; err == nil; n++ {
+		var data []byte
+		if data, err = records.Next(); err != nil {
+			break
+		}
+		for sent := false; !sent && err == nil; {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-tick.C:
+				m.log.Printf("INFO: convert progress: %d records\n", atomic.LoadInt64(&converted))
+			case lines <- line{n, data}:
+				sent = true
+			}
+		}
+	}
+	close(lines)
+	wg.Wait()
+	if closeErr := m.manifest.Close(m.fsync); failure == nil {
+		failure = closeErr
+	}
+	if failure != nil {
+		return failure
+	}
+	if err != io.EOF {
+		return fmt.Errorf("read backup: %w", err)
+	}
+	return m.logConversion(converted, malformed, dropped)
+}
+
+// logConversion logs the outcome of a conversion, which fails if some
+// entries were malformed.
+func (m *Migrator) logConversion(converted, malformed, dropped int64) error {
+	if dropped > 0 {
+		m.log.Printf("WARN: dropped the content type, metadata headers, vclock or other siblings of %d records, which backup dirs can't hold\n", dropped)
+	}
+	m.log.Printf("INFO: converted %d keys, skipped %d malformed\n", converted, malformed)
+	if malformed > 0 {
+		return fmt.Errorf("%d of %d entries malformed: %w", malformed, converted+malformed, ErrKeysFailed)
+	}
+	return nil
+}
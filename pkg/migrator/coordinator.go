@@ -0,0 +1,307 @@
+package migrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// queuedBatches is the number of batches listed ahead of the workers.
+	queuedBatches = 64
+	// coordinatorGrace is how long a finished coordinator keeps telling
+	// polling workers that the run is over.
+	coordinatorGrace = 5 * time.Second
+)
+
+// batch is a batch of keys of a bucket handed to a worker. Keys are
+// escaped like in backups.
+type batch struct {
+	ID         int      `json:"id"`
+	BucketType string   `json:"bucket_type"`
+	Bucket     string   `json:"bucket"`
+	Keys       []string `json:"keys"`
+}
+
+// batchResult is what a worker reports for a batch: the number of keys by
+// outcome, and the errors of the failed keys.
+type batchResult struct {
+	ID       int      `json:"id"`
+	Worker   string   `json:"worker"`
+	Outcomes []int64  `json:"outcomes"`
+	Failures []string `json:"failures"`
+}
+
+// lease is a batch handed to a worker until expires.
+type lease struct {
+	batch   *batch
+	worker  string
+	expires time.Time
+}
+
+// coordinator hands out the batches listed by Coordinate to the workers.
+type coordinator struct {
+	m            *Migrator
+	leaseTimeout time.Duration
+	ready        chan *batch
+
+	mu       sync.Mutex
+	requeued []*batch
+	leases   map[int]*lease
+	done     map[int]bool
+	listed   int
+	listDone bool
+	finished chan struct{}
+}
+
+// Coordinate lists the keys of every bucket of the configured bucket
+// types, syncing the props of the buckets on the way, and serves them in
+// batches of batchSize keys to the workers running Join on addr. A batch
+// not reported by its worker within leaseTimeout is handed to another
+// one. It returns when every batch is done.
+func (m *Migrator) Coordinate(ctx context.Context, addr string, batchSize int, leaseTimeout time.Duration) error {
+	m.mode = modeMigrate
+	types, err := m.bucketTypes(ctx)
+	if err != nil {
+		return err
+	}
+
+	c := &coordinator{
+		m:            m,
+		leaseTimeout: leaseTimeout,
+		ready:        make(chan *batch, queuedBatches),
+		leases:       make(map[int]*lease),
+		done:         make(map[int]bool),
+		finished:     make(chan struct{}),
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lease", c.serveLease)
+	mux.HandleFunc("/complete", c.serveComplete)
+	server := &http.Server{Handler: mux}
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+	m.log.Printf("INFO: coordinator listening on %s\n", listener.Addr())
+
+	listErr := make(chan error, 1)
+	go func() {
+		listErr <- c.list(ctx, types, batchSize)
+	}()
+
+	tick := time.NewTicker(time.Second * 5)
+	defer tick.Stop()
+	for {
+		select {
+		case err = <-listErr:
+			if err != nil {
+				return err
+			}
+			listErr = nil
+		case <-c.finished:
+			m.log.Printf("INFO: keys: %s\n", &m.totals)
+			// Let the polling workers learn that the run is over.
+			select {
+			case <-time.After(coordinatorGrace):
+			case <-ctx.Done():
+			}
+			if failed := atomic.LoadInt64(&m.failed); failed > 0 {
+				return fmt.Errorf("%d keys failed: %w", failed, ErrKeysFailed)
+			}
+			return nil
+		case <-tick.C:
+			c.progress()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// list queues the keys of the buckets of types in batches.
+func (c *coordinator) list(ctx context.Context, types []string, batchSize int) error {
+	m := c.m
+	for _, bucketType := range types {
+		buckets, err := m.source.ListBuckets(ctx, bucketType)
+		if err != nil {
+			return fmt.Errorf("get list of bucket err: %w", err)
+		}
+
+		for _, bucket := range buckets {
+			err = m.retry(ctx, func() error {
+				return m.syncProperties(ctx, bucketType, bucket)
+			})
+			if err != nil {
+				return fmt.Errorf("sync bucket %s err: props: %w", bucket, err)
+			}
+
+			b := &batch{BucketType: bucketType, Bucket: bucket}
+			err = m.listKeys(ctx, m.source, bucketType, bucket, func(key string) error {
+				b.Keys = append(b.Keys, escapeKey(key))
+				if len(b.Keys) < batchSize {
+					return nil
+				}
+				next := &batch{BucketType: bucketType, Bucket: bucket}
+				err := c.queue(ctx, b)
+				b = next
+				return err
+			}, func() {})
+			if err != nil && !errors.Is(err, errNotFound) {
+				return fmt.Errorf("list keys of bucket %s: %w", bucket, err)
+			}
+			if len(b.Keys) > 0 {
+				if err = c.queue(ctx, b); err != nil {
+					return err
+				}
+			}
+			m.log.Printf("INFO: listed bucket '%s'\n", bucket)
+		}
+	}
+
+	c.mu.Lock()
+	c.listDone = true
+	c.checkFinished()
+	c.mu.Unlock()
+	return nil
+}
+
+// queue numbers b and waits for room for it.
+func (c *coordinator) queue(ctx context.Context, b *batch) error {
+	c.mu.Lock()
+	c.listed++
+	b.ID = c.listed
+	c.mu.Unlock()
+
+	select {
+	case c.ready <- b:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// serveLease hands a batch to the worker of the request. It answers 204
+// when no batch is ready yet and 410 when the run is over.
+func (c *coordinator) serveLease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	worker := r.URL.Query().Get("worker")
+
+	c.mu.Lock()
+	c.expire()
+	var b *batch
+	if len(c.requeued) > 0 {
+		b, c.requeued = c.requeued[0], c.requeued[1:]
+	} else {
+		select {
+		case b = <-c.ready:
+		default:
+		}
+	}
+	if b != nil {
+		c.leases[b.ID] = &lease{batch: b, worker: worker, expires: time.Now().Add(c.leaseTimeout)}
+	}
+	over := b == nil && c.isFinished()
+	c.mu.Unlock()
+
+	switch {
+	case b != nil:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(b)
+	case over:
+		w.WriteHeader(http.StatusGone)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// serveComplete records the result of a batch. Results of batches already
+// done, e.g. reported late by a worker whose lease expired, are ignored.
+func (c *coordinator) serveComplete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var res batchResult
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done[res.ID] || res.ID <= 0 || res.ID > c.listed {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if _, ok := c.leases[res.ID]; ok {
+		delete(c.leases, res.ID)
+	} else {
+		// Expired meanwhile, drop the batch from the requeued ones.
+		for i, b := range c.requeued {
+			if b.ID == res.ID {
+				c.requeued = append(c.requeued[:i], c.requeued[i+1:]...)
+				break
+			}
+		}
+	}
+	c.done[res.ID] = true
+
+	for o := outcome(0); o < numOutcomes && int(o) < len(res.Outcomes); o++ {
+		atomic.AddInt64(&c.m.totals[o], res.Outcomes[o])
+	}
+	for _, failure := range res.Failures {
+		c.m.log.Printf("ERR: worker %s: %s\n", res.Worker, failure)
+	}
+	atomic.AddInt64(&c.m.failed, int64(len(res.Failures)))
+	c.checkFinished()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// expire requeues the batches of expired leases. c.mu must be held.
+func (c *coordinator) expire() {
+	now := time.Now()
+	for id, l := range c.leases {
+		if now.After(l.expires) {
+			c.m.log.Printf("WARN: lease of batch %d by worker %s expired, handing it out again\n", id, l.worker)
+			delete(c.leases, id)
+			c.requeued = append(c.requeued, l.batch)
+		}
+	}
+}
+
+// isFinished reports whether every batch is listed and done. c.mu must be
+// held.
+func (c *coordinator) isFinished() bool {
+	return c.listDone && len(c.done) == c.listed
+}
+
+// checkFinished closes finished once the run is over. c.mu must be held.
+func (c *coordinator) checkFinished() {
+	if c.isFinished() {
+		select {
+		case <-c.finished:
+		default:
+			close(c.finished)
+		}
+	}
+}
+
+func (c *coordinator) progress() {
+	c.mu.Lock()
+	c.expire()
+	done, listed, leased := len(c.done), c.listed, len(c.leases)
+	c.mu.Unlock()
+	c.m.log.Printf("INFO: coordinator progress: %d of %d listed batches done, %d leased (%s)\n",
+		done, listed, leased, &c.m.totals)
+}
@@ -0,0 +1,88 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// BucketCount is the number of keys of a bucket on the source and, when
+// counted, on the destination.
+type BucketCount struct {
+	BucketType  string `json:"bucket_type"`
+	Bucket      string `json:"bucket"`
+	Source      int64  `json:"source"`
+	Destination *int64 `json:"destination,omitempty"`
+}
+
+// Count counts the keys of every bucket of the configured bucket types on
+// the source, and on the destination too with withDestination, without
+// fetching any value. Buckets are sorted by bucket type and name.
+func (m *Migrator) Count(ctx context.Context, withDestination bool) ([]BucketCount, error) {
+	types, err := m.bucketTypes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var counts []BucketCount
+	for _, bucketType := range types {
+		source, err := m.countBuckets(ctx, m.source, bucketType)
+		if err != nil {
+			return nil, fmt.Errorf("count source: %w", err)
+		}
+
+		var destination map[string]int64
+		if withDestination {
+			if destination, err = m.countBuckets(ctx, m.destination, m.destType(bucketType)); err != nil {
+				return nil, fmt.Errorf("count destination: %w", err)
+			}
+		}
+
+		for bucket, n := range source {
+			c := BucketCount{BucketType: bucketType, Bucket: bucket, Source: n}
+			if withDestination {
+				d := destination[bucket]
+				c.Destination = &d
+			}
+			counts = append(counts, c)
+		}
+		for bucket, n := range destination {
+			if _, ok := source[bucket]; !ok {
+				d := n
+				counts = append(counts, BucketCount{BucketType: bucketType, Bucket: bucket, Destination: &d})
+			}
+		}
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].BucketType != counts[j].BucketType {
+			return counts[i].BucketType < counts[j].BucketType
+		}
+		return counts[i].Bucket < counts[j].Bucket
+	})
+	return counts, nil
+}
+
+// countBuckets counts the keys of every bucket of a bucket type of client.
+func (m *Migrator) countBuckets(ctx context.Context, client riakClient, bucketType string) (map[string]int64, error) {
+	buckets, err := client.ListBuckets(ctx, bucketType)
+	if err != nil {
+		return nil, fmt.Errorf("get list of bucket err: %w", err)
+	}
+
+	counts := make(map[string]int64, len(buckets))
+	for _, bucket := range buckets {
+		var n int64
+		err = m.listKeys(ctx, client, bucketType, bucket, func(string) error {
+			n++
+			return nil
+		}, func() {})
+		if err != nil && !errors.Is(err, errNotFound) {
+			return nil, fmt.Errorf("list keys of bucket %s: %w", bucket, err)
+		}
+		m.log.Printf("INFO: type '%s' bucket '%s': %d keys\n", bucketType, bucket, n)
+		counts[bucket] = n
+	}
+	return counts, nil
+}
@@ -0,0 +1,22 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+)
+
+// deleteKey deletes a key of a bucket Delete empties, or only counts it
+// with DryRun.
+func (m *Migrator) deleteKey(ctx context.Context, bucketType, bucket, key string) (outcome, error) {
+	if m.cfg.DryRun {
+		return wouldDelete, nil
+	}
+	err := m.source.DeleteObject(ctx, bucketType, bucket, key)
+	if errors.Is(err, errNotFound) {
+		return skippedVanished, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
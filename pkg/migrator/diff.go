@@ -0,0 +1,360 @@
+package migrator
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrDifferent matches the error of a diff that found differences.
+var ErrDifferent = errors.New("clusters differ")
+
+// diffPartitions is the number of files the keys of a bucket are spread
+// over, so a diff holds about 1/diffPartitions of a bucket in memory.
+const diffPartitions = 64
+
+// Statuses of the keys of a diff report.
+const (
+	diffOnlySource      = "only_source"
+	diffOnlyDestination = "only_destination"
+	diffDifferentETag   = "different_etag"
+)
+
+// diffRecord is a line of a diff report. Key is escaped like in backups.
+// Keys only on the destination are named as they are there, after the
+// bucket type, bucket and key mappings, the others as on the source.
+type diffRecord struct {
+	BucketType string `json:"bucket_type"`
+	Bucket     string `json:"bucket"`
+	Key        string `json:"key"`
+	Status     string `json:"status"`
+}
+
+// diffCounts tallies the keys of a bucket in a diff.
+type diffCounts struct {
+	onlySource, onlyDestination, both, differentETag int64
+}
+
+func (c diffCounts) differs() bool {
+	return c.onlySource > 0 || c.onlyDestination > 0 || c.differentETag > 0
+}
+
+// Diff lists the keys of every bucket of the configured bucket types on
+// both clusters and writes the keys found on one side only to w as NDJSON,
+// without fetching any value. With DiffETags the ETags of keys found on
+// both are compared too. It returns ErrDifferent when they differ.
+func (m *Migrator) Diff(ctx context.Context, w io.Writer) error {
+	types, err := m.bucketTypes(ctx)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp("", "riak-migrator-diff-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	out := bufio.NewWriter(w)
+	enc := json.NewEncoder(out)
+	var total diffCounts
+	for _, bucketType := range types {
+		buckets, err := m.diffBuckets(ctx, bucketType)
+		if err != nil {
+			return err
+		}
+
+		for _, bucket := range buckets {
+			c, err := m.diffBucket(ctx, tmp, enc, bucketType, bucket)
+			if err != nil {
+				return fmt.Errorf("diff bucket %s err: %w", bucket, err)
+			}
+			m.log.Printf("INFO: diff type '%s' bucket '%s': %d only on source, %d only on destination, %d on both, %d with different etag\n",
+				bucketType, bucket, c.onlySource, c.onlyDestination, c.both, c.differentETag)
+			total.onlySource += c.onlySource
+			total.onlyDestination += c.onlyDestination
+			total.both += c.both
+			total.differentETag += c.differentETag
+		}
+	}
+
+	m.log.Printf("INFO: diff: %d only on source, %d only on destination, %d on both, %d with different etag\n",
+		total.onlySource, total.onlyDestination, total.both, total.differentETag)
+	if err = out.Flush(); err != nil {
+		return err
+	}
+	if total.differs() {
+		return ErrDifferent
+	}
+	return nil
+}
+
+// diffBuckets returns the source buckets of a bucket type on either
+// cluster: the buckets of the source, and the buckets of the destination no
+// source bucket maps to. Within one cluster, only the mapped buckets are
+// compared with the buckets they map to.
+func (m *Migrator) diffBuckets(ctx context.Context, bucketType string) ([]string, error) {
+	if m.sameCluster() {
+		return mappedBuckets(m.cfg.BucketMap), nil
+	}
+	source, err := m.source.ListBuckets(ctx, bucketType)
+	if err != nil {
+		return nil, fmt.Errorf("get list of source bucket err: %w", err)
+	}
+	destination, err := m.destination.ListBuckets(ctx, m.destType(bucketType))
+	if err != nil {
+		return nil, fmt.Errorf("get list of destination bucket err: %w", err)
+	}
+
+	seen := make(map[string]bool, len(source))
+	mapped := make(map[string]bool, len(source))
+	var buckets []string
+	for _, bucket := range source {
+		if !seen[bucket] {
+			seen[bucket] = true
+			mapped[m.destBucket(bucket)] = true
+			buckets = append(buckets, bucket)
+		}
+	}
+	for _, bucket := range destination {
+		// A bucket mapped to another one has no counterpart on the source.
+		if !seen[bucket] && !mapped[bucket] && m.destBucket(bucket) == bucket {
+			seen[bucket] = true
+			buckets = append(buckets, bucket)
+		}
+	}
+	sort.Strings(buckets)
+	return buckets, nil
+}
+
+// diffBucket compares the keys of a source bucket with the keys of the
+// destination bucket it maps to, by their destination keys. Source keys
+// with no destination key are left out, as a migration skips them.
+func (m *Migrator) diffBucket(ctx context.Context, tmp string, enc *json.Encoder, bucketType, bucket string) (diffCounts, error) {
+	var c diffCounts
+	dstType, dstBucket := m.destType(bucketType), m.destBucket(bucket)
+	if err := m.partitionKeys(ctx, m.source, bucketType, bucket, filepath.Join(tmp, "source"), m.destKey); err != nil {
+		return c, fmt.Errorf("list source keys: %w", err)
+	}
+	if err := m.partitionKeys(ctx, m.destination, dstType, dstBucket, filepath.Join(tmp, "destination"), nil); err != nil {
+		return c, fmt.Errorf("list destination keys: %w", err)
+	}
+
+	write := func(key, status string) error {
+		if status == diffOnlyDestination {
+			return enc.Encode(diffRecord{BucketType: dstType, Bucket: dstBucket, Key: key, Status: status})
+		}
+		return enc.Encode(diffRecord{BucketType: bucketType, Bucket: bucket, Key: key, Status: status})
+	}
+
+	for p := 0; p < diffPartitions; p++ {
+		source, err := readPartition(filepath.Join(tmp, "source"), p)
+		if err != nil {
+			return c, err
+		}
+		destination, err := readPartition(filepath.Join(tmp, "destination"), p)
+		if err != nil {
+			return c, err
+		}
+
+		var (
+			both            []keyPair
+			onlyDestination []string
+		)
+		for key := range destination {
+			if sourceKey, ok := source[key]; ok {
+				both = append(both, keyPair{source: sourceKey, destination: key})
+				delete(source, key)
+			} else {
+				onlyDestination = append(onlyDestination, key)
+			}
+		}
+		onlySource := make([]string, 0, len(source))
+		for _, key := range source {
+			onlySource = append(onlySource, key)
+		}
+		sort.Strings(onlySource)
+		sort.Strings(onlyDestination)
+
+		for _, key := range onlySource {
+			if err = write(key, diffOnlySource); err != nil {
+				return c, err
+			}
+		}
+		for _, key := range onlyDestination {
+			if err = write(key, diffOnlyDestination); err != nil {
+				return c, err
+			}
+		}
+		c.onlySource += int64(len(onlySource))
+		c.onlyDestination += int64(len(onlyDestination))
+		c.both += int64(len(both))
+
+		if m.cfg.DiffETags {
+			different, err := m.diffETags(ctx, bucketType, bucket, both)
+			if err != nil {
+				return c, err
+			}
+			for _, key := range different {
+				c.differentETag++
+				if err = write(key, diffDifferentETag); err != nil {
+					return c, err
+				}
+			}
+		}
+	}
+	return c, nil
+}
+
+// keyPair is a source key and its destination key, both escaped.
+type keyPair struct {
+	source, destination string
+}
+
+// partitionKeys writes the escaped keys of a bucket of client to
+// diffPartitions files in dir by the hash of their destination key, which
+// destKey maps them to when not nil. A key with a different destination
+// key is written after it, separated by a space, which escaped keys have
+// none of.
+func (m *Migrator) partitionKeys(ctx context.Context, client riakClient, bucketType, bucket, dir string, destKey func(string) (string, bool)) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+
+	files := make([]*os.File, diffPartitions)
+	writers := make([]*bufio.Writer, diffPartitions)
+	for p := range files {
+		f, err := os.Create(partitionPath(dir, p))
+		if err != nil {
+			for _, f := range files[:p] {
+				_ = f.Close()
+			}
+			return err
+		}
+		files[p], writers[p] = f, bufio.NewWriter(f)
+	}
+
+	err := m.listKeys(ctx, client, bucketType, bucket, func(key string) error {
+		line := escapeKey(key)
+		dstKey := key
+		if destKey != nil {
+			var ok bool
+			if dstKey, ok = destKey(key); !ok {
+				return nil
+			}
+			if dstKey != key {
+				line = escapeKey(dstKey) + " " + line
+			}
+		}
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(dstKey))
+		w := writers[h.Sum32()%diffPartitions]
+		_, err := w.WriteString(line + "\n")
+		return err
+	}, func() {})
+	if errors.Is(err, errNotFound) {
+		err = nil
+	}
+
+	for p, f := range files {
+		if flushErr := writers[p].Flush(); err == nil {
+			err = flushErr
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func partitionPath(dir string, p int) string {
+	return filepath.Join(dir, fmt.Sprintf("%02d", p))
+}
+
+// readPartition returns the keys of a partition file, mapping the escaped
+// destination keys to the escaped keys they were listed as.
+func readPartition(dir string, p int) (map[string]string, error) {
+	f, err := os.Open(partitionPath(dir, p))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		dstKey, key, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			key = dstKey
+		}
+		keys[dstKey] = key
+	}
+	return keys, scanner.Err()
+}
+
+// diffETags returns the escaped source keys whose ETags differ from the
+// ones of their destination keys. Riak assigns an ETag on every write, so
+// they only match for keys written by the same write, e.g. by replication.
+func (m *Migrator) diffETags(ctx context.Context, bucketType, bucket string, keys []keyPair) ([]string, error) {
+	var (
+		mu        sync.Mutex
+		different []string
+		failure   error
+		wg        sync.WaitGroup
+	)
+	keysC := make(chan keyPair)
+	for i := 0; i < m.cfg.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keysC {
+				same, err := m.sameETag(ctx, bucketType, bucket, key)
+				mu.Lock()
+				if err != nil && failure == nil {
+					failure = fmt.Errorf("compare etag of '%s': %w", key.source, err)
+				} else if err == nil && !same {
+					different = append(different, key.source)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, key := range keys {
+		keysC <- key
+	}
+	close(keysC)
+	wg.Wait()
+
+	sort.Strings(different)
+	return different, failure
+}
+
+func (m *Migrator) sameETag(ctx context.Context, bucketType, bucket string, keys keyPair) (bool, error) {
+	key, err := unescapeKey(keys.source)
+	if err != nil {
+		return false, err
+	}
+	dstKey, err := unescapeKey(keys.destination)
+	if err != nil {
+		return false, err
+	}
+	ctx = m.trace(ctx, bucketType, bucket, key)
+	src, err := m.source.HeadObject(ctx, bucketType, bucket, key)
+	if err != nil {
+		return false, fmt.Errorf("head source: %w", err)
+	}
+	dst, err := m.destination.HeadObject(ctx, m.destType(bucketType), m.destBucket(bucket), dstKey)
+	if err != nil {
+		return false, fmt.Errorf("head destination: %w", err)
+	}
+	return src.Get("ETag") == dst.Get("ETag"), nil
+}
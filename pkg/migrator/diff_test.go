@@ -0,0 +1,110 @@
+package migrator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDiffBucketMapSameCluster(t *testing.T) {
+	f := newFakeRiak(t)
+	f.put("default", "events_2023", "k1", "v1")
+	f.put("default", "events_2023", "k2", "v2")
+	f.put("default", "events_2023", "k3", "v3")
+	f.put("default", "events_archive", "k1", "v1")
+	f.put("default", "events_archive", "k2", "changed")
+	f.put("default", "events_archive", "k4", "v4")
+	// Not in the bucket map, so not compared.
+	f.put("default", "users", "u1", "v1")
+
+	cfg := Config{
+		Source:      f.URL,
+		Destination: f.URL,
+		BucketMap:   map[string]string{"events_2023": "events_archive"},
+		DiffETags:   true,
+	}
+	records, err := runDiff(t, cfg)
+	if !errors.Is(err, ErrDifferent) {
+		t.Errorf("diff = %v, want ErrDifferent", err)
+	}
+	want := []diffRecord{
+		{BucketType: "default", Bucket: "events_2023", Key: "k2", Status: diffDifferentETag},
+		{BucketType: "default", Bucket: "events_2023", Key: "k3", Status: diffOnlySource},
+		{BucketType: "default", Bucket: "events_archive", Key: "k4", Status: diffOnlyDestination},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("diff records\n%+v\nwant\n%+v", records, want)
+	}
+
+	// A copy makes them equal.
+	f.put("default", "events_archive", "k2", "v2")
+	f.put("default", "events_archive", "k3", "v3")
+	f.put("default", "events_2023", "k4", "v4")
+	if records, err = runDiff(t, cfg); err != nil || len(records) > 0 {
+		t.Errorf("diff of copied buckets = %+v, %v", records, err)
+	}
+}
+
+func TestDiffBucketMapAndKeyPrefix(t *testing.T) {
+	source, destination := newFakeRiak(t), newFakeRiak(t)
+	source.put("default", "users", "a", "v1")
+	source.put("default", "users", "b", "v2")
+	source.put("default", "users", "c", "v3")
+	source.put("default", "plain", "p1", "v1")
+	destination.put("default", "users_v2", "v2:a", "v1")
+	destination.put("default", "users_v2", "v2:b", "changed")
+	destination.put("default", "users_v2", "v2:d", "v4")
+	destination.put("default", "plain", "v2:p1", "v1")
+	destination.put("default", "other", "x", "v1")
+
+	records, err := runDiff(t, Config{
+		Source:       source.URL,
+		Destination:  destination.URL,
+		BucketMap:    map[string]string{"users": "users_v2"},
+		KeyPrefixAdd: "v2:",
+		DiffETags:    true,
+	})
+	if !errors.Is(err, ErrDifferent) {
+		t.Errorf("diff = %v, want ErrDifferent", err)
+	}
+	// Keys on the source are named as there, the others as on the
+	// destination.
+	want := []diffRecord{
+		{BucketType: "default", Bucket: "other", Key: "x", Status: diffOnlyDestination},
+		{BucketType: "default", Bucket: "users", Key: "b", Status: diffDifferentETag},
+		{BucketType: "default", Bucket: "users", Key: "c", Status: diffOnlySource},
+		{BucketType: "default", Bucket: "users_v2", Key: "v2%3Ad", Status: diffOnlyDestination},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("diff records\n%+v\nwant\n%+v", records, want)
+	}
+}
+
+// runDiff runs a diff of cfg and returns its records, sorted by bucket and
+// key.
+func runDiff(t *testing.T, cfg Config) ([]diffRecord, error) {
+	t.Helper()
+	var out bytes.Buffer
+	err := newTestMigrator(t, cfg).Diff(context.Background(), &out)
+
+	var records []diffRecord
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var rec diffRecord
+		if decodeErr := dec.Decode(&rec); decodeErr != nil {
+			t.Fatalf("decode diff report: %v", decodeErr)
+		}
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Bucket != records[j].Bucket {
+			return records[i].Bucket < records[j].Bucket
+		}
+		return records[i].Key < records[j].Key
+	})
+	return records, err
+}
@@ -0,0 +1,66 @@
+package migrator
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// dryRun tallies the keys a restore would write, and the malformed entries
+// of the backup.
+type dryRun struct {
+	keys      map[[2]string]int
+	malformed []string
+}
+
+func newDryRun() *dryRun {
+	return &dryRun{keys: make(map[[2]string]int)}
+}
+
+// check validates a backed up key, where names its file or line. key is
+// escaped.
+func (d *dryRun) check(where, bucketType, bucket, key string, size int64) {
+	if _, err := unescapeKey(key); err != nil {
+		d.invalid(where, fmt.Errorf("unescape key: %w", err))
+		return
+	}
+	if size == 0 {
+		d.invalid(where, errors.New("empty value"))
+		return
+	}
+	d.keys[[2]string{bucketType, bucket}]++
+}
+
+func (d *dryRun) invalid(where string, err error) {
+	d.malformed = append(d.malformed, fmt.Sprintf("%s: %s", where, err))
+}
+
+// reportDryRun logs the keys per bucket and the malformed entries, which
+// make it fail.
+func (m *Migrator) reportDryRun(d *dryRun) error {
+	buckets := make([][2]string, 0, len(d.keys))
+	for b := range d.keys {
+		buckets = append(buckets, b)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		if buckets[i][0] != buckets[j][0] {
+			return buckets[i][0] < buckets[j][0]
+		}
+		return buckets[i][1] < buckets[j][1]
+	})
+
+	total := 0
+	for _, b := range buckets {
+		m.log.Printf("INFO: dry run: type '%s' bucket '%s': %d keys\n", b[0], b[1], d.keys[b])
+		total += d.keys[b]
+	}
+	for _, entry := range d.malformed {
+		m.log.Printf("ERR: malformed %s\n", entry)
+	}
+	m.log.Printf("INFO: dry run: would restore %d keys of %d buckets, %d malformed entries\n", total, len(buckets), len(d.malformed))
+
+	if len(d.malformed) > 0 {
+		return fmt.Errorf("backup has %d malformed entries", len(d.malformed))
+	}
+	return nil
+}
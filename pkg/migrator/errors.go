@@ -0,0 +1,56 @@
+package migrator
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrKeysFailed matches the error of a run in which some keys failed.
+var ErrKeysFailed = errors.New("some keys failed")
+
+// multiError is the combined error of the keys or buckets that failed.
+type multiError []error
+
+// add appends err, flattening a multiError.
+func (e multiError) add(err error) multiError {
+	if errs, ok := err.(multiError); ok {
+		return append(e, errs...)
+	}
+	return append(e, err)
+}
+
+func (e multiError) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Is reports whether target is ErrKeysFailed or matches any of the
+// errors.
+func (e multiError) Is(target error) bool {
+	if target == ErrKeysFailed {
+		return true
+	}
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors that matches target.
+func (e multiError) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
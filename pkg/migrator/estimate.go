@@ -0,0 +1,105 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// BucketEstimate is the size of a bucket on the source estimated from the
+// HEADs of its keys: of all of them, or of the EstimateSample share.
+type BucketEstimate struct {
+	BucketType string `json:"bucket_type"`
+	Bucket     string `json:"bucket"`
+	// Keys is the number of keys listed, Headed the number of them whose
+	// size was read, summing to HeadedBytes.
+	Keys        int64 `json:"keys"`
+	Headed      int64 `json:"headed"`
+	HeadedBytes int64 `json:"headed_bytes"`
+	// Bytes is HeadedBytes extrapolated to all the keys.
+	Bytes int64 `json:"bytes"`
+}
+
+// Estimate lists the keys of every bucket of the configured bucket types
+// on the source and HEADs them, or their EstimateSample share, on the
+// worker pool to sum the sizes of their values, without fetching any.
+// Buckets are sorted by bucket type and name.
+func (m *Migrator) Estimate(ctx context.Context) ([]BucketEstimate, error) {
+	m.mode = modeEstimate
+	m.bucketsMu.Lock()
+	m.estimates = nil
+	m.bucketsMu.Unlock()
+	err := m.run(ctx)
+
+	m.bucketsMu.Lock()
+	estimates := append([]BucketEstimate(nil), m.estimates...)
+	m.bucketsMu.Unlock()
+	sort.Slice(estimates, func(i, j int) bool {
+		if estimates[i].BucketType != estimates[j].BucketType {
+			return estimates[i].BucketType < estimates[j].BucketType
+		}
+		return estimates[i].Bucket < estimates[j].Bucket
+	})
+	return estimates, err
+}
+
+// newEstimateSampler returns the sampler of the keys an estimate HEADs,
+// nil when it HEADs all of them.
+func (m *Migrator) newEstimateSampler() *sampler {
+	rate := m.cfg.EstimateSample
+	if m.mode != modeEstimate || rate <= 0 || rate >= 1 {
+		return nil
+	}
+	return &sampler{seed: m.cfg.SampleSeed, maxHash: uint64(rate * (1 << 63) * 2)}
+}
+
+// estimateKey HEADs a key on the source and adds the size of its value to
+// its bucket. Keys with siblings count without a size.
+func (m *Migrator) estimateKey(ctx context.Context, item workItem) (outcome, error) {
+	start := time.Now()
+	header, err := m.source.HeadObject(ctx, item.bucketType, item.bucket, item.key)
+	item.job.throughput.get(time.Since(start))
+	m.latencies.record(item.bucketType, opSourceHead, time.Since(start))
+	var se *statusError
+	switch {
+	case errors.Is(err, errNotFound):
+		return m.vanished(item.bucket, item.key), nil
+	case errors.As(err, &se) && se.code == 300:
+		return estimated, nil
+	case err != nil:
+		return 0, fmt.Errorf("head source: %w", err)
+	}
+
+	size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("head source: no size: %w", err)
+	}
+	atomic.AddInt64(&item.job.sized, size)
+	return estimated, nil
+}
+
+// addEstimate records the estimate of the bucket of job.
+func (m *Migrator) addEstimate(job *bucketJob) {
+	e := BucketEstimate{
+		BucketType:  job.bucketType,
+		Bucket:      job.bucket,
+		Keys:        atomic.LoadInt64(&job.listed),
+		Headed:      job.stats.get(estimated),
+		HeadedBytes: atomic.LoadInt64(&job.sized),
+	}
+	e.Bytes = e.HeadedBytes
+	if e.Headed > 0 && e.Headed < e.Keys {
+		e.Bytes = int64(math.Round(float64(e.HeadedBytes) * float64(e.Keys) / float64(e.Headed)))
+	}
+	m.log.Printf("INFO: bucket '%s' (%s) estimate: %d keys, %d bytes from %d HEADs\n",
+		job.bucket, job.bucketType, e.Keys, e.Bytes, e.Headed)
+
+	m.bucketsMu.Lock()
+	m.estimates = append(m.estimates, e)
+	m.bucketsMu.Unlock()
+}
@@ -0,0 +1,227 @@
+package migrator
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// failureRecord is a line of the failures file. Key is escaped like in
+// backups.
+type failureRecord struct {
+	BucketType string    `json:"bucket_type"`
+	Bucket     string    `json:"bucket"`
+	Key        string    `json:"key"`
+	Error      string    `json:"error"`
+	Time       time.Time `json:"time"`
+}
+
+// failureLog appends the keys failing a migration to the failures file as
+// they fail, a line written at once per key, so a run that crashes keeps
+// them. The file is flocked against other runs. It is safe for concurrent
+// use.
+type failureLog struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openFailureLog(path string) (*failureLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err = flock(file); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("lock %s, is another run using it: %w", path, err)
+	}
+	return &failureLog{path: path, file: file}, nil
+}
+
+func (l *failureLog) add(bucketType, bucket, key string, failure error) error {
+	b, err := json.Marshal(failureRecord{
+		BucketType: bucketType,
+		Bucket:     bucket,
+		Key:        escapeKey(key),
+		Error:      failure.Error(),
+		Time:       time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.file.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the file, syncing it with s.
+func (l *failureLog) Close(s *syncer) error {
+	err := s.file(l.file)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failures file: %w", err)
+	}
+	return nil
+}
+
+// recordFailure adds a failed key to the failures file, if any. The key
+// is still failed when the file can't be written.
+func (m *Migrator) recordFailure(item workItem, failure error) {
+	if m.failures == nil {
+		return
+	}
+	if err := m.failures.add(item.bucketType, item.bucket, item.key, failure); err != nil {
+		m.log.Printf("ERR: record failed key '%s' of bucket '%s' in %s: %s\n", item.key, item.bucket, m.failures.path, err)
+	}
+}
+
+// failedBucket has the keys of a bucket to retry, unescaped.
+type failedBucket struct {
+	bucketType string
+	bucket     string
+	keys       []string
+}
+
+// readFailures reads the failures file at path, flocked by f, and returns
+// the keys it has by bucket, each key once. Lines cut short by a crash are
+// ignored.
+func readFailures(f *os.File) ([]*failedBucket, int, error) {
+	var (
+		buckets []*failedBucket
+		byName  = make(map[string]*failedBucket)
+		seen    = make(map[keyHash]bool)
+		lines   int
+	)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var rec failureRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil {
+			continue
+		}
+		lines++
+		h := hashKey(rec.BucketType, rec.Bucket, rec.Key)
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		key, err := unescapeKey(rec.Key)
+		if err != nil {
+			continue
+		}
+		name := rec.BucketType + "/" + rec.Bucket
+		b := byName[name]
+		if b == nil {
+			b = &failedBucket{bucketType: rec.BucketType, bucket: rec.Bucket}
+			byName[name] = b
+			buckets = append(buckets, b)
+		}
+		b.keys = append(b.keys, key)
+	}
+	return buckets, lines, scanner.Err()
+}
+
+// ResumeFailures migrates again the keys of the failures file of earlier
+// migrations, each key once, and replaces the file with the keys failing
+// again. The file is kept as it was when the run is stopped before every
+// key was retried.
+func (m *Migrator) ResumeFailures(ctx context.Context) (err error) {
+	m.mode = modeMigrate
+	path := m.cfg.FailuresFile
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		m.log.Printf("INFO: no failures file %s, nothing to retry\n", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = flock(f); err != nil {
+		return fmt.Errorf("lock %s, is another run using it: %w", path, err)
+	}
+	buckets, lines, err := readFailures(f)
+	if err != nil {
+		return fmt.Errorf("read failures file: %w", err)
+	}
+	var keys int
+	for _, b := range buckets {
+		keys += len(b.keys)
+	}
+	m.log.Printf("INFO: retrying %d failed keys of %d buckets, from %d lines of %s\n", keys, len(buckets), lines, path)
+
+	tmp := path + ".retry"
+	if m.failures, err = openFailureLog(tmp); err != nil {
+		return err
+	}
+	if err = m.failures.file.Truncate(0); err != nil {
+		_ = m.failures.Close(nil)
+		return err
+	}
+	defer func() {
+		closeErr := m.failures.Close(m.fsync)
+		m.failures = nil
+		if err == nil {
+			err = closeErr
+		}
+		if ctx.Err() != nil || err != nil && !errors.Is(err, ErrKeysFailed) {
+			_ = os.Remove(tmp)
+			return
+		}
+		if renameErr := os.Rename(tmp, path); renameErr != nil && err == nil {
+			err = renameErr
+		}
+	}()
+
+	m.truncated, m.buckets, m.typeStats = nil, nil, nil
+	closePool := m.startPool(ctx)
+	defer closePool()
+	for _, b := range buckets {
+		if ctx.Err() != nil {
+			break
+		}
+		m.retryBucket(ctx, b)
+	}
+	m.log.Printf("INFO: keys: %s\n", &m.totals)
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	if n := atomic.LoadInt64(&m.failed); n > 0 {
+		return fmt.Errorf("%d keys failed again, left in %s: %w", n, path, ErrKeysFailed)
+	}
+	return nil
+}
+
+// retryBucket migrates the failed keys of a bucket on the worker pool. A
+// failed key doesn't stop the others.
+func (m *Migrator) retryBucket(ctx context.Context, b *failedBucket) {
+	started := time.Now()
+	job := &bucketJob{bucketType: b.bucketType, bucket: b.bucket, stop: func() {}}
+	m.activate(job)
+	atomic.StoreInt64(&job.listed, int64(len(b.keys)))
+	for _, key := range b.keys {
+		job.pending.Add(1)
+		select {
+		case <-ctx.Done():
+			job.pending.Done()
+		case m.work <- workItem{bucketType: b.bucketType, bucket: b.bucket, key: key, job: job}:
+			continue
+		}
+		break
+	}
+	job.pending.Wait()
+	m.deactivate(job)
+	m.typeCounters(b.bucketType).merge(&job.stats)
+	m.summarizeBucket(b.bucketType, b.bucket, job, started, job.err())
+	m.log.Printf("INFO: bucket '%s' (%s) retried %d keys: %s, %d failed\n", b.bucket, b.bucketType, len(b.keys), &job.stats, len(job.failures))
+}
@@ -0,0 +1,290 @@
+package migrator
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRiak is an in-memory Riak HTTP API for tests: bucket and key
+// listings, key GETs, HEADs, PUTs and DELETEs, bucket props, /ping and
+// /stats. It records the method, escaped path and query of every request.
+type fakeRiak struct {
+	*httptest.Server
+	// untyped also serves the default bucket type at the untyped /buckets
+	// endpoints, which are unknown otherwise.
+	untyped bool
+	// discard keeps only the size of the values PUT, for values too large
+	// to hold.
+	discard bool
+	// allowMult keeps a PUT without the current vclock of its key as a
+	// sibling, as a bucket with allow_mult does.
+	allowMult bool
+
+	mu       sync.Mutex
+	types    map[string]map[string]map[string]*fakeObject
+	props    map[string][]byte
+	requests []string
+	puts     int
+}
+
+// fakeVClock is the vclock of the values stored with put.
+const fakeVClock = "a85hYGBgzGDKBVIcypz/fgaUHjmdwZTImMfKsCFj"
+
+// fakeObject is a value stored in a fakeRiak, with the headers it was PUT
+// with: content type, metadata, indexes and links.
+type fakeObject struct {
+	value  []byte
+	size   int64
+	header http.Header
+	// vclock changes with every PUT, the same for values stored with put.
+	vclock string
+	// siblings counts the values kept besides value with allowMult.
+	siblings int
+}
+
+func newFakeRiak(t *testing.T) *fakeRiak {
+	f := &fakeRiak{
+		types: make(map[string]map[string]map[string]*fakeObject),
+		props: make(map[string][]byte),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// put stores a value with header, name and value pairs, and the content
+// type text/plain unless header has another.
+func (f *fakeRiak) put(bucketType, bucket, key, value string, header ...string) {
+	h := http.Header{}
+	for i := 0; i+1 < len(header); i += 2 {
+		h.Add(header[i], header[i+1])
+	}
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", "text/plain")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.bucket(bucketType, bucket, true)[key] = &fakeObject{value: []byte(value), size: int64(len(value)), header: h, vclock: fakeVClock}
+}
+
+// get returns a stored value, nil when missing.
+func (f *fakeRiak) get(bucketType, bucket, key string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.bucket(bucketType, bucket, false)[key]
+}
+
+// keys returns the keys of a bucket, sorted.
+func (f *fakeRiak) keys(bucketType, bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.bucket(bucketType, bucket, false) {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// requested returns the requests of method, as escaped paths with their
+// query, in the order received.
+func (f *fakeRiak) requested(method string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var paths []string
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, method+" ") {
+			paths = append(paths, strings.TrimPrefix(r, method+" "))
+		}
+	}
+	return paths
+}
+
+func (f *fakeRiak) resetRequests() {
+	f.mu.Lock()
+	f.requests = nil
+	f.mu.Unlock()
+}
+
+func (f *fakeRiak) bucket(bucketType, bucket string, create bool) map[string]*fakeObject {
+	if f.types[bucketType] == nil && create {
+		f.types[bucketType] = make(map[string]map[string]*fakeObject)
+	}
+	if f.types[bucketType][bucket] == nil && create {
+		f.types[bucketType][bucket] = make(map[string]*fakeObject)
+	}
+	return f.types[bucketType][bucket]
+}
+
+func (f *fakeRiak) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	request := r.Method + " " + r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		request += "?" + r.URL.RawQuery
+	}
+	f.requests = append(f.requests, request)
+	f.mu.Unlock()
+
+	path := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	for i := range path {
+		path[i], _ = url.PathUnescape(path[i])
+	}
+	if f.untyped && path[0] == "buckets" {
+		path = append([]string{"types", "default"}, path...)
+	}
+	switch {
+	case len(path) == 1 && path[0] == "ping":
+		_, _ = io.WriteString(w, "OK")
+	case len(path) == 1 && path[0] == "stats":
+		_, _ = io.WriteString(w, `{"ring_members":["riak@a"],"ring_num_partitions":8,"ring_creation_size":8,"ring_ownership":"[{'riak@a',8}]"}`)
+	case len(path) < 3 || path[0] != "types":
+		http.NotFound(w, r)
+	case len(path) == 3 && path[2] == "props":
+		_, _ = io.WriteString(w, `{"props":{}}`)
+	case len(path) == 3 && path[2] == "buckets":
+		f.listBuckets(w, path[1])
+	case len(path) == 5 && path[2] == "buckets" && path[4] == "props":
+		f.serveProps(w, r, path[1], path[3])
+	case len(path) == 5 && path[2] == "buckets" && path[4] == "keys":
+		f.listKeys(w, r, path[1], path[3])
+	case len(path) == 6 && path[2] == "buckets" && path[4] == "keys":
+		f.serveKey(w, r, path[1], path[3], path[5])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeRiak) listBuckets(w http.ResponseWriter, bucketType string) {
+	f.mu.Lock()
+	buckets := []string{}
+	for bucket := range f.types[bucketType] {
+		buckets = append(buckets, bucket)
+	}
+	f.mu.Unlock()
+	sort.Strings(buckets)
+	_ = json.NewEncoder(w).Encode(map[string][]string{"buckets": buckets})
+}
+
+func (f *fakeRiak) listKeys(w http.ResponseWriter, r *http.Request, bucketType, bucket string) {
+	keys := f.keys(bucketType, bucket)
+	if keys == nil {
+		http.NotFound(w, r)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string][]string{"keys": keys})
+}
+
+func (f *fakeRiak) serveProps(w http.ResponseWriter, r *http.Request, bucketType, bucket string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := bucketType + "/" + bucket
+	switch {
+	case r.Method == http.MethodPut:
+		f.props[name], _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	case f.props[name] != nil:
+		_, _ = w.Write(f.props[name])
+	case f.bucket(bucketType, bucket, false) != nil:
+		_, _ = io.WriteString(w, `{"props":{"n_val":3}}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeRiak) serveKey(w http.ResponseWriter, r *http.Request, bucketType, bucket, key string) {
+	if r.Method == http.MethodPut {
+		f.putKey(w, r, bucketType, bucket, key)
+		return
+	}
+
+	f.mu.Lock()
+	obj := f.bucket(bucketType, bucket, false)[key]
+	if obj != nil && r.Method == http.MethodDelete {
+		delete(f.types[bucketType][bucket], key)
+	}
+	f.mu.Unlock()
+	if obj == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	for name, values := range obj.header {
+		w.Header()[name] = values
+	}
+	etag := fmt.Sprintf(`"%x"`, md5.Sum(obj.value))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", time.Unix(1700000000, 0).UTC().Format(http.TimeFormat))
+	w.Header().Set("X-Riak-Vclock", obj.vclock)
+	w.Header().Set("Content-Length", fmt.Sprint(len(obj.value)))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(obj.value)
+	}
+}
+
+func (f *fakeRiak) putKey(w http.ResponseWriter, r *http.Request, bucketType, bucket, key string) {
+	obj := &fakeObject{header: http.Header{}}
+	for name, values := range r.Header {
+		if name == "Content-Type" || name == "Link" || strings.HasPrefix(name, "X-Riak-Meta-") || strings.HasPrefix(name, "X-Riak-Index-") {
+			obj.header[name] = values
+		}
+	}
+	var err error
+	if f.discard {
+		obj.size, err = io.Copy(io.Discard, r.Body)
+	} else {
+		obj.value, err = io.ReadAll(r.Body)
+		obj.size = int64(len(obj.value))
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("If-None-Match") == "*" && f.bucket(bucketType, bucket, false)[key] != nil {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	f.puts++
+	obj.vclock = fmt.Sprintf("vclock-%d", f.puts)
+	if current := f.bucket(bucketType, bucket, false)[key]; current != nil && f.allowMult && r.Header.Get("X-Riak-Vclock") != current.vclock {
+		obj.siblings = current.siblings + 1
+	}
+	f.bucket(bucketType, bucket, true)[key] = obj
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newTestMigrator returns a Migrator of the default bucket type between
+// source and destination, logging nowhere.
+func newTestMigrator(t *testing.T, cfg Config) *Migrator {
+	t.Helper()
+	if cfg.BucketTypes == nil {
+		cfg.BucketTypes = []string{"default"}
+	}
+	cfg.Logger = log.New(io.Discard, "", 0)
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new migrator: %v", err)
+	}
+	return m
+}
@@ -0,0 +1,180 @@
+package migrator
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxFileName is the longest file name, in bytes, common filesystems allow.
+const maxFileName = 255
+
+// hashedPrefix starts the file name of a key whose escaped form is longer
+// than maxFileName. Escaped keys never start with it, as an escaped %
+// is always followed by two hex digits.
+const hashedPrefix = "%sha256-"
+
+// longKeysName is the file in a bucket dir mapping hashed file names to
+// their keys.
+const longKeysName = ".long-keys.ndjson"
+
+// keyFileName returns the name of the backup file of a key: its escaped
+// form or, when that is too long, one derived from the hash of the key.
+// It reports whether the name is hashed. A key named like a metadata or
+// temp file of the backup, which restores skip, has its first character
+// escaped.
+func keyFileName(key string) (string, bool) {
+	name := escapeReserved(escapeKey(key))
+	if !isKeyFile(name) {
+		name = fmt.Sprintf("%%%02X", name[0]) + name[1:]
+	}
+	if len(name) <= maxFileName {
+		return name, false
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hashedPrefix + hex.EncodeToString(sum[:]), true
+}
+
+// bucketDir returns the directory of a bucket relative to the backup dir.
+func bucketDir(bucketType, bucket string) string {
+	return filepath.Join(escapeSegment(bucketType), escapeSegment(bucket))
+}
+
+// escapeSegment maps a bucket type or bucket to a directory name. Path
+// separators, % and characters some filesystems reject are escaped as %XX,
+// so the name can't leave the backup dir and url.PathUnescape reverses it.
+func escapeSegment(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c < 0x20 || c == 0x7f || strings.IndexByte(`%/\<>:"|?*`, c) >= 0 {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return escapeReserved(b.String())
+}
+
+// escapeReserved escapes the first character of names that can't be used
+// as file names: . and .., and the device names of Windows.
+func escapeReserved(name string) string {
+	switch {
+	case name == ".":
+		return "%2E"
+	case name == "..":
+		return "%2E%2E"
+	case isDeviceName(name):
+		return fmt.Sprintf("%%%02X", name[0]) + name[1:]
+	}
+	return name
+}
+
+func isDeviceName(name string) bool {
+	base := strings.ToUpper(name)
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	switch base {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	return len(base) == 4 && (strings.HasPrefix(base, "COM") || strings.HasPrefix(base, "LPT")) && base[3] >= '1' && base[3] <= '9'
+}
+
+// parseBackupPath splits the path of a key file relative to the backup dir
+// into its bucket type, bucket and file name. Backups of format 2 and
+// newer have escaped bucket type and bucket dirs.
+func parseBackupPath(rel string, version int) (bucketType, bucket, file string, err error) {
+	return splitBackupPath(rel, filepath.Separator, version)
+}
+
+// splitBackupPath is parseBackupPath for paths separated by sep.
+func splitBackupPath(rel string, sep rune, version int) (bucketType, bucket, file string, err error) {
+	segments := strings.Split(rel, string(sep))
+	if len(segments) != 3 {
+		return "", "", "", errors.New("not a type/bucket/key file")
+	}
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", "", "", fmt.Errorf("invalid path segment '%s'", segment)
+		}
+	}
+
+	bucketType, bucket, file = segments[0], segments[1], segments[2]
+	if version < 2 {
+		return bucketType, bucket, file, nil
+	}
+	if bucketType, err = url.PathUnescape(bucketType); err != nil {
+		return "", "", "", fmt.Errorf("unescape bucket type: %w", err)
+	}
+	if bucket, err = url.PathUnescape(bucket); err != nil {
+		return "", "", "", fmt.Errorf("unescape bucket: %w", err)
+	}
+	return bucketType, bucket, file, nil
+}
+
+// longKey is a line of the long keys file of a bucket dir. Key is escaped.
+type longKey struct {
+	File string `json:"file"`
+	Key  string `json:"key"`
+}
+
+// addLongKey records the key of a hashed file name in the long keys file
+// of its bucket dir.
+func (m *Migrator) addLongKey(dir, file, key string) error {
+	b, err := json.Marshal(longKey{File: file, Key: key})
+	if err != nil {
+		return err
+	}
+
+	m.longKeysMu.Lock()
+	defer m.longKeysMu.Unlock()
+
+	f, err := os.OpenFile(filepath.Join(dir, longKeysName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readLongKeys returns the escaped keys of the hashed file names of a
+// bucket dir.
+func readLongKeys(dir string) (map[string]string, error) {
+	keys := make(map[string]string)
+	f, err := os.Open(filepath.Join(dir, longKeysName))
+	if os.IsNotExist(err) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry longKey
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("decode %s: %w", longKeysName, err)
+		}
+		keys[entry.File] = entry.Key
+	}
+	return keys, scanner.Err()
+}
+
+// isHashedFileName reports whether name is the hashed file name of a long
+// key.
+func isHashedFileName(name string) bool {
+	return strings.HasPrefix(name, hashedPrefix)
+}
@@ -0,0 +1,242 @@
+package migrator
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitBackupPath(t *testing.T) {
+	for _, tc := range []struct {
+		rel                     string
+		sep                     rune
+		version                 int
+		bucketType, bucket, key string
+		ok                      bool
+	}{
+		{"default/b1/k1", '/', formatVersion, "default", "b1", "k1", true},
+		{`default\b1\k1`, '\\', formatVersion, "default", "b1", "k1", true},
+		{`maps\b%2F1\k%2F1`, '\\', formatVersion, "maps", "b/1", "k%2F1", true},
+		{"maps/b%2F1/k%2F1", '/', formatVersion, "maps", "b/1", "k%2F1", true},
+		{"maps/b%2F1/k%2F1", '/', 1, "maps", "b%2F1", "k%2F1", true},
+		{`default\b1\k1`, '/', formatVersion, "", "", "", false},
+		{"default/b1/k1", '\\', formatVersion, "", "", "", false},
+		{"manifest.json", '/', formatVersion, "", "", "", false},
+		{"default/b1", '/', formatVersion, "", "", "", false},
+		{"default/b1/sub/k1", '/', formatVersion, "", "", "", false},
+		{`default\b1\sub\k1`, '\\', formatVersion, "", "", "", false},
+		{"default/../k1", '/', formatVersion, "", "", "", false},
+		{`default\.\k1`, '\\', formatVersion, "", "", "", false},
+		{"default//k1", '/', formatVersion, "", "", "", false},
+		{"default/b%ZZ/k1", '/', formatVersion, "", "", "", false},
+	} {
+		bucketType, bucket, key, err := splitBackupPath(tc.rel, tc.sep, tc.version)
+		if (err == nil) != tc.ok {
+			t.Errorf("splitBackupPath(%q, %q) = %v, want ok %v", tc.rel, tc.sep, err, tc.ok)
+			continue
+		}
+		if bucketType != tc.bucketType || bucket != tc.bucket || key != tc.key {
+			t.Errorf("splitBackupPath(%q, %q) = %q, %q, %q, want %q, %q, %q",
+				tc.rel, tc.sep, bucketType, bucket, key, tc.bucketType, tc.bucket, tc.key)
+		}
+	}
+}
+
+func TestRestoreDirNested(t *testing.T) {
+	source := newFakeRiak(t)
+	source.put("default", "b1", "k1", "v1")
+	source.put("default", "b2", "k2", "v2")
+	// The dirs above the backup look like a bucket type and bucket too.
+	dir := filepath.Join(t.TempDir(), "backups", "default", "b1")
+	m := newTestMigrator(t, Config{Source: source.URL, Destination: source.URL, BackupDir: dir})
+	if err := m.BackupDir(context.Background()); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	for _, stray := range []string{"README", filepath.Join("default", "stray"), filepath.Join("default", "b1", "sub", "k9")} {
+		path := filepath.Join(dir, stray)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("stray"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	destination := newFakeRiak(t)
+	m = newTestMigrator(t, Config{Source: destination.URL, Destination: destination.URL, BackupDir: dir})
+	if err := m.RestoreDir(context.Background()); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	got := map[string][]string{}
+	for _, bucket := range []string{"b1", "b2", "sub", "stray"} {
+		if keys := destination.keys("default", bucket); keys != nil {
+			got[bucket] = keys
+		}
+	}
+	if want := map[string][]string{"b1": {"k1"}, "b2": {"k2"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %v, want %v", got, want)
+	}
+}
+
+func TestKeyFileName(t *testing.T) {
+	for _, tc := range []struct {
+		key, name string
+		hashed    bool
+	}{
+		{"k1", "k1", false},
+		{"a/b", "a%2Fb", false},
+		{"a\\b", "a%5Cb", false},
+		{"..", "%2E%2E", false},
+		{".", "%2E", false},
+		{"../etc/passwd", "..%2Fetc%2Fpasswd", false},
+		{"\xff\xfe\x00", "%FF%FE%00", false},
+		{"CON", "%43ON", false},
+		{propsName, "%70rops.json", false},
+		{manifestName, "%6Danifest.ndjson", false},
+		{longKeysName, "%2Elong-keys.ndjson", false},
+		{".migrator-tmp-123", "%2Emigrator-tmp-123", false},
+		{"данные", "%D0%B4%D0%B0%D0%BD%D0%BD%D1%8B%D0%B5", false},
+		{strings.Repeat("k", maxFileName), strings.Repeat("k", maxFileName), false},
+		{strings.Repeat("k", maxFileName+1), "", true},
+		// 85 characters, but 510 bytes escaped.
+		{strings.Repeat("ж", 85), "", true},
+		{strings.Repeat("\xff", 86), "", true},
+	} {
+		name, hashed := keyFileName(tc.key)
+		if hashed != tc.hashed {
+			t.Errorf("keyFileName(%q) hashed %v, want %v", tc.key, hashed, tc.hashed)
+			continue
+		}
+		if len(name) > maxFileName || strings.ContainsAny(name, "/\\\x00") {
+			t.Errorf("keyFileName(%q) = %q, not a valid file name", tc.key, name)
+		}
+		if hashed {
+			if !isHashedFileName(name) {
+				t.Errorf("keyFileName(%q) = %q, want a hashed name", tc.key, name)
+			}
+			continue
+		}
+		if name != tc.name {
+			t.Errorf("keyFileName(%q) = %q, want %q", tc.key, name, tc.name)
+		}
+		if key, err := unescapeKey(name); err != nil || key != tc.key {
+			t.Errorf("unescapeKey(%q) = %q, %v, want %q", name, key, err, tc.key)
+		}
+	}
+}
+
+func TestKeyFileNameHashesDistinctKeys(t *testing.T) {
+	long := strings.Repeat("k", 300)
+	a, _ := keyFileName(long + "a")
+	b, _ := keyFileName(long + "b")
+	if a == b {
+		t.Errorf("keys differing in their last byte share the file name %s", a)
+	}
+}
+
+func TestBackupDirKeyNamesRoundTrip(t *testing.T) {
+	keys := []string{
+		"a/b",
+		"..",
+		".",
+		"props.json",
+		"manifest.ndjson",
+		".migrator-tmp-123",
+		strings.Repeat("k", 300) + "a",
+		strings.Repeat("k", 300) + "b",
+		strings.Repeat("ж", 100),
+	}
+	source := newFakeRiak(t)
+	for i, key := range keys {
+		source.put("default", "b1", key, string(rune('a'+i)))
+	}
+	dir := t.TempDir()
+	m := newTestMigrator(t, Config{Source: source.URL, Destination: source.URL, BackupDir: dir})
+	if err := m.BackupDir(context.Background()); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "default", "b1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if len(entry.Name()) > maxFileName {
+			t.Errorf("file name of %d bytes: %s", len(entry.Name()), entry.Name())
+		}
+	}
+
+	destination := newFakeRiak(t)
+	m = newTestMigrator(t, Config{Source: destination.URL, Destination: destination.URL, BackupDir: dir})
+	if err = m.RestoreDir(context.Background()); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if got, want := destination.keys("default", "b1"), source.keys("default", "b1"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored keys %q, want %q", got, want)
+	}
+	for i, key := range keys {
+		if got := destination.get("default", "b1", key); string(got.value) != string(rune('a'+i)) {
+			t.Errorf("key %q restored as %q", key, got.value)
+		}
+	}
+}
+
+func TestBackupDirHostileNames(t *testing.T) {
+	names := []string{"..", ".", "../escape", "../../escape", "/abs/path", `..\escape`, "a\x00b", "CON", "props.json"}
+	source := newFakeRiak(t)
+	for _, bucketType := range []string{"default", "../types"} {
+		for _, bucket := range names {
+			for _, key := range names {
+				source.put(bucketType, bucket, key, bucket+"|"+key)
+			}
+		}
+	}
+	root := t.TempDir()
+	dir := filepath.Join(root, "backup")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{Source: source.URL, Destination: source.URL, BackupDir: dir, BucketTypes: []string{"default", "../types"}}
+	m := newTestMigrator(t, cfg)
+	if err := m.BackupDir(context.Background()); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+
+	// Everything written is in the backup dir, at most a bucket type, a
+	// bucket and a file deep.
+	err := filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if path != root && (rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))) {
+			t.Errorf("%s written outside the backup dir", path)
+		}
+		if depth := len(strings.Split(rel, string(filepath.Separator))); depth > 3 {
+			t.Errorf("%s nested %d deep", rel, depth)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destination := newFakeRiak(t)
+	cfg.Source, cfg.Destination = destination.URL, destination.URL
+	m = newTestMigrator(t, cfg)
+	if err = m.RestoreDir(context.Background()); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	for _, bucketType := range []string{"default", "../types"} {
+		for _, bucket := range names {
+			if got, want := destination.keys(bucketType, bucket), source.keys(bucketType, bucket); !reflect.DeepEqual(got, want) {
+				t.Errorf("bucket %q (%s) restored with keys %q, want %q", bucket, bucketType, got, want)
+			}
+		}
+	}
+}
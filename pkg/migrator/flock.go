@@ -0,0 +1,14 @@
+//go:build !windows
+
+package migrator
+
+import (
+	"os"
+	"syscall"
+)
+
+// flock takes an exclusive lock of f without waiting, released once f is
+// closed.
+func flock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
@@ -0,0 +1,8 @@
+package migrator
+
+import "os"
+
+// flock doesn't lock on Windows, which has no flock.
+func flock(f *os.File) error {
+	return nil
+}
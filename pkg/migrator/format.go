@@ -0,0 +1,74 @@
+package migrator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// formatVersion is the layout version of backups written by this build.
+// Backups without a version use the original layout: plain key files, and
+// NDJSON records with bucket_type, bucket, key and value only. Version 1
+// added the manifest of directory backups and the checksum and object
+// metadata fields of NDJSON records. Version 2 escapes the bucket type and
+// bucket dirs of directory backups, and stores keys too long for a file
+// name under hashed names. Version 3 adds the siblings of NDJSON records
+// of keys with siblings. Version 4 adds the props file of bucket dirs, and
+// escapes the first character of key files named like it.
+const formatVersion = 4
+
+const versionName = ".migrator-version"
+
+// checkFormat accepts backups of formatVersion and older. Backups that
+// predate versioning are read as version 0.
+func checkFormat(version int) error {
+	if version > formatVersion {
+		return fmt.Errorf("backup format %d is newer than the supported format %d, use a newer build", version, formatVersion)
+	}
+	return nil
+}
+
+func writeDirFormat(dir string, s *syncer) error {
+	return writeFileAtomic(filepath.Join(dir, versionName), []byte(strconv.Itoa(formatVersion)+"\n"), s)
+}
+
+func readDirFormat(dir string) (int, error) {
+	b, err := os.ReadFile(filepath.Join(dir, versionName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("malformed %s: %w", versionName, err)
+	}
+	return version, nil
+}
+
+// checkDirFormat validates the format of the directory backup at dir and
+// returns its version.
+func checkDirFormat(dir string) (int, error) {
+	version, err := readDirFormat(dir)
+	if err != nil {
+		return 0, err
+	}
+	return version, checkFormat(version)
+}
+
+// isKeyFile reports whether name is a key file of a directory backup,
+// rather than metadata or a leftover temp file.
+func isKeyFile(name string) bool {
+	return !isMetadataFile(name) && !isTempFile(name)
+}
+
+// isMetadataFile reports whether name is a file the tool keeps next to the
+// key files of a directory backup.
+func isMetadataFile(name string) bool {
+	return name == manifestName || name == versionName || name == longKeysName || name == lockName ||
+		name == completeName || name == propsName
+}
@@ -0,0 +1,147 @@
+package migrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckFormat(t *testing.T) {
+	for _, tc := range []struct {
+		version int
+		ok      bool
+	}{
+		{0, true},
+		{1, true},
+		{formatVersion - 1, true},
+		{formatVersion, true},
+		{formatVersion + 1, false},
+		{100, false},
+	} {
+		if err := checkFormat(tc.version); (err == nil) != tc.ok {
+			t.Errorf("checkFormat(%d) = %v, want ok %v", tc.version, err, tc.ok)
+		}
+	}
+}
+
+func TestCheckDirFormat(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string // no version file when empty
+		version int
+		ok      bool
+	}{
+		{"unversioned", "", 0, true},
+		{"older", "1\n", 1, true},
+		{"current", fmt.Sprintf("%d\n", formatVersion), formatVersion, true},
+		{"newer", fmt.Sprintf("%d\n", formatVersion+1), formatVersion + 1, false},
+		{"malformed", "v2\n", 0, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tc.content != "" {
+				if err := os.WriteFile(filepath.Join(dir, versionName), []byte(tc.content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			version, err := checkDirFormat(dir)
+			if (err == nil) != tc.ok {
+				t.Fatalf("checkDirFormat = %v, want ok %v", err, tc.ok)
+			}
+			if tc.ok && version != tc.version {
+				t.Errorf("version = %d, want %d", version, tc.version)
+			}
+		})
+	}
+}
+
+func TestWriteDirFormat(t *testing.T) {
+	dir := t.TempDir()
+	if err := writeDirFormat(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := checkDirFormat(dir); err != nil || version != formatVersion {
+		t.Errorf("checkDirFormat = %d, %v, want %d", version, err, formatVersion)
+	}
+}
+
+func TestRecordDecodesUnversioned(t *testing.T) {
+	// A record of the original layout: no format, checksum or metadata.
+	line := `{"bucket_type":"default","bucket":"b1","key":"k+1","value":"dmFsdWU="}`
+	var rec record
+	if err := json.Unmarshal([]byte(line), &rec); err != nil {
+		t.Fatal(err)
+	}
+	want := record{BucketType: "default", Bucket: "b1", Key: "k+1", Value: []byte("value")}
+	if !reflect.DeepEqual(rec, want) {
+		t.Errorf("decoded %+v, want %+v", rec, want)
+	}
+	if err := checkFormat(rec.Format); err != nil {
+		t.Errorf("checkFormat: %v", err)
+	}
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	rec := record{
+		BucketType:   "maps",
+		Bucket:       "b1",
+		Key:          "k%2F1",
+		Format:       formatVersion,
+		Value:        []byte{0, 1, 2, 0xff},
+		SHA256:       "ab12",
+		ContentType:  "application/octet-stream",
+		Headers:      map[string]string{"X-Riak-Meta-Owner": "me", "Link": `</buckets/b2/keys/k2>; riaktag="next"`},
+		VClock:       "a85hYGBgzGDKBVIcypz/fgaUHjmdwZTImMfKsCFj",
+		LastModified: "Tue, 14 Nov 2023 22:13:20 GMT",
+		Siblings: []sibling{{
+			Value:        []byte("old"),
+			SHA256:       "cd34",
+			ContentType:  "text/plain",
+			Headers:      map[string]string{"X-Riak-Index-Email_bin": "a@b"},
+			VTag:         "v1",
+			LastModified: "Mon, 13 Nov 2023 22:13:20 GMT",
+		}},
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got record
+	if err = json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, rec) {
+		t.Errorf("round trip of %s = %+v, want %+v", b, got, rec)
+	}
+}
+
+func TestRestoreFormats(t *testing.T) {
+	unversioned := `{"bucket_type":"default","bucket":"b1","key":"k1","value":"djE="}`
+	current := fmt.Sprintf(`{"bucket_type":"default","bucket":"b1","key":"k2","format":%d,"value":"djI=","content_type":"application/json"}`, formatVersion)
+	newer := fmt.Sprintf(`{"bucket_type":"default","bucket":"b1","key":"k3","format":%d,"value":"djM="}`, formatVersion+1)
+
+	destination := newFakeRiak(t)
+	m := newTestMigrator(t, Config{Source: destination.URL, Destination: destination.URL})
+	if err := m.Restore(context.Background(), strings.NewReader(unversioned+"\n"+current+"\n")); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if obj := destination.get("default", "b1", "k1"); obj == nil || string(obj.value) != "v1" {
+		t.Errorf("unversioned record restored as %+v", obj)
+	}
+	if obj := destination.get("default", "b1", "k2"); obj == nil || obj.header.Get("Content-Type") != "application/json" {
+		t.Errorf("current record restored as %+v", obj)
+	}
+
+	err := m.Restore(context.Background(), strings.NewReader(newer+"\n"))
+	if err == nil || !strings.Contains(err.Error(), "newer than the supported format") {
+		t.Errorf("restore of a newer format = %v, want it refused", err)
+	}
+	if destination.get("default", "b1", "k3") != nil {
+		t.Error("record of a newer format restored")
+	}
+}
@@ -0,0 +1,63 @@
+package migrator
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// syncer fsyncs backup files and their dirs with Fsync, and times it. A
+// nil syncer, Fsync being off, syncs nothing.
+type syncer struct {
+	syncs int64
+	nanos int64
+}
+
+// file fsyncs the data of f to disk.
+func (s *syncer) file(f *os.File) error {
+	if s == nil {
+		return nil
+	}
+	defer s.time(time.Now())
+	return f.Sync()
+}
+
+// dir fsyncs the dir at path, so the files created in or renamed into it
+// survive a crash.
+func (s *syncer) dir(path string) error {
+	if s == nil {
+		return nil
+	}
+	defer s.time(time.Now())
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *syncer) time(start time.Time) {
+	atomic.AddInt64(&s.syncs, 1)
+	atomic.AddInt64(&s.nanos, int64(time.Since(start)))
+}
+
+// spent returns the time spent syncing so far.
+func (s *syncer) spent() time.Duration {
+	if s == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&s.nanos))
+}
+
+// logSync logs the time spent syncing backup files, if any.
+func (m *Migrator) logSync() {
+	if m.fsync == nil {
+		return
+	}
+	m.log.Printf("INFO: fsync: %d syncs took %s\n",
+		atomic.LoadInt64(&m.fsync.syncs), m.fsync.spent().Round(time.Millisecond))
+}
@@ -0,0 +1,161 @@
+package migrator
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// phase is what a run is busy with, for heartbeats.
+type phase int32
+
+const (
+	phaseStarting phase = iota
+	phaseListing
+	phaseCopying
+	phaseBackingUp
+	phaseVerifying
+	phaseRestoring
+	phaseDeleting
+	phaseEstimating
+)
+
+// runProgress has the run-level counters of heartbeats. The workers only
+// update them atomically, so heartbeats never block them.
+type runProgress struct {
+	phase       int32
+	buckets     int64
+	bucketsDone int64
+	keys        int64
+	inFlight    int64
+}
+
+func (m *Migrator) setPhase(p phase) {
+	atomic.StoreInt32(&m.progress.phase, int32(p))
+}
+
+// syncPhase is the phase of syncing keys in the current mode.
+func (m *Migrator) syncPhase() phase {
+	switch m.mode {
+	case modeMigrate:
+		return phaseCopying
+	case modeDelete:
+		return phaseDeleting
+	case modeEstimate:
+		return phaseEstimating
+	}
+	return phaseBackingUp
+}
+
+func (m *Migrator) phaseName() string {
+	switch phase(atomic.LoadInt32(&m.progress.phase)) {
+	case phaseListing:
+		return "listing"
+	case phaseCopying:
+		return "copying"
+	case phaseBackingUp:
+		return "backing up"
+	case phaseVerifying:
+		return "verifying"
+	case phaseRestoring:
+		return "restoring"
+	case phaseDeleting:
+		return "deleting"
+	case phaseEstimating:
+		return "estimating"
+	default:
+		return "starting"
+	}
+}
+
+// StartHeartbeat logs the phase and rates of the run every interval,
+// whatever the run is busy with, until the returned func is called.
+func (m *Migrator) StartHeartbeat(interval time.Duration) func() {
+	done, finished := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(finished)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+
+		start := time.Now()
+		prevKeys, prevAt := int64(0), start
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-tick.C:
+				keys := atomic.LoadInt64(&m.progress.keys)
+				var buckets string
+				if total := atomic.LoadInt64(&m.progress.buckets); total > 0 {
+					buckets = fmt.Sprintf(", %d of %d buckets done", atomic.LoadInt64(&m.progress.bucketsDone), total)
+				}
+				m.log.Printf("INFO: heartbeat: %s%s, %d keys, %.1f keys/s now, %.1f keys/s overall, %d requests in flight\n",
+					m.phaseName(), buckets, keys,
+					float64(keys-prevKeys)/now.Sub(prevAt).Seconds(), float64(keys)/now.Sub(start).Seconds(),
+					atomic.LoadInt64(&m.progress.inFlight))
+				prevKeys, prevAt = keys, now
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// Progress is a snapshot of the progress of a run.
+type Progress struct {
+	Phase       string
+	Buckets     int64
+	BucketsDone int64
+	Keys        int64
+	// Active has the buckets being synced, in the order they started.
+	Active []BucketProgress
+}
+
+// BucketProgress is the progress of a bucket being synced.
+type BucketProgress struct {
+	BucketType string
+	Bucket     string
+	Done       int64
+	Listed     int64
+}
+
+// Progress returns the progress of the run. It is safe to call while the
+// run goes on.
+func (m *Migrator) Progress() Progress {
+	p := Progress{
+		Phase:       m.phaseName(),
+		Buckets:     atomic.LoadInt64(&m.progress.buckets),
+		BucketsDone: atomic.LoadInt64(&m.progress.bucketsDone),
+		Keys:        atomic.LoadInt64(&m.progress.keys),
+	}
+	m.activeMu.Lock()
+	for _, job := range m.active {
+		p.Active = append(p.Active, BucketProgress{
+			BucketType: job.bucketType,
+			Bucket:     job.bucket,
+			Done:       atomic.LoadInt64(&job.done),
+			Listed:     atomic.LoadInt64(&job.listed),
+		})
+	}
+	m.activeMu.Unlock()
+	return p
+}
+
+func (m *Migrator) activate(job *bucketJob) {
+	m.activeMu.Lock()
+	m.active = append(m.active, job)
+	m.activeMu.Unlock()
+}
+
+func (m *Migrator) deactivate(job *bucketJob) {
+	m.activeMu.Lock()
+	defer m.activeMu.Unlock()
+	for i, active := range m.active {
+		if active == job {
+			m.active = append(m.active[:i], m.active[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package migrator
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// incrementalState carries the manifest of the previous backup through an
+// incremental run, so unchanged keys are reused instead of downloaded and
+// keys gone from the source are dropped from the snapshot.
+type incrementalState struct {
+	dir      string
+	log      *log.Logger
+	totals   *counters
+	previous map[string]manifestEntry
+
+	mu      sync.Mutex
+	types   map[string]bool
+	buckets map[string]bool
+	keys    map[string]map[string]bool
+}
+
+func (m *Migrator) loadIncremental(dir string) (*incrementalState, error) {
+	previous, err := readManifest(dir)
+	if os.IsNotExist(err) {
+		m.log.Println("WARN: no manifest from a previous backup, doing a full backup")
+		previous = make(map[string]manifestEntry)
+	} else if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+
+	return &incrementalState{
+		dir:      dir,
+		log:      m.log,
+		totals:   &m.totals,
+		previous: previous,
+		types:    make(map[string]bool),
+		buckets:  make(map[string]bool),
+		keys:     make(map[string]map[string]bool),
+	}, nil
+}
+
+// listBuckets records the buckets that exist in the source for bucketType.
+func (s *incrementalState) listBuckets(bucketType string, buckets []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.types[bucketType] = true
+	for _, bucket := range buckets {
+		s.buckets[bucketDir(bucketType, bucket)] = true
+	}
+}
+
+// listKeys records the keys that exist in the source for bucket. Buckets
+// that never get their keys listed (e.g. skipped ones) keep all their
+// previous keys.
+func (s *incrementalState) listKeys(bucketType, bucket string, keys []string) {
+	listed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		name, _ := keyFileName(key)
+		listed[name] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[bucketDir(bucketType, bucket)] = listed
+}
+
+// conditional returns the headers making a GET of key conditional on it
+// having changed since the previous backup, as long as that backup still
+// has the key file.
+func (s *incrementalState) conditional(bucketType, bucket, key string) http.Header {
+	entry, ok := s.previous[filepath.Join(bucketDir(bucketType, bucket), key)]
+	if !ok {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, entry.path())); err != nil {
+		return nil
+	}
+
+	header := make(http.Header)
+	if entry.ETag != "" {
+		header.Set("If-None-Match", entry.ETag)
+	}
+	if entry.LastModified != "" {
+		header.Set("If-Modified-Since", entry.LastModified)
+	}
+	return header
+}
+
+func (s *incrementalState) disappeared(entry manifestEntry) bool {
+	if !s.types[entry.BucketType] {
+		return false
+	}
+
+	bucket := bucketDir(entry.BucketType, entry.Bucket)
+	if !s.buckets[bucket] {
+		return true
+	}
+	listed, ok := s.keys[bucket]
+	return ok && !listed[entry.Key]
+}
+
+// finish drops keys that disappeared from the source and compacts the
+// manifest, so the backup dir is again a complete snapshot.
+func (s *incrementalState) finish(dir string, sync *syncer) error {
+	entries, err := readManifest(dir)
+	if err != nil {
+		return fmt.Errorf("read manifest: %w", err)
+	}
+
+	kept := make([]manifestEntry, 0, len(entries))
+	removed := 0
+	for path, entry := range entries {
+		if !s.disappeared(entry) {
+			kept = append(kept, entry)
+			continue
+		}
+
+		s.log.Printf("WARN: key '%s' disappeared from source, removing it from backup\n", path)
+		if err = os.Remove(filepath.Join(dir, path)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].path() < kept[j].path()
+	})
+
+	if err = writeManifest(dir, kept, sync); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+
+	s.log.Printf("INFO: incremental backup: fetched %d keys, reused %d keys, removed %d disappeared keys\n",
+		s.totals.get(copied), s.totals.get(unchanged), removed)
+	return nil
+}
@@ -0,0 +1,169 @@
+package migrator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// joinPoll is the wait of a worker before asking its coordinator for
+	// a batch again when none was ready.
+	joinPoll = time.Second
+	// joinAttempts is the number of times a worker tries to reach its
+	// coordinator before giving up.
+	joinAttempts = 10
+)
+
+// Join syncs the batches of keys handed out by the coordinator at
+// coordinatorURL, see Coordinate, with the worker pool, until the
+// coordinator reports the run over.
+func (m *Migrator) Join(ctx context.Context, coordinatorURL string) error {
+	m.mode = modeMigrate
+	coordinatorURL = strings.TrimSuffix(coordinatorURL, "/")
+	host, _ := os.Hostname()
+	worker := fmt.Sprintf("%s-%d", host, os.Getpid())
+	m.log.Printf("INFO: worker %s joining %s\n", worker, coordinatorURL)
+	if err := m.checkCompression(ctx); err != nil {
+		return err
+	}
+
+	closePool := m.startPool(ctx)
+	defer closePool()
+
+	for {
+		b, err := m.leaseBatch(ctx, coordinatorURL, worker)
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			m.log.Printf("INFO: keys: %s\n", &m.totals)
+			m.logTransfer()
+			m.logLatencies()
+			return nil
+		}
+
+		res := m.syncBatch(ctx, b)
+		res.Worker = worker
+		m.log.Printf("INFO: batch %d of bucket '%s': %d keys, %d failed\n", b.ID, b.Bucket, len(b.Keys), len(res.Failures))
+		if err = ctx.Err(); err != nil {
+			// The lease expires and the batch goes to another worker.
+			return err
+		}
+		if err = m.completeBatch(ctx, coordinatorURL, res); err != nil {
+			return err
+		}
+	}
+}
+
+// syncBatch syncs the keys of b with the worker pool.
+func (m *Migrator) syncBatch(ctx context.Context, b *batch) batchResult {
+	job := &bucketJob{stop: func() {}}
+	res := batchResult{ID: b.ID}
+	for _, fileKey := range b.Keys {
+		key, err := unescapeKey(fileKey)
+		if err != nil {
+			res.Failures = append(res.Failures, fmt.Sprintf("unescape key '%s': %s", fileKey, err))
+			continue
+		}
+		job.pending.Add(1)
+		select {
+		case m.work <- workItem{bucketType: b.BucketType, bucket: b.Bucket, key: key, job: job}:
+		case <-ctx.Done():
+			job.pending.Done()
+		}
+	}
+	job.pending.Wait()
+
+	for _, err := range job.failures {
+		res.Failures = append(res.Failures, fmt.Sprintf("bucket %s: %s", b.Bucket, err))
+	}
+	res.Outcomes = make([]int64, numOutcomes)
+	for o := outcome(0); o < numOutcomes; o++ {
+		res.Outcomes[o] = job.stats.get(o)
+	}
+	return res
+}
+
+// leaseBatch asks the coordinator for a batch, waiting while none is
+// ready. It returns nil once the run is over.
+func (m *Migrator) leaseBatch(ctx context.Context, coordinatorURL, worker string) (*batch, error) {
+	for {
+		res, err := m.callCoordinator(ctx, coordinatorURL+"/lease?worker="+url.QueryEscape(worker), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		switch res.StatusCode {
+		case http.StatusOK:
+			var b batch
+			err = json.NewDecoder(res.Body).Decode(&b)
+			_ = res.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("decode batch: %w", err)
+			}
+			return &b, nil
+		case http.StatusGone:
+			_ = res.Body.Close()
+			return nil, nil
+		case http.StatusNoContent:
+			_ = res.Body.Close()
+		default:
+			_ = res.Body.Close()
+			return nil, fmt.Errorf("lease batch: %w", &statusError{code: res.StatusCode})
+		}
+
+		select {
+		case <-time.After(joinPoll):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (m *Migrator) completeBatch(ctx context.Context, coordinatorURL string, result batchResult) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	res, err := m.callCoordinator(ctx, coordinatorURL+"/complete", body)
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("complete batch %d: %w", result.ID, &statusError{code: res.StatusCode})
+	}
+	return nil
+}
+
+// callCoordinator POSTs body to endpoint, trying joinAttempts times while the
+// coordinator can't be reached.
+func (m *Migrator) callCoordinator(ctx context.Context, endpoint string, body []byte) (*http.Response, error) {
+	var err error
+	for attempt := 1; attempt <= joinAttempts; attempt++ {
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		var res *http.Response
+		if res, err = http.DefaultClient.Do(req); err == nil {
+			return res, nil
+		}
+		m.log.Printf("WARN: coordinator unreachable (attempt %d of %d): %s\n", attempt, joinAttempts, err)
+
+		select {
+		case <-time.After(joinPoll * time.Duration(attempt)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, fmt.Errorf("reach coordinator: %w", err)
+}
@@ -0,0 +1,131 @@
+package migrator
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// keyCacheHeader is the first line of a cached key listing, followed by
+// a line per key escaped by escapeKey.
+type keyCacheHeader struct {
+	BucketType string    `json:"bucket_type"`
+	Bucket     string    `json:"bucket"`
+	ListedAt   time.Time `json:"listed_at"`
+}
+
+// keyCachePath returns the file caching the key listing of a bucket.
+func (m *Migrator) keyCachePath(bucketType, bucket string) string {
+	return filepath.Join(m.cfg.KeyCacheDir, escapeSegment(bucketType), escapeSegment(bucket)+".keys")
+}
+
+// listCached calls fn for the keys of a source bucket cached in
+// KeyCacheDir, if not older than KeyCacheMaxAge. Otherwise it lists them
+// from the source, caching them as they are listed. Only complete
+// listings are cached: a file only appears once its listing finished.
+func (m *Migrator) listCached(ctx context.Context, bucketType, bucket string, fn func(key string) error, drain func()) error {
+	path := m.keyCachePath(bucketType, bucket)
+	used, err := m.readKeyCache(path, bucket, fn)
+	if used || err != nil {
+		return err
+	}
+
+	// A resumed index listing misses the keys before its continuation.
+	if m.listState != nil && m.listState.get(bucketType, bucket) != "" {
+		return m.listSource(ctx, m.source, bucketType, bucket, fn, drain)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return fmt.Errorf("key cache: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), tempPattern)
+	if err != nil {
+		return fmt.Errorf("key cache: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(keyCacheHeader{BucketType: bucketType, Bucket: bucket, ListedAt: time.Now().UTC()}); err != nil {
+		return err
+	}
+	var n int64
+	err = m.listSource(ctx, m.source, bucketType, bucket, func(key string) error {
+		if _, err := w.WriteString(escapeKey(key) + "\n"); err != nil {
+			return fmt.Errorf("key cache: %w", err)
+		}
+		n++
+		return fn(key)
+	}, drain)
+	if err != nil {
+		return err
+	}
+
+	if err = w.Flush(); err != nil {
+		return fmt.Errorf("key cache: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("key cache: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("key cache: %w", err)
+	}
+	m.log.Printf("INFO: bucket '%s' cached the listing of %d keys in %s\n", bucket, n, path)
+	return nil
+}
+
+// readKeyCache calls fn for the keys cached in path, and reports whether
+// it did: a missing or expired cache isn't used.
+func (m *Migrator) readKeyCache(path, bucket string, fn func(key string) error) (bool, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("key cache: %w", err)
+	}
+	defer file.Close()
+
+	lines := NewLineIterator(file)
+	line, err := lines.Next()
+	var header keyCacheHeader
+	if err == nil {
+		err = json.Unmarshal(line, &header)
+	}
+	if err != nil {
+		m.log.Printf("WARN: bucket '%s' ignoring the malformed key cache %s: %s\n", bucket, path, err)
+		return false, nil
+	}
+	age := time.Since(header.ListedAt)
+	if m.cfg.KeyCacheMaxAge > 0 && age > m.cfg.KeyCacheMaxAge {
+		m.log.Printf("INFO: bucket '%s' key cache listed at %s is %s old, listing the keys again\n",
+			bucket, header.ListedAt.Format(time.RFC3339), age.Round(time.Second))
+		return false, nil
+	}
+
+	m.log.Printf("INFO: bucket '%s' using the keys cached in %s, listed at %s (%s ago), not listing the source\n",
+		bucket, path, header.ListedAt.Format(time.RFC3339), age.Round(time.Second))
+	for {
+		line, err := lines.Next()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return true, fmt.Errorf("key cache: %w", err)
+		}
+		key, err := unescapeKey(string(line))
+		if err != nil {
+			return true, fmt.Errorf("key cache %s: %w", path, err)
+		}
+		if err = fn(key); err != nil {
+			return true, err
+		}
+	}
+}
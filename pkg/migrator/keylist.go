@@ -0,0 +1,54 @@
+package migrator
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// keyRecord is a line of a key listing. It has the fields of a backup
+// record that name the key, and Key is escaped the same way.
+type keyRecord struct {
+	BucketType string `json:"bucket_type"`
+	Bucket     string `json:"bucket"`
+	Key        string `json:"key"`
+}
+
+// ListKeys writes every key of the configured bucket types on the source
+// to w as NDJSON, without fetching any value. Keys are streamed as they
+// are listed.
+func (m *Migrator) ListKeys(ctx context.Context, w io.Writer) error {
+	types, err := m.bucketTypes(ctx)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(w)
+	enc := json.NewEncoder(out)
+	var total int64
+	for _, bucketType := range types {
+		buckets, err := m.source.ListBuckets(ctx, bucketType)
+		if err != nil {
+			return fmt.Errorf("get list of bucket err: %w", err)
+		}
+
+		for _, bucket := range buckets {
+			var n int64
+			err = m.listKeys(ctx, m.source, bucketType, bucket, func(key string) error {
+				n++
+				return enc.Encode(keyRecord{BucketType: bucketType, Bucket: bucket, Key: escapeKey(key)})
+			}, func() {})
+			if err != nil && !errors.Is(err, errNotFound) {
+				return fmt.Errorf("list keys of bucket %s: %w", bucket, err)
+			}
+			m.log.Printf("INFO: type '%s' bucket '%s': %d keys\n", bucketType, bucket, n)
+			total += n
+		}
+	}
+
+	m.log.Printf("INFO: listed %d keys\n", total)
+	return out.Flush()
+}
@@ -0,0 +1,159 @@
+package migrator
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Operations of the latency histograms.
+const (
+	opSourceGet  = "source get"
+	opSourceHead = "source head"
+	opDestPut    = "destination put"
+	opDestHead   = "destination head"
+)
+
+// latencySubBuckets is the number of histogram buckets per doubling of a
+// latency, bounding the error of the percentiles to about 9%.
+const latencySubBuckets = 8
+
+// numLatencyBuckets covers latencies from 1µs to about 12 days, longer
+// ones count in the last bucket.
+const numLatencyBuckets = 40 * latencySubBuckets
+
+// histogram counts latencies in log-scaled buckets, so its memory doesn't
+// grow with the samples. It is safe for concurrent use.
+type histogram struct {
+	counts [numLatencyBuckets]int64
+	count  int64
+	max    int64
+}
+
+func latencyBucket(d time.Duration) int {
+	us := float64(d) / float64(time.Microsecond)
+	if us < 1 {
+		return 0
+	}
+	i := int(math.Log2(us) * latencySubBuckets)
+	if i >= numLatencyBuckets {
+		i = numLatencyBuckets - 1
+	}
+	return i
+}
+
+// latencyBound is the upper bound of bucket i.
+func latencyBound(i int) time.Duration {
+	return time.Duration(math.Exp2(float64(i+1)/latencySubBuckets) * float64(time.Microsecond))
+}
+
+func (h *histogram) record(d time.Duration) {
+	atomic.AddInt64(&h.counts[latencyBucket(d)], 1)
+	atomic.AddInt64(&h.count, 1)
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&h.max, max, int64(d)) {
+			return
+		}
+	}
+}
+
+// percentile returns the upper bound of the bucket of the p-th percentile,
+// at most the max.
+func (h *histogram) percentile(p float64) time.Duration {
+	max := time.Duration(atomic.LoadInt64(&h.max))
+	rank := int64(math.Ceil(p * float64(atomic.LoadInt64(&h.count))))
+	var seen int64
+	for i := range h.counts {
+		if seen += atomic.LoadInt64(&h.counts[i]); seen >= rank && seen > 0 {
+			if bound := latencyBound(i); bound < max {
+				return bound
+			}
+			break
+		}
+	}
+	return max
+}
+
+// latencyKey is a histogram of latencies, bucketType being the source one.
+type latencyKey struct {
+	bucketType string
+	op         string
+}
+
+// latencies has a histogram per operation and bucket type.
+type latencies struct {
+	mu    sync.RWMutex
+	hists map[latencyKey]*histogram
+}
+
+func (l *latencies) record(bucketType, op string, d time.Duration) {
+	key := latencyKey{bucketType, op}
+	l.mu.RLock()
+	h := l.hists[key]
+	l.mu.RUnlock()
+	if h == nil {
+		l.mu.Lock()
+		if h = l.hists[key]; h == nil {
+			if l.hists == nil {
+				l.hists = make(map[latencyKey]*histogram)
+			}
+			h = &histogram{}
+			l.hists[key] = h
+		}
+		l.mu.Unlock()
+	}
+	h.record(d)
+}
+
+// LatencySummary has the latency percentiles of an operation on the keys
+// of a bucket type, in seconds.
+type LatencySummary struct {
+	BucketType string  `json:"bucket_type"`
+	Operation  string  `json:"operation"`
+	Count      int64   `json:"count"`
+	P50        float64 `json:"p50_seconds"`
+	P90        float64 `json:"p90_seconds"`
+	P99        float64 `json:"p99_seconds"`
+	Max        float64 `json:"max_seconds"`
+}
+
+// summaries returns the percentiles of every histogram, by bucket type
+// and operation.
+func (l *latencies) summaries() []LatencySummary {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	summaries := make([]LatencySummary, 0, len(l.hists))
+	for key, h := range l.hists {
+		summaries = append(summaries, LatencySummary{
+			BucketType: key.bucketType,
+			Operation:  key.op,
+			Count:      atomic.LoadInt64(&h.count),
+			P50:        h.percentile(0.5).Seconds(),
+			P90:        h.percentile(0.9).Seconds(),
+			P99:        h.percentile(0.99).Seconds(),
+			Max:        time.Duration(atomic.LoadInt64(&h.max)).Seconds(),
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].BucketType != summaries[j].BucketType {
+			return summaries[i].BucketType < summaries[j].BucketType
+		}
+		return summaries[i].Operation < summaries[j].Operation
+	})
+	return summaries
+}
+
+// logLatencies logs the latency percentiles of the run, if any.
+func (m *Migrator) logLatencies() {
+	for _, s := range m.latencies.summaries() {
+		m.log.Printf("INFO: latency of %s in bucket type '%s': p50 %s, p90 %s, p99 %s, max %s over %d requests\n",
+			s.Operation, s.BucketType, seconds(s.P50), seconds(s.P90), seconds(s.P99), seconds(s.Max), s.Count)
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(100 * time.Microsecond)
+}
@@ -0,0 +1,98 @@
+package migrator
+
+// Source APIs, the URL layouts of the Riak HTTP API.
+const (
+	// SourceAPITypes is the layout of Riak 2.0 and later, under
+	// /types/<type>.
+	SourceAPITypes = "types"
+	// SourceAPILegacy is the layout of Riak 1.x, which has no bucket
+	// types: its buckets are read as the buckets of the default type.
+	SourceAPILegacy = "legacy"
+)
+
+// urlLayout builds the paths of the Riak HTTP API, so the requests of
+// httpClient are the same for every Riak version.
+type urlLayout interface {
+	// hasTypes reports whether there are bucket types other than the
+	// default one.
+	hasTypes() bool
+	// typePath is the prefix of the bucket listing and props of a type.
+	typePath(bucketType string) string
+	bucketPath(bucketType, bucket string) string
+	keyPath(bucketType, bucket, key string) string
+	// mapredInputs is the inputs of a MapReduce job over a bucket.
+	mapredInputs(bucketType, bucket string) interface{}
+}
+
+// typesLayout is the layout of SourceAPITypes.
+type typesLayout struct{}
+
+func (typesLayout) hasTypes() bool { return true }
+
+func (typesLayout) typePath(bucketType string) string {
+	return "/types/" + escapePath(bucketType)
+}
+
+func (l typesLayout) bucketPath(bucketType, bucket string) string {
+	return l.typePath(bucketType) + "/buckets/" + escapePath(bucket)
+}
+
+func (l typesLayout) keyPath(bucketType, bucket, key string) string {
+	return l.bucketPath(bucketType, bucket) + "/keys/" + escapePath(key)
+}
+
+func (typesLayout) mapredInputs(bucketType, bucket string) interface{} {
+	return []string{bucketType, bucket}
+}
+
+// untypedLayout is typesLayout addressing the default type through the
+// untyped endpoints under /buckets, as Riak 1.x did. Some Riak versions
+// treat them differently, props in particular.
+type untypedLayout struct {
+	typesLayout
+}
+
+func (l untypedLayout) typePath(bucketType string) string {
+	if bucketType == "default" {
+		return ""
+	}
+	return l.typesLayout.typePath(bucketType)
+}
+
+func (l untypedLayout) bucketPath(bucketType, bucket string) string {
+	if bucketType == "default" {
+		return "/buckets/" + escapePath(bucket)
+	}
+	return l.typesLayout.bucketPath(bucketType, bucket)
+}
+
+func (l untypedLayout) keyPath(bucketType, bucket, key string) string {
+	return l.bucketPath(bucketType, bucket) + "/keys/" + escapePath(key)
+}
+
+func (l untypedLayout) mapredInputs(bucketType, bucket string) interface{} {
+	if bucketType == "default" {
+		return bucket
+	}
+	return l.typesLayout.mapredInputs(bucketType, bucket)
+}
+
+// legacyLayout is the layout of SourceAPILegacy. The bucket type of its
+// paths is always the default one, and ignored.
+type legacyLayout struct{}
+
+func (legacyLayout) hasTypes() bool { return false }
+
+func (legacyLayout) typePath(string) string { return "" }
+
+func (legacyLayout) bucketPath(_, bucket string) string {
+	return "/buckets/" + escapePath(bucket)
+}
+
+func (legacyLayout) keyPath(_, bucket, key string) string {
+	return "/riak/" + escapePath(bucket) + "/" + escapePath(key)
+}
+
+func (legacyLayout) mapredInputs(_, bucket string) interface{} {
+	return bucket
+}
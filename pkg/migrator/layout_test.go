@@ -0,0 +1,123 @@
+package migrator
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLayoutPaths(t *testing.T) {
+	for _, tc := range []struct {
+		name                  string
+		layout                urlLayout
+		bucketType            string
+		typePath, bucket, key string
+	}{
+		{"types", typesLayout{}, "default", "/types/default", "/types/default/buckets/b%201", "/types/default/buckets/b%201/keys/a%2Fb"},
+		{"types", typesLayout{}, "maps", "/types/maps", "/types/maps/buckets/b%201", "/types/maps/buckets/b%201/keys/a%2Fb"},
+		{"untyped", untypedLayout{}, "default", "", "/buckets/b%201", "/buckets/b%201/keys/a%2Fb"},
+		{"untyped", untypedLayout{}, "maps", "/types/maps", "/types/maps/buckets/b%201", "/types/maps/buckets/b%201/keys/a%2Fb"},
+		{"legacy", legacyLayout{}, "default", "", "/buckets/b%201", "/riak/b%201/a%2Fb"},
+	} {
+		if got := tc.layout.typePath(tc.bucketType); got != tc.typePath {
+			t.Errorf("%s: type path of %s = %s, want %s", tc.name, tc.bucketType, got, tc.typePath)
+		}
+		if got := tc.layout.bucketPath(tc.bucketType, "b 1"); got != tc.bucket {
+			t.Errorf("%s: bucket path of %s = %s, want %s", tc.name, tc.bucketType, got, tc.bucket)
+		}
+		if got := tc.layout.keyPath(tc.bucketType, "b 1", "a/b"); got != tc.key {
+			t.Errorf("%s: key path of %s = %s, want %s", tc.name, tc.bucketType, got, tc.key)
+		}
+	}
+}
+
+func TestMigrateUntypedDefaultType(t *testing.T) {
+	typedSource := []string{
+		"GET /types/default/buckets/b1/keys/k1",
+		"GET /types/default/buckets/b1/keys?keys=true",
+		"GET /types/default/buckets/b1/props",
+		"GET /types/default/buckets?buckets=true",
+		"GET /types/maps/buckets/b2/keys/k2",
+		"GET /types/maps/buckets/b2/keys?keys=true",
+		"GET /types/maps/buckets/b2/props",
+		"GET /types/maps/buckets?buckets=true",
+	}
+	untypedSource := []string{
+		"GET /buckets/b1/keys/k1",
+		"GET /buckets/b1/keys?keys=true",
+		"GET /buckets/b1/props",
+		"GET /buckets?buckets=true",
+		"GET /types/maps/buckets/b2/keys/k2",
+		"GET /types/maps/buckets/b2/keys?keys=true",
+		"GET /types/maps/buckets/b2/props",
+		"GET /types/maps/buckets?buckets=true",
+	}
+	typedDest := []string{
+		"PUT /types/default/buckets/b1/keys/k1?returnbody=false",
+		"PUT /types/default/buckets/b1/props",
+		"PUT /types/maps/buckets/b2/keys/k2?returnbody=false",
+		"PUT /types/maps/buckets/b2/props",
+	}
+	untypedDest := []string{
+		"PUT /buckets/b1/keys/k1?returnbody=false",
+		"PUT /buckets/b1/props",
+		"PUT /types/maps/buckets/b2/keys/k2?returnbody=false",
+		"PUT /types/maps/buckets/b2/props",
+	}
+	for _, tc := range []struct {
+		name                         string
+		untypedSource, untypedDest   bool
+		sourceRequests, destRequests []string
+	}{
+		{"typed to typed", false, false, typedSource, typedDest},
+		{"untyped to typed", true, false, untypedSource, typedDest},
+		{"typed to untyped", false, true, typedSource, untypedDest},
+		{"untyped to untyped", true, true, untypedSource, untypedDest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			source, destination := newFakeRiak(t), newFakeRiak(t)
+			source.untyped, destination.untyped = tc.untypedSource, tc.untypedDest
+			source.put("default", "b1", "k1", "v1")
+			source.put("maps", "b2", "k2", "v2")
+
+			m := newTestMigrator(t, Config{
+				Source:        source.URL,
+				Destination:   destination.URL,
+				BucketTypes:   []string{"default", "maps"},
+				UntypedSource: tc.untypedSource,
+				UntypedDest:   tc.untypedDest,
+			})
+			if err := m.Migrate(context.Background()); err != nil {
+				t.Fatalf("migrate: %v", err)
+			}
+
+			if got := bucketRequests(source); !reflect.DeepEqual(got, tc.sourceRequests) {
+				t.Errorf("source requests\n%q\nwant\n%q", got, tc.sourceRequests)
+			}
+			if got := bucketRequests(destination); !reflect.DeepEqual(got, tc.destRequests) {
+				t.Errorf("destination requests\n%q\nwant\n%q", got, tc.destRequests)
+			}
+			for _, k := range []struct{ bucketType, bucket, key string }{{"default", "b1", "k1"}, {"maps", "b2", "k2"}} {
+				if destination.get(k.bucketType, k.bucket, k.key) == nil {
+					t.Errorf("%s/%s/%s not copied", k.bucketType, k.bucket, k.key)
+				}
+			}
+		})
+	}
+}
+
+// bucketRequests returns the requests f received of buckets and keys,
+// leaving out /ping and /stats, sorted.
+func bucketRequests(f *fakeRiak) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var requests []string
+	for _, r := range f.requests {
+		if r != "GET /stats" && r != "GET /ping" {
+			requests = append(requests, r)
+		}
+	}
+	sort.Strings(requests)
+	return requests
+}
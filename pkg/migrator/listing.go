@@ -0,0 +1,143 @@
+package migrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Key listing methods.
+const (
+	// ListMethodKeys lists keys with keys=true, which walks every key of
+	// the cluster.
+	ListMethodKeys = "keys"
+	// ListMethodIndex pages through the $bucket secondary index, which
+	// needs the leveldb backend.
+	ListMethodIndex = "index"
+	// ListMethodMapred lists keys with a MapReduce job, for old clusters
+	// without the $bucket index.
+	ListMethodMapred = "mapred"
+)
+
+// indexPageSize is the max_results of a $bucket index page.
+const indexPageSize = 5000
+
+// listKeys calls fn for every key of a bucket of client with the
+// configured listing method, or from the key cache for the source with
+// KeyCacheDir. drain waits until the keys passed to fn so far are
+// processed, so that a continuation is only saved once the keys before it
+// are done.
+func (m *Migrator) listKeys(ctx context.Context, client riakClient, bucketType, bucket string, fn func(key string) error, drain func()) error {
+	if m.cfg.KeyCacheDir != "" && client == m.source && m.mode != modeDelete {
+		return m.listCached(ctx, bucketType, bucket, fn, drain)
+	}
+	return m.listSource(ctx, client, bucketType, bucket, fn, drain)
+}
+
+// listSource lists the keys of a bucket of client for listKeys.
+func (m *Migrator) listSource(ctx context.Context, client riakClient, bucketType, bucket string, fn func(key string) error, drain func()) error {
+	switch m.cfg.ListMethod {
+	case ListMethodIndex:
+		return m.listByIndex(ctx, client, bucketType, bucket, fn, drain)
+	case ListMethodMapred:
+		return client.MapReduceKeys(ctx, bucketType, bucket, fn)
+	default:
+		return client.ListKeys(ctx, bucketType, bucket, fn)
+	}
+}
+
+// listByIndex pages through the $bucket index of a bucket, starting at the
+// continuation saved by an interrupted run.
+func (m *Migrator) listByIndex(ctx context.Context, client riakClient, bucketType, bucket string, fn func(key string) error, drain func()) error {
+	var continuation string
+	if m.listState != nil {
+		if continuation = m.listState.get(bucketType, bucket); continuation != "" {
+			m.log.Printf("INFO: bucket '%s' resume listing at continuation %s\n", bucket, continuation)
+		}
+	}
+
+	for {
+		keys, next, err := client.ListKeysPage(ctx, bucketType, bucket, continuation, indexPageSize)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err = fn(key); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+
+		if m.listState != nil {
+			drain()
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+			if err = m.listState.set(bucketType, bucket, next); err != nil {
+				return fmt.Errorf("save list state: %w", err)
+			}
+		}
+		continuation = next
+	}
+}
+
+// listState persists the continuations of index listings in progress, so
+// an interrupted run resumes listing where it stopped.
+type listState struct {
+	path string
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+func loadListState(path string) (*listState, error) {
+	s := &listState{path: path, tokens: make(map[string]string)}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &s.tokens); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *listState) get(bucketType, bucket string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokens[bucketType+"/"+bucket]
+}
+
+// set saves the continuation of a bucket, an empty one marks its listing
+// as done.
+func (s *listState) set(bucketType, bucket, continuation string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := bucketType + "/" + bucket
+	if continuation == "" {
+		if _, ok := s.tokens[name]; !ok {
+			return nil
+		}
+		delete(s.tokens, name)
+	} else {
+		s.tokens[name] = continuation
+	}
+
+	b, err := json.MarshalIndent(s.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
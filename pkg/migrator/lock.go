@@ -0,0 +1,169 @@
+package migrator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// lockName is the lock file at the root of a backup dir.
+const lockName = ".migrator-lock"
+
+// ErrLocked is a backup dir locked by another run.
+var ErrLocked = errors.New("backup dir is locked by another run")
+
+// lockInfo is the content of a lock file, identifying the run holding it.
+type lockInfo struct {
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Started  time.Time `json:"started"`
+}
+
+// LockBackupDir locks BackupDir against other runs backing up to or
+// restoring from it, and returns the func removing the lock. A lock left
+// by a run of this host that is gone is taken over; one of another host
+// can't be checked, force takes over any lock. The lock file stays
+// flocked while held, so of runs taking over the same lock at once only
+// one succeeds.
+func (m *Migrator) LockBackupDir(force bool) (func() error, error) {
+	dir := m.cfg.BackupDir
+	path := filepath.Join(dir, lockName)
+	hostname, _ := os.Hostname()
+	data, err := json.Marshal(lockInfo{PID: os.Getpid(), Hostname: hostname, Started: time.Now().UTC()})
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, '\n')
+
+	for attempt := 0; attempt < 3; attempt++ {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		switch {
+		case err == nil:
+			// A run taking over the lock just created, still empty,
+			// flocked it first.
+			if err = flock(file); err != nil {
+				_ = file.Close()
+				return nil, fmt.Errorf("%s: %w", dir, ErrLocked)
+			}
+		case os.IsExist(err):
+			if file, err = m.takeOverLock(path, hostname, force); err != nil {
+				return nil, err
+			}
+			if file == nil {
+				continue
+			}
+		default:
+			return nil, fmt.Errorf("lock %s: %w", path, err)
+		}
+
+		if err = writeLock(file, data); err != nil {
+			_ = os.Remove(path)
+			_ = file.Close()
+			return nil, err
+		}
+		return func() error {
+			err := os.Remove(path)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			return err
+		}, nil
+	}
+	return nil, fmt.Errorf("lock %s: removed and created again by other runs while taking it over", path)
+}
+
+// takeOverLock returns the lock file at path, flocked, when the run
+// holding it is gone or force is set. It returns nil when the lock was
+// removed meanwhile, to be created again.
+func (m *Migrator) takeOverLock(path, hostname string, force bool) (*os.File, error) {
+	dir := filepath.Dir(path)
+	if force {
+		m.log.Printf("WARN: forcing the lock of %s\n", dir)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	if err = flock(file); err != nil {
+		_ = file.Close()
+		if holder, err := readLock(path); err == nil && holder.PID != 0 {
+			return nil, lockedError(dir, holder)
+		}
+		return nil, fmt.Errorf("%s: %w", dir, ErrLocked)
+	}
+	// The holder may have removed the lock between opening and flocking it.
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if current, err := os.Stat(path); err != nil || !os.SameFile(info, current) {
+		_ = file.Close()
+		return nil, nil
+	}
+
+	holder, err := readLock(path)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	// An empty lock is one of a run that crashed creating it. In
+	// containers every run may be the same pid, which this process doesn't
+	// hold the lock with.
+	if holder.PID != 0 && (holder.Hostname != hostname || holder.PID != os.Getpid() && processAlive(holder.PID)) {
+		_ = file.Close()
+		return nil, lockedError(dir, holder)
+	}
+	m.log.Printf("WARN: taking over the lock of %s left by pid %d, which is gone\n", dir, holder.PID)
+	return file, nil
+}
+
+// writeLock replaces the content of the lock file with data.
+func writeLock(file *os.File, data []byte) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := file.WriteAt(data, 0)
+	return err
+}
+
+// lockedError returns the error of dir locked by holder.
+func lockedError(dir string, holder lockInfo) error {
+	return fmt.Errorf("%s by pid %d on %s since %s, use -force-unlock if it crashed: %w",
+		dir, holder.PID, holder.Hostname, holder.Started.Format(time.RFC3339), ErrLocked)
+}
+
+func readLock(path string) (lockInfo, error) {
+	var holder lockInfo
+	b, err := os.ReadFile(path)
+	if err != nil || len(b) == 0 {
+		return holder, err
+	}
+	if err = json.Unmarshal(b, &holder); err != nil {
+		return holder, fmt.Errorf("malformed %s: %w", path, err)
+	}
+	return holder, nil
+}
+
+// processAlive reports whether the process pid of this host runs. A
+// process of another user can't be signalled but runs.
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || !errors.Is(err, os.ErrProcessDone)
+}
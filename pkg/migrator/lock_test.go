@@ -0,0 +1,71 @@
+package migrator
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockBackupDirTakeOverOnce(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no flock on Windows")
+	}
+	dir := t.TempDir()
+	hostname, _ := os.Hostname()
+	// No process runs with a pid over the largest pid_max.
+	stale, err := json.Marshal(lockInfo{PID: 1<<22 + 1, Hostname: hostname, Started: time.Now().UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, lockName), stale, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	const runs = 8
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		unlocks  []func() error
+		failures []error
+	)
+	for i := 0; i < runs; i++ {
+		m := newTestMigrator(t, Config{Source: "http://source:8098", Destination: "http://destination:8098", BackupDir: dir})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := m.LockBackupDir(false)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failures = append(failures, err)
+				return
+			}
+			unlocks = append(unlocks, unlock)
+		}()
+	}
+	wg.Wait()
+
+	if len(unlocks) != 1 {
+		t.Fatalf("%d runs took over the stale lock, want 1", len(unlocks))
+	}
+	for _, err := range failures {
+		if !errors.Is(err, ErrLocked) {
+			t.Errorf("lock = %v, want %v", err, ErrLocked)
+		}
+	}
+	holder, err := readLock(filepath.Join(dir, lockName))
+	if err != nil || holder.PID != os.Getpid() {
+		t.Errorf("lock held by %+v, %v, want pid %d", holder, err, os.Getpid())
+	}
+	if err = unlocks[0](); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, lockName)); !os.IsNotExist(err) {
+		t.Errorf("lock left after unlock: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package migrator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const manifestName = "manifest.ndjson"
+
+// manifestEntry describes one key file of a directory backup.
+type manifestEntry struct {
+	BucketType string `json:"bucket_type"`
+	Bucket     string `json:"bucket"`
+	Key        string `json:"key"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+
+	LastModified string `json:"last_modified,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+}
+
+// path returns the location of the key file relative to the backup dir.
+func (e manifestEntry) path() string {
+	return filepath.Join(bucketDir(e.BucketType, e.Bucket), e.Key)
+}
+
+// manifestWriter appends entries to the manifest of a directory backup.
+// It is safe for concurrent use by the key workers.
+type manifestWriter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openManifest(dir string) (*manifestWriter, error) {
+	file, err := os.OpenFile(filepath.Join(dir, manifestName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("open manifest: %w", err)
+	}
+	return &manifestWriter{file: file}, nil
+}
+
+func (m *manifestWriter) Add(entry manifestEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err = m.file.Write(data)
+	return err
+}
+
+// Close closes the manifest, synced by s.
+func (m *manifestWriter) Close(s *syncer) error {
+	err := s.file(m.file)
+	if closeErr := m.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readManifest loads the manifest of a directory backup keyed by the
+// relative key file path. Later entries win, so a key re-written by a
+// subsequent run is checked against its latest checksum.
+func readManifest(dir string) (map[string]manifestEntry, error) {
+	file, err := os.Open(filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make(map[string]manifestEntry)
+	lines := NewLineIterator(file)
+	for n := 1; ; n++ {
+		line, err := lines.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var entry manifestEntry
+		if err = json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("manifest line %d: %w", n, err)
+		}
+		entries[entry.path()] = entry
+	}
+	return entries, nil
+}
+
+// writeManifest replaces the manifest of a directory backup with entries.
+// s syncs it and the dir.
+func writeManifest(dir string, entries []manifestEntry, s *syncer) error {
+	tmp := filepath.Join(dir, manifestName+".tmp")
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(file)
+	for _, entry := range entries {
+		if err = enc.Encode(entry); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if err = s.file(file); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, filepath.Join(dir, manifestName)); err != nil {
+		return err
+	}
+	return s.dir(dir)
+}
+
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func fileChecksum(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
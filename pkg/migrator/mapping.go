@@ -0,0 +1,73 @@
+package migrator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// destType returns the destination bucket type for a source bucket type.
+func (m *Migrator) destType(bucketType string) string {
+	if mapped, ok := m.cfg.TypeMap[bucketType]; ok {
+		return mapped
+	}
+	return bucketType
+}
+
+// destBucket returns the destination bucket for a source bucket.
+func (m *Migrator) destBucket(bucket string) string {
+	if mapped, ok := m.cfg.BucketMap[bucket]; ok {
+		return mapped
+	}
+	return bucket
+}
+
+// mappedBuckets returns the source buckets of a bucket map, sorted.
+func mappedBuckets(bucketMap map[string]string) []string {
+	buckets := make([]string, 0, len(bucketMap))
+	for bucket := range bucketMap {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+// sameCluster reports whether the source and destination are the same
+// cluster, going by their URLs.
+func (m *Migrator) sameCluster() bool {
+	return strings.TrimSuffix(m.cfg.Source, "/") == strings.TrimSuffix(m.cfg.Destination, "/")
+}
+
+// checkSameCluster refuses a copy within one cluster without a bucket map
+// or with a bucket mapped onto itself, which would only overwrite its keys
+// with themselves.
+func (m *Migrator) checkSameCluster(types []string) error {
+	if len(m.cfg.BucketMap) == 0 {
+		return fmt.Errorf("source and destination are the same cluster, a copy within it needs a bucket map")
+	}
+	for _, bucketType := range types {
+		if m.destType(bucketType) != bucketType {
+			continue
+		}
+		for _, bucket := range mappedBuckets(m.cfg.BucketMap) {
+			if m.destBucket(bucket) == bucket {
+				return fmt.Errorf("bucket '%s' of bucket type '%s' maps onto itself within the same cluster", bucket, bucketType)
+			}
+		}
+	}
+	return nil
+}
+
+// destKey returns the destination key for an unescaped source key: the
+// KeyPrefixStrip prefix is removed first, then KeyPrefixAdd is prepended.
+// It reports false when the key has to be skipped.
+func (m *Migrator) destKey(key string) (string, bool) {
+	if m.cfg.KeyPrefixStrip != "" {
+		if strings.HasPrefix(key, m.cfg.KeyPrefixStrip) {
+			key = strings.TrimPrefix(key, m.cfg.KeyPrefixStrip)
+		} else if m.cfg.SkipUnprefixed {
+			return "", false
+		}
+	}
+	return m.cfg.KeyPrefixAdd + key, true
+}
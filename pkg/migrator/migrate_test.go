@@ -0,0 +1,333 @@
+package migrator
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memKey names an object of a memClient.
+type memKey struct {
+	bucketType, bucket, key string
+}
+
+// memClient is an in-memory riakClient, to test the sync of keys without
+// HTTP. A request fails with errs[op], where op is the method and the
+// object, e.g. "PutObject default/b1/k1", or the method and bucket for
+// listings and props, e.g. "ListKeys default/b1".
+type memClient struct {
+	mu      sync.Mutex
+	objects map[memKey][]byte
+	props   map[string][]byte
+	errs    map[string]error
+	puts    []string
+}
+
+func newMemClient() *memClient {
+	return &memClient{
+		objects: make(map[memKey][]byte),
+		props:   make(map[string][]byte),
+		errs:    make(map[string]error),
+	}
+}
+
+func (c *memClient) put(bucketType, bucket, key, value string) {
+	c.mu.Lock()
+	c.objects[memKey{bucketType, bucket, key}] = []byte(value)
+	c.mu.Unlock()
+}
+
+func (c *memClient) get(bucketType, bucket, key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.objects[memKey{bucketType, bucket, key}]
+	return string(value), ok
+}
+
+// fail returns the error set for op, if any.
+func (c *memClient) fail(op string, names ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.errs[op+" "+strings.Join(names, "/")]
+}
+
+func (c *memClient) header(value []byte) http.Header {
+	return http.Header{
+		"Content-Type":  {"application/json"},
+		"Etag":          {fmt.Sprintf(`"%x"`, md5.Sum(value))},
+		"Last-Modified": {"Tue, 14 Nov 2023 22:13:20 GMT"},
+	}
+}
+
+func (c *memClient) BucketTypeExists(ctx context.Context, bucketType string) (bool, error) {
+	return true, c.fail("BucketTypeExists", bucketType)
+}
+
+func (c *memClient) ListBuckets(ctx context.Context, bucketType string) ([]string, error) {
+	if err := c.fail("ListBuckets", bucketType); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	seen := make(map[string]bool)
+	var buckets []string
+	for k := range c.objects {
+		if k.bucketType == bucketType && !seen[k.bucket] {
+			seen[k.bucket] = true
+			buckets = append(buckets, k.bucket)
+		}
+	}
+	c.mu.Unlock()
+	sort.Strings(buckets)
+	return buckets, nil
+}
+
+func (c *memClient) ListKeys(ctx context.Context, bucketType, bucket string, fn func(key string) error) error {
+	if err := c.fail("ListKeys", bucketType, bucket); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	var keys []string
+	for k := range c.objects {
+		if k.bucketType == bucketType && k.bucket == bucket {
+			keys = append(keys, k.key)
+		}
+	}
+	c.mu.Unlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *memClient) ListKeysPage(ctx context.Context, bucketType, bucket, continuation string, maxResults int) ([]string, string, error) {
+	var keys []string
+	err := c.ListKeys(ctx, bucketType, bucket, func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	return keys, "", err
+}
+
+func (c *memClient) MapReduceKeys(ctx context.Context, bucketType, bucket string, fn func(key string) error) error {
+	return c.ListKeys(ctx, bucketType, bucket, fn)
+}
+
+func (c *memClient) GetObject(ctx context.Context, bucketType, bucket, key string, header http.Header) (*object, error) {
+	if err := c.fail("GetObject", bucketType, bucket, key); err != nil {
+		return nil, err
+	}
+	value, ok := c.get(bucketType, bucket, key)
+	if !ok {
+		return nil, errNotFound
+	}
+	return &object{
+		Header: c.header([]byte(value)),
+		Body:   io.NopCloser(strings.NewReader(value)),
+		Size:   int64(len(value)),
+	}, nil
+}
+
+func (c *memClient) HeadObject(ctx context.Context, bucketType, bucket, key string) (http.Header, error) {
+	if err := c.fail("HeadObject", bucketType, bucket, key); err != nil {
+		return nil, err
+	}
+	value, ok := c.get(bucketType, bucket, key)
+	if !ok {
+		return nil, errNotFound
+	}
+	return c.header([]byte(value)), nil
+}
+
+func (c *memClient) PutObject(ctx context.Context, bucketType, bucket, key string, body io.Reader, header http.Header) error {
+	if err := c.fail("PutObject", bucketType, bucket, key); err != nil {
+		return err
+	}
+	var value bytes.Buffer
+	if _, err := value.ReadFrom(body); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := memKey{bucketType, bucket, key}
+	if _, ok := c.objects[k]; ok && header.Get("If-None-Match") == "*" {
+		return errPreconditionFailed
+	}
+	c.objects[k] = value.Bytes()
+	c.puts = append(c.puts, bucketType+"/"+bucket+"/"+key)
+	return nil
+}
+
+func (c *memClient) DeleteObject(ctx context.Context, bucketType, bucket, key string) error {
+	if err := c.fail("DeleteObject", bucketType, bucket, key); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := memKey{bucketType, bucket, key}
+	if _, ok := c.objects[k]; !ok {
+		return errNotFound
+	}
+	delete(c.objects, k)
+	return nil
+}
+
+func (c *memClient) GetProps(ctx context.Context, bucketType, bucket string) ([]byte, error) {
+	if err := c.fail("GetProps", bucketType, bucket); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if props, ok := c.props[bucketType+"/"+bucket]; ok {
+		return props, nil
+	}
+	return []byte(`{"props":{"n_val":3}}`), nil
+}
+
+func (c *memClient) PutProps(ctx context.Context, bucketType, bucket string, props []byte) error {
+	if err := c.fail("PutProps", bucketType, bucket); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.props[bucketType+"/"+bucket] = props
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memClient) GetStats(ctx context.Context) ([]byte, error) {
+	return []byte(`{"ring_members":["riak@a"],"ring_num_partitions":8,"ring_creation_size":8,"ring_ownership":"[{'riak@a',8}]"}`), nil
+}
+
+func (c *memClient) Ping(ctx context.Context) error {
+	return nil
+}
+
+// newMemMigrator returns a Migrator of cfg between two memClients.
+func newMemMigrator(t *testing.T, cfg Config, source, destination *memClient) *Migrator {
+	t.Helper()
+	cfg.Source, cfg.Destination = "http://source:8098", "http://destination:8098"
+	m := newTestMigrator(t, cfg)
+	m.source, m.destination = source, destination
+	return m
+}
+
+func TestMigrateCopiesAndSkipsKeys(t *testing.T) {
+	source, destination := newMemClient(), newMemClient()
+	source.put("default", "b1", "k1", "v1")
+	source.put("default", "b1", "k2", "v2")
+	source.put("default", "b2", "k3", "v3")
+	source.props["default/b1"] = []byte(`{"props":{"n_val":5}}`)
+	destination.put("default", "b1", "k2", "old")
+
+	m := newMemMigrator(t, Config{Overwrite: OverwriteIfMissing}, source, destination)
+	if err := m.Migrate(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	for _, tc := range []struct{ bucket, key, value string }{
+		{"b1", "k1", "v1"},
+		{"b1", "k2", "old"},
+		{"b2", "k3", "v3"},
+	} {
+		if value, _ := destination.get("default", tc.bucket, tc.key); value != tc.value {
+			t.Errorf("%s/%s on destination = %q, want %q", tc.bucket, tc.key, value, tc.value)
+		}
+	}
+	sort.Strings(destination.puts)
+	if want := []string{"default/b1/k1", "default/b2/k3"}; !reflect.DeepEqual(destination.puts, want) {
+		t.Errorf("PUTs = %q, want %q", destination.puts, want)
+	}
+	if n := m.totals.get(copied); n != 2 {
+		t.Errorf("copied %d keys, want 2", n)
+	}
+	if n := m.totals.get(skippedExisting); n != 1 {
+		t.Errorf("skipped %d existing keys, want 1", n)
+	}
+	if props := string(destination.props["default/b1"]); props != `{"props":{"n_val":5}}` {
+		t.Errorf("props of b1 on destination = %s", props)
+	}
+}
+
+func TestMigrateSkipsByOverwrite(t *testing.T) {
+	for _, tc := range []struct {
+		overwrite      string
+		conditionalPut bool
+		value          string
+		outcome        outcome
+	}{
+		{OverwriteAlways, false, "new", copied},
+		{OverwriteIfMissing, false, "old", skippedExisting},
+		{OverwriteAlways, true, "old", preconditionFailed},
+	} {
+		t.Run(fmt.Sprintf("%s conditional %v", tc.overwrite, tc.conditionalPut), func(t *testing.T) {
+			source, destination := newMemClient(), newMemClient()
+			source.put("default", "b1", "k1", "new")
+			destination.put("default", "b1", "k1", "old")
+
+			m := newMemMigrator(t, Config{Overwrite: tc.overwrite, ConditionalPut: tc.conditionalPut}, source, destination)
+			if err := m.Migrate(context.Background()); err != nil {
+				t.Fatalf("migrate: %v", err)
+			}
+			if value, _ := destination.get("default", "b1", "k1"); value != tc.value {
+				t.Errorf("value on destination = %q, want %q", value, tc.value)
+			}
+			if n := m.totals.get(tc.outcome); n != 1 {
+				t.Errorf("keys %s = %d, want 1: %s", outcomeNames[tc.outcome], n, &m.totals)
+			}
+		})
+	}
+}
+
+func TestMigrateErrors(t *testing.T) {
+	unavailable := &statusError{code: http.StatusServiceUnavailable, body: []byte("overloaded")}
+	for _, tc := range []struct {
+		name   string
+		op     string
+		err    error
+		strict bool
+		want   string // error of the run, none when empty
+		copied int64
+	}{
+		{name: "list buckets", op: "ListBuckets default", err: unavailable, want: "get list of bucket err"},
+		{name: "list keys", op: "ListKeys default/b1", err: unavailable, want: "503", copied: 1},
+		{name: "get props", op: "GetProps default/b1", err: unavailable, want: "props: get properties", copied: 1},
+		{name: "put props", op: "PutProps default/b1", err: unavailable, want: "props:", copied: 1},
+		{name: "rejected props", op: "PutProps default/b1", err: &statusError{code: http.StatusBadRequest}, copied: 3},
+		{name: "get key", op: "GetObject default/b1/k2", err: unavailable, want: "sync key 'k2'", copied: 2},
+		{name: "put key", op: "PutObject default/b1/k2", err: unavailable, want: "sync key 'k2'", copied: 2},
+		{name: "vanished key", op: "GetObject default/b1/k2", err: errNotFound, copied: 2},
+		{name: "vanished key, strict", op: "GetObject default/b1/k2", err: errNotFound, strict: true, want: "sync key 'k2'", copied: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			source, destination := newMemClient(), newMemClient()
+			source.put("default", "b1", "k1", "v1")
+			source.put("default", "b1", "k2", "v2")
+			source.put("default", "b2", "k3", "v3")
+			for _, c := range []*memClient{source, destination} {
+				c.errs[tc.op] = tc.err
+			}
+
+			m := newMemMigrator(t, Config{Strict: tc.strict, BucketParallel: 1}, source, destination)
+			err := m.Migrate(context.Background())
+			switch {
+			case tc.want == "" && err != nil:
+				t.Fatalf("migrate: %v", err)
+			case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+				t.Fatalf("migrate = %v, want %q", err, tc.want)
+			}
+			if n := m.totals.get(copied); n != tc.copied {
+				t.Errorf("copied %d keys, want %d: %s", n, tc.copied, &m.totals)
+			}
+		})
+	}
+}
@@ -0,0 +1,1249 @@
+// Package migrator copies the keys of a Riak cluster to another cluster
+// over the Riak HTTP API, and backs them up to and restores them from
+// directory trees or NDJSON streams.
+package migrator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Overwrite policies for keys already present on the destination.
+const (
+	OverwriteAlways    = "always"
+	OverwriteIfMissing = "if-missing"
+	OverwriteIfNewer   = "if-newer"
+)
+
+// Config configures a Migrator. Source and Destination are base URLs of
+// the Riak HTTP API, e.g. http://riak-0.riak:8098.
+type Config struct {
+	Source      string
+	Destination string
+	BucketTypes []string
+	// ProbeBucketTypes leaves out bucket types that don't exist on the
+	// source instead of failing on them.
+	ProbeBucketTypes bool
+	// Parallel is the number of keys processed at once across all
+	// buckets, 10 when unset. With AutoParallel it is the most processed
+	// at once.
+	Parallel int
+	// AutoParallel starts processing few keys at once and raises the
+	// number while the destination copes, see LatencyThreshold and
+	// MaxErrorRate.
+	AutoParallel bool
+	// BucketParallel is the number of buckets processed at once, 1 when
+	// unset.
+	BucketParallel int
+	// TypeParallel is the number of bucket types processed at once, 1 when
+	// unset. Each processes BucketParallel buckets at once, all of them
+	// share the Parallel workers.
+	TypeParallel int
+	// ListMethod is the way keys are listed, ListMethodKeys when empty.
+	ListMethod string
+	// SourceAPI is the URL layout of the source, SourceAPITypes when
+	// empty. SourceAPILegacy only has the default bucket type.
+	SourceAPI string
+	// UntypedSource and UntypedDest address the default bucket type of
+	// the source and destination through the untyped /buckets endpoints
+	// instead of /types/default.
+	UntypedSource bool
+	UntypedDest   bool
+	// ListStateFile is where index listings save their continuations, so
+	// an interrupted run resumes listing there. Not saved when empty.
+	ListStateFile string
+	// KeyCacheDir caches the key listings of the source, which runs reuse
+	// instead of listing the source again while they are not older than
+	// KeyCacheMaxAge, at any age when zero. Not cached when empty.
+	KeyCacheDir    string
+	KeyCacheMaxAge time.Duration
+	// ShardCount splits the keys in ShardCount shards, of which only the
+	// keys of shard ShardIndex are migrated, backed up or verified, see
+	// inShard. Unsharded when at most 1.
+	ShardIndex int
+	ShardCount int
+	// MaxObjectSize skips keys with values longer than it, or fails them
+	// with FailOnOversize, and records them in the NDJSON file at
+	// OversizeReport when set. Unlimited when zero.
+	MaxObjectSize  int64
+	FailOnOversize bool
+	OversizeReport string
+	// ValidateJSON checks that values with the application/json content
+	// type are valid JSON, holding each in memory to do so. InvalidJSON
+	// is what becomes of invalid ones, InvalidJSONWarn when empty, and
+	// they are recorded in the NDJSON file at InvalidJSONReport when set.
+	ValidateJSON      bool
+	InvalidJSON       string
+	InvalidJSONReport string
+	// TransformCmd is a shell command migrations pipe every value through,
+	// writing its output instead, with the key in the RIAK_BUCKET_TYPE,
+	// RIAK_BUCKET and RIAK_KEY environment variables. At most
+	// TransformParallel run at once, Parallel when zero, each for at most
+	// TransformTimeout, 30s when zero. A failed run fails the key, or
+	// skips it with TransformSkip.
+	TransformCmd      string
+	TransformParallel int
+	TransformTimeout  time.Duration
+	TransformSkip     bool
+	// ValueMatch only keeps the keys whose value matches it, in
+	// migrations, backups and their verification: either a field=value
+	// condition on a JSON field, dotted for nested ones, or else a
+	// regexp matched against the raw value. Values are held in memory to
+	// match them.
+	ValueMatch string
+	// MaxKeysPerBucket stops at the first MaxKeysPerBucket keys listed of
+	// every bucket, e.g. for rehearsals. Unlimited when zero.
+	MaxKeysPerBucket int64
+	// Strict fails keys deleted from the source between their listing and
+	// fetch, instead of skipping them.
+	Strict bool
+	// LatencyThreshold lowers the number of keys processed at once while
+	// the p95 latency of destination PUTs is over it, and MaxErrorRate
+	// while the share of failed keys is. Zero ones aren't checked; with
+	// neither set and no AutoParallel the number isn't lowered.
+	LatencyThreshold time.Duration
+	MaxErrorRate     float64
+	// Retries is the number of times a key or props request dropped by
+	// the connection is retried.
+	Retries int
+	// QuietProgress leaves out the periodic progress lines of buckets, e.g.
+	// for a progress bar showing Progress instead.
+	QuietProgress bool
+	// FailFast stops the run at the first failed bucket, or restored file
+	// of a directory backup. Otherwise the others are still processed and
+	// the failures returned at the end.
+	FailFast bool
+	// RequireStableRing refuses to start a migration, backup or delete
+	// when the stats of the source show transfers of partitions, or can't
+	// be read. Otherwise they are only logged.
+	RequireStableRing bool
+
+	// SourceClient and DestinationClient default to http.DefaultClient,
+	// Logger to the standard logger.
+	SourceClient      *http.Client
+	DestinationClient *http.Client
+	Logger            *log.Logger
+	// UserAgent is the User-Agent of the requests to the clusters,
+	// riak-migrator when empty.
+	UserAgent string
+	// RunID identifies the run in the X-Request-Id header of its requests,
+	// followed by a sequence number in the ones for a key, random when
+	// empty.
+	RunID string
+	// Timeouts bound the requests to the clusters by operation.
+	Timeouts Timeouts
+	// Debug logs every request to the clusters.
+	Debug bool
+	// TraceKeys are type/bucket/key names of keys whose requests are
+	// logged in full, headers and the start of bodies included. Keys are
+	// the source ones, the destination ones when verifying a restore.
+	TraceKeys []string
+	// OTelEndpoint is the OTLP/HTTP endpoint of an OpenTelemetry collector,
+	// e.g. http://collector:4318, runs export spans to: one per run and
+	// bucket, and per key and request for the OTelSampleRate share of the
+	// keys. Nothing is traced when empty.
+	OTelEndpoint   string
+	OTelSampleRate float64
+	// Quorum holds the quorum parameters of key GETs from the source and
+	// PUTs to the destination.
+	Quorum Quorum
+	// RiakTimeout is the timeout Riak applies to key GETs and PUTs, its
+	// default when zero. ReturnBody makes PUTs return the stored object,
+	// which the migrator doesn't read.
+	RiakTimeout time.Duration
+	ReturnBody  bool
+	// Fsync syncs backup files to disk before they are closed, and their
+	// dirs once files are renamed into them, so a backup survives a crash
+	// of the host. It costs throughput, the time spent is logged.
+	Fsync bool
+	// CompressTransfer gzip encodes the values PUT to the destination,
+	// unless a probe at the start finds it doesn't take them. Riak stores
+	// them encoded, so this needs a proxy decoding them in front of it.
+	CompressTransfer bool
+	// GzipProbeType and GzipProbeBucket are where the CompressTransfer probe
+	// writes and deletes its key on the destination, the default type and
+	// DefaultProbeBucket when empty.
+	GzipProbeType   string
+	GzipProbeBucket string
+	// NoSourceGzip fetches key values from the source as they are stored
+	// instead of asking for them gzip encoded, e.g. for a proxy in front
+	// of it mishandling the encoding.
+	NoSourceGzip bool
+
+	// Overwrite is the policy for keys already present on the destination,
+	// OverwriteAlways when empty.
+	Overwrite string
+	// Delta compares the headers of keys present on both clusters before
+	// fetching them, and skips the ones not newer on the source.
+	Delta bool
+	// SkipIdentical skips keys present on both clusters whose headers
+	// show the same content, see identical.
+	SkipIdentical bool
+	// VerifyAfter makes migrations compare the keys of every bucket
+	// between the clusters once it is synced: a sample of them picked as
+	// for VerifySample, all of them when no sample is set.
+	VerifyAfter bool
+	// VerifyBackupAfter makes directory backups check the keys of every
+	// bucket once it is written, sampled as for VerifyAfter: their files
+	// are read again against the checksums written to the manifest, and
+	// their values compared with the source.
+	VerifyBackupAfter bool
+	// ConditionalPut sends PUTs with If-None-Match: *, so keys written to
+	// the destination meanwhile are kept.
+	ConditionalPut bool
+
+	// TypeMap renames bucket types on the destination.
+	TypeMap map[string]string
+	// BucketMap renames buckets on the destination, in every bucket type.
+	// A migration with the same Source and Destination copies within one
+	// cluster: it needs BucketMap, only copies its buckets and refuses
+	// ones mapped onto themselves.
+	BucketMap map[string]string
+	// KeyPrefixStrip is removed from and KeyPrefixAdd then prepended to
+	// every key written to the destination. Keys without KeyPrefixStrip
+	// are written unchanged, or skipped with SkipUnprefixed.
+	KeyPrefixAdd   string
+	KeyPrefixStrip string
+	SkipUnprefixed bool
+
+	// DiffETags makes diffs compare the ETags of keys found on both
+	// clusters.
+	DiffETags bool
+
+	// SampleRate is the share of keys, or SampleCount the number of keys
+	// per bucket, VerifySample checks. SampleSeed picks the sample.
+	SampleRate  float64
+	SampleCount int
+	SampleSeed  int64
+
+	// BackupDir is the root of directory backups.
+	BackupDir string
+	// RestoreTypes, RestoreBuckets and RestoreKeyPrefix limit restores to
+	// the keys of the listed bucket types and buckets with the prefix. Empty
+	// ones don't filter.
+	RestoreTypes     []string
+	RestoreBuckets   []string
+	RestoreKeyPrefix string
+	// IgnoreManifest restores the files of directory backups without
+	// checking them against the manifest.
+	IgnoreManifest bool
+	// IgnoreVClocks restores NDJSON records without their vclocks, e.g.
+	// into a new cluster, where the vclocks of another one mean nothing.
+	IgnoreVClocks bool
+	// FailOnSiblings fails the restore of NDJSON records of keys with
+	// siblings, instead of restoring their last modified sibling.
+	FailOnSiblings bool
+	// RestoreVClock reads the vclock of every key on the destination
+	// before restoring it and sends it on the PUT, so restoring twice into
+	// an allow_mult bucket supersedes the values instead of adding
+	// siblings. It doubles the requests of a restore.
+	RestoreVClock bool
+	// CleanDest deletes the keys of every destination bucket a restore
+	// writes to before restoring its keys, so keys deleted since the
+	// backup don't survive it. With DryRun the keys are only counted.
+	CleanDest bool
+	// DeleteBuckets are the buckets of every bucket type Delete empties.
+	DeleteBuckets []string
+	// DryRun makes restores validate the backup and report the keys they
+	// would write, without writing any, and Delete count the keys it
+	// would delete.
+	DryRun bool
+	// RestoreCount counts the files of a directory backup before
+	// restoring it, so progress is logged against a total.
+	RestoreCount bool
+	// SkipExisting skips keys already present in BackupDir.
+	SkipExisting bool
+	// ResumeIndex is a key listing file where stream backups record the
+	// keys they wrote, in batches, and which keys later ones skip, so a
+	// rerun after a failed backup only writes the rest. Split backups
+	// then start a new file after the existing ones. Not used when empty.
+	ResumeIndex string
+	// Incremental only downloads keys changed since the previous backup
+	// in BackupDir.
+	Incremental bool
+	// FailuresFile is an NDJSON file migrations append the keys failing
+	// them to as they fail, which ResumeFailures retries. The keys of a
+	// bucket not tried after another of its keys failed aren't in it. Not
+	// used when empty.
+	FailuresFile string
+	// EstimateSample is the share of the keys Estimate HEADs, picked by
+	// SampleSeed, all of them when zero.
+	EstimateSample float64
+}
+
+// Timeouts bound the requests of each kind of operation, from sending
+// them to reading their response. Zero ones don't bound them.
+type Timeouts struct {
+	// List bounds bucket and key listings, a whole listing for
+	// ListMethodKeys and ListMethodMapred, a page for ListMethodIndex.
+	List time.Duration
+	// Get bounds key GETs and HEADs, Put key PUTs.
+	Get time.Duration
+	Put time.Duration
+	// Props bounds bucket type and bucket props requests.
+	Props time.Duration
+}
+
+type mode int
+
+const (
+	modeMigrate mode = iota
+	modeBackupDir
+	modeBackupStream
+	modeDelete
+	modeEstimate
+)
+
+// Migrator runs migrations, backups, restores and backup verifications.
+// It runs one operation at a time.
+type Migrator struct {
+	cfg         Config
+	log         *log.Logger
+	source      riakClient
+	destination riakClient
+
+	totals    counters
+	latencies latencies
+	retries   retryStats
+	work      chan workItem
+	limit     *limiter
+	throttle  *throttle
+	listState *listState
+
+	longKeysMu sync.Mutex
+
+	oversizeReport *keyReport
+	jsonReport     *keyReport
+	transformer    *transformer
+	matcher        *valueMatcher
+	traced         map[string]bool
+	tracer         *tracer
+	// fsync is nil unless Fsync is set.
+	fsync *syncer
+
+	// gzipPut is whether PUT bodies are compressed, decided on the first
+	// run by checkCompression.
+	gzipMu      sync.Mutex
+	gzipChecked bool
+	gzipPut     bool
+	sent        transferStats
+	received    transferStats
+
+	truncatedMu sync.Mutex
+	truncated   []string
+
+	// failed counts the failed keys, buckets has the summaries of the
+	// buckets synced.
+	failed    int64
+	bucketsMu sync.Mutex
+	buckets   []BucketSummary
+
+	progress runProgress
+	activeMu sync.Mutex
+	active   []*bucketJob
+
+	// requests counts the request IDs of keys.
+	requests int64
+	// typeStats tallies the key outcomes of every bucket type.
+	typeStatsMu sync.Mutex
+	typeStats   map[string]*counters
+
+	mode     mode
+	output   *recordWriter
+	resume   *resumeIndex
+	manifest *manifestWriter
+	previous *incrementalState
+	cleaned  cleaner
+	// ring is the check of the source ring before the last run.
+	ring *RingCheck
+	// estimates has the buckets sized by Estimate.
+	estimates []BucketEstimate
+	// failures records the failed keys of migrations in FailuresFile.
+	failures *failureLog
+}
+
+func New(cfg Config) (*Migrator, error) {
+	if cfg.Parallel <= 0 {
+		cfg.Parallel = 10
+	}
+	if cfg.BucketParallel <= 0 {
+		cfg.BucketParallel = 1
+	}
+	if cfg.TypeParallel <= 0 {
+		cfg.TypeParallel = 1
+	}
+	if cfg.SourceClient == nil {
+		cfg.SourceClient = http.DefaultClient
+	}
+	if cfg.DestinationClient == nil {
+		cfg.DestinationClient = http.DefaultClient
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.Default()
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = "riak-migrator"
+	}
+	if cfg.RunID == "" {
+		cfg.RunID = newRunID()
+	}
+	if cfg.GzipProbeType == "" {
+		cfg.GzipProbeType = "default"
+	}
+	if cfg.GzipProbeBucket == "" {
+		cfg.GzipProbeBucket = DefaultProbeBucket
+	}
+
+	switch cfg.ListMethod {
+	case "":
+		cfg.ListMethod = ListMethodKeys
+	case ListMethodKeys, ListMethodIndex, ListMethodMapred:
+	default:
+		return nil, fmt.Errorf("unknown list method '%s'", cfg.ListMethod)
+	}
+
+	var sourceLayout, destinationLayout urlLayout = typesLayout{}, typesLayout{}
+	if cfg.UntypedSource {
+		sourceLayout = untypedLayout{}
+	}
+	if cfg.UntypedDest {
+		destinationLayout = untypedLayout{}
+	}
+	switch cfg.SourceAPI {
+	case "", SourceAPITypes:
+	case SourceAPILegacy:
+		sourceLayout = legacyLayout{}
+		for _, bucketType := range cfg.BucketTypes {
+			if bucketType != "default" {
+				return nil, fmt.Errorf("the legacy source API has no bucket type '%s', only the default one", bucketType)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown source API '%s'", cfg.SourceAPI)
+	}
+
+	switch cfg.Overwrite {
+	case "":
+		cfg.Overwrite = OverwriteAlways
+	case OverwriteAlways, OverwriteIfMissing, OverwriteIfNewer:
+	default:
+		return nil, fmt.Errorf("unknown overwrite policy '%s'", cfg.Overwrite)
+	}
+
+	switch cfg.InvalidJSON {
+	case "":
+		cfg.InvalidJSON = InvalidJSONWarn
+	case InvalidJSONWarn, InvalidJSONSkip, InvalidJSONFail:
+	default:
+		return nil, fmt.Errorf("unknown invalid JSON policy '%s'", cfg.InvalidJSON)
+	}
+
+	if cfg.ShardCount < 0 || cfg.ShardCount > 1 && (cfg.ShardIndex < 0 || cfg.ShardIndex >= cfg.ShardCount) {
+		return nil, fmt.Errorf("invalid shard %d of %d", cfg.ShardIndex, cfg.ShardCount)
+	}
+	if err := cfg.Quorum.validate(); err != nil {
+		return nil, err
+	}
+
+	// Walks don't follow a symlinked root, e.g. the latest timestamped
+	// backup.
+	if dir, err := filepath.EvalSymlinks(cfg.BackupDir); err == nil {
+		cfg.BackupDir = dir
+	}
+
+	if cfg.RiakTimeout < 0 || cfg.RiakTimeout > 0 && cfg.RiakTimeout < time.Millisecond {
+		return nil, fmt.Errorf("invalid riak timeout %s, want at least 1ms", cfg.RiakTimeout)
+	}
+
+	source := newHTTPClient(cfg.Source, cfg.SourceClient, ErrSourceUnreachable)
+	destination := newHTTPClient(cfg.Destination, cfg.DestinationClient, ErrDestinationUnreachable)
+	source.layout, destination.layout = sourceLayout, destinationLayout
+	source.getQuery, destination.putQuery = keyQueries(cfg)
+	source.timeouts, destination.timeouts = cfg.Timeouts, cfg.Timeouts
+	source.userAgent, destination.userAgent = cfg.UserAgent, cfg.UserAgent
+	source.runID, destination.runID = cfg.RunID, cfg.RunID
+	if cfg.Debug {
+		source.debug, destination.debug = cfg.Logger, cfg.Logger
+	}
+	traced, err := parseTraceKeys(cfg.TraceKeys)
+	if err != nil {
+		return nil, err
+	}
+	source.trace, destination.trace = cfg.Logger, cfg.Logger
+
+	m := &Migrator{
+		cfg:         cfg,
+		log:         cfg.Logger,
+		source:      source,
+		destination: destination,
+		traced:      traced,
+	}
+	source.acceptEncoding, source.received = "gzip", &m.received
+	if cfg.NoSourceGzip {
+		source.acceptEncoding = "identity"
+	}
+	if cfg.Fsync {
+		m.fsync = &syncer{}
+	}
+	if cfg.ValueMatch != "" {
+		var err error
+		if m.matcher, err = newValueMatcher(cfg.ValueMatch); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.OTelEndpoint != "" {
+		if cfg.OTelSampleRate < 0 || cfg.OTelSampleRate > 1 {
+			return nil, fmt.Errorf("invalid OpenTelemetry sample rate %g, want 0 to 1", cfg.OTelSampleRate)
+		}
+		m.tracer = newTracer(cfg.OTelEndpoint, cfg.OTelSampleRate, cfg.Logger)
+		source.tracer, destination.tracer = m.tracer, m.tracer
+	}
+	if cfg.TransformCmd != "" {
+		limit := cfg.TransformParallel
+		if limit <= 0 {
+			limit = cfg.Parallel
+		}
+		m.transformer = newTransformer(cfg.TransformCmd, limit, cfg.TransformTimeout)
+	}
+	source.inFlight, destination.inFlight = &m.progress.inFlight, &m.progress.inFlight
+	return m, nil
+}
+
+// Migrate copies every bucket of the configured bucket types, with its
+// props and keys, from the source to the destination.
+func (m *Migrator) Migrate(ctx context.Context) error {
+	m.mode = modeMigrate
+	return m.run(ctx)
+}
+
+// Delete deletes every key of the DeleteBuckets of the bucket types on the
+// source, which Riak has no single operation for. With DryRun the keys are
+// only counted.
+func (m *Migrator) Delete(ctx context.Context) error {
+	m.mode = modeDelete
+	return m.run(ctx)
+}
+
+func (m *Migrator) run(ctx context.Context) (err error) {
+	types, err := m.bucketTypes(ctx)
+	if err != nil {
+		return err
+	}
+	if m.mode == modeMigrate && m.sameCluster() {
+		if err = m.checkSameCluster(types); err != nil {
+			return err
+		}
+	}
+	if m.mode == modeMigrate {
+		if err = m.checkCompression(ctx); err != nil {
+			return err
+		}
+	}
+	if err = m.checkRing(ctx); err != nil {
+		return err
+	}
+	m.log.Printf("INFO: bucket types: %s\n", strings.Join(types, ","))
+	if label := m.shardLabel(); label != "" {
+		m.log.Printf("INFO: only processing the keys%s\n", label)
+	}
+
+	if m.cfg.ListStateFile != "" {
+		if m.listState, err = loadListState(m.cfg.ListStateFile); err != nil {
+			return fmt.Errorf("load list state: %w", err)
+		}
+	}
+
+	m.truncated, m.buckets, m.typeStats = nil, nil, nil
+	if m.cfg.OversizeReport != "" {
+		m.oversizeReport = &keyReport{name: "oversize report", path: m.cfg.OversizeReport}
+		defer m.oversizeReport.Close()
+	}
+	if m.cfg.InvalidJSONReport != "" {
+		m.jsonReport = &keyReport{name: "invalid JSON report", path: m.cfg.InvalidJSONReport}
+		defer m.jsonReport.Close()
+	}
+	if m.cfg.FailuresFile != "" && m.mode == modeMigrate {
+		if m.failures, err = openFailureLog(m.cfg.FailuresFile); err != nil {
+			return fmt.Errorf("open failures file: %w", err)
+		}
+		defer func() {
+			if closeErr := m.failures.Close(m.fsync); err == nil {
+				err = closeErr
+			}
+			m.failures = nil
+		}()
+	}
+	closePool := m.startPool(ctx)
+	defer closePool()
+	// The workers don't get the span of the run, only sampled keys make
+	// request spans.
+	spanCtx, endSpan := m.traceRun(ctx, types)
+	defer func() { endSpan(err) }()
+
+	failures := m.syncTypes(spanCtx, types)
+
+	if len(types) > 1 {
+		for _, bType := range types {
+			m.log.Printf("INFO: bucket type '%s' keys: %s\n", bType, m.typeCounters(bType))
+		}
+	}
+	m.log.Printf("INFO: keys%s: %s\n", m.shardLabel(), &m.totals)
+	m.logRetries()
+	m.logTransfer()
+	m.logLatencies()
+	if len(m.truncated) > 0 {
+		m.log.Printf("WARN: %d buckets truncated by the key limit, the run is incomplete: %s\n",
+			len(m.truncated), strings.Join(m.truncated, ", "))
+	}
+	if len(failures) > 0 {
+		return failures
+	}
+	if n := m.totals.get(mismatched); n > 0 && ctx.Err() == nil {
+		return fmt.Errorf("%d of %d verified keys mismatched: %w", n, n+m.totals.get(verified), ErrDifferent)
+	}
+	return ctx.Err()
+}
+
+// syncTypes syncs the buckets of types, TypeParallel types at once. A
+// failed type only stops the others with FailFast.
+func (m *Migrator) syncTypes(ctx context.Context, types []string) multiError {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		failures multiError
+	)
+	slots := make(chan struct{}, m.cfg.TypeParallel)
+types:
+	for _, bucketType := range types {
+		select {
+		case <-ctx.Done():
+			break types
+		case slots <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(bucketType string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := m.syncBuckets(ctx, bucketType); err != nil {
+				mu.Lock()
+				failures = failures.add(err)
+				mu.Unlock()
+				if m.cfg.FailFast {
+					stop()
+				}
+			}
+		}(bucketType)
+	}
+	wg.Wait()
+	return failures
+}
+
+// bucketTypes returns the configured bucket types, leaving out the ones
+// missing on the source when ProbeBucketTypes is set.
+func (m *Migrator) bucketTypes(ctx context.Context) ([]string, error) {
+	if !m.cfg.ProbeBucketTypes {
+		return m.cfg.BucketTypes, nil
+	}
+
+	types := make([]string, 0, len(m.cfg.BucketTypes))
+	for _, bucketType := range m.cfg.BucketTypes {
+		exists, err := m.source.BucketTypeExists(ctx, bucketType)
+		if err != nil {
+			return nil, fmt.Errorf("probe bucket type %s: %w", bucketType, err)
+		}
+		if !exists {
+			m.log.Printf("WARN: bucket type '%s' doesn't exist on source, skip it\n", bucketType)
+			continue
+		}
+		types = append(types, bucketType)
+	}
+	return types, nil
+}
+
+func (m *Migrator) syncBuckets(ctx context.Context, bucketType string) error {
+	m.setPhase(phaseListing)
+	var (
+		buckets []string
+		err     error
+	)
+	switch {
+	case m.mode == modeDelete:
+		// Listing buckets scans every key, Delete is given its buckets.
+		buckets = m.cfg.DeleteBuckets
+	case m.mode == modeMigrate && m.sameCluster():
+		buckets = mappedBuckets(m.cfg.BucketMap)
+	default:
+		if buckets, err = m.source.ListBuckets(ctx, bucketType); err != nil {
+			return fmt.Errorf("get list of bucket err: %w", err)
+		}
+	}
+	atomic.AddInt64(&m.progress.buckets, int64(len(buckets)))
+
+	if m.mode == modeBackupDir {
+		if err = mkdir(filepath.Join(m.cfg.BackupDir, escapeSegment(bucketType))); err != nil {
+			return err
+		}
+	}
+	if m.previous != nil {
+		m.previous.listBuckets(bucketType, buckets)
+	}
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		failures multiError
+	)
+	slots := make(chan struct{}, m.cfg.BucketParallel)
+buckets:
+	for _, bucket := range buckets {
+		select {
+		case <-ctx.Done():
+			break buckets
+		case slots <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(bucket string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			defer atomic.AddInt64(&m.progress.bucketsDone, 1)
+
+			if err := m.syncBucket(ctx, bucketType, bucket); err != nil {
+				err = fmt.Errorf("sync bucket %s err: %w", bucket, err)
+				m.log.Printf("ERR: %s\n", err)
+				mu.Lock()
+				failures = append(failures, err)
+				mu.Unlock()
+				if m.cfg.FailFast {
+					stop()
+				}
+				return
+			}
+			m.log.Printf("INFO: finish sync bucket '%s' (%s)\n", bucket, bucketType)
+		}(bucket)
+	}
+	wg.Wait()
+
+	if len(failures) > 0 {
+		return failures
+	}
+	return nil
+}
+
+func (m *Migrator) syncBucket(ctx context.Context, bucketType, bucket string) (err error) {
+	m.log.Printf("INFO: start sync bucket '%s' (%s)\n", bucket, bucketType)
+	started := time.Now()
+	ctx, span := m.tracer.start(ctx, spanFrom(ctx), "sync bucket", spanKindInternal,
+		stringAttr("riak.bucket_type", bucketType), stringAttr("riak.bucket", bucket))
+	job := &bucketJob{bucketType: bucketType, bucket: bucket, span: span}
+	m.activate(job)
+	defer func() {
+		span.setAttr(intAttr("riak.keys", atomic.LoadInt64(&job.done)))
+		span.finish(err)
+		m.deactivate(job)
+		m.typeCounters(bucketType).merge(&job.stats)
+		m.summarizeBucket(bucketType, bucket, job, started, err)
+		if m.mode == modeDelete {
+			m.log.Printf("INFO: bucket '%s' (%s) delete: %s, %d failed\n", bucket, bucketType, &job.stats, len(job.failures))
+		}
+	}()
+
+	switch m.mode {
+	case modeMigrate:
+		err := m.retry(ctx, func() error {
+			return m.syncProperties(ctx, bucketType, bucket)
+		})
+		if err != nil {
+			return fmt.Errorf("props: %w", err)
+		}
+	case modeBackupDir:
+		dir := filepath.Join(m.cfg.BackupDir, bucketDir(bucketType, bucket))
+		if err := mkdir(dir); err != nil {
+			return err
+		}
+		if err := m.backupProps(ctx, bucketType, bucket, dir); err != nil {
+			return fmt.Errorf("props: %w", err)
+		}
+	}
+
+	// Keys already handed to a worker are finished, a failure only stops
+	// the listing and dispatch of the remaining ones.
+	dispatchCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	job.stop = stop
+
+	tick := time.NewTicker(time.Second * 5)
+	defer tick.Stop()
+	var (
+		listed   int64
+		prev     throughput
+		prevDone int64
+		prevAt   = time.Now()
+	)
+	progress := func() {
+		if m.cfg.QuietProgress {
+			return
+		}
+		var workers string
+		if m.throttle != nil {
+			workers = fmt.Sprintf(", %d workers", m.limit.get())
+		}
+		cur, done, now := job.throughput.snapshot(), atomic.LoadInt64(&job.done), time.Now()
+		rates := cur.since(prev, done-prevDone, now.Sub(prevAt))
+		prev, prevDone, prevAt = cur, done, now
+		m.log.Printf("INFO: bucket '%s' (%s) progress: processed %d of %d listed keys (%s), %s%s\n",
+			bucket, bucketType, done, listed, &job.stats, rates, workers)
+	}
+
+	// wait waits until the keys handed to the workers are processed.
+	wait := func() {
+		finished := make(chan struct{})
+		go func() {
+			job.pending.Wait()
+			close(finished)
+		}()
+		for {
+			select {
+			case <-finished:
+				return
+			case <-tick.C:
+				progress()
+			}
+		}
+	}
+
+	// A resumed listing misses the keys before its continuation, so
+	// incremental backups keep the previous keys of the bucket.
+	resumed := m.listState != nil && m.listState.get(bucketType, bucket) != ""
+
+	dispatch := func(item workItem) error {
+		job.pending.Add(1)
+		for {
+			select {
+			case <-dispatchCtx.Done():
+				job.pending.Done()
+				return dispatchCtx.Err()
+			case <-tick.C:
+				progress()
+			case m.work <- item:
+				return nil
+			}
+		}
+	}
+
+	var sample *sampler
+	switch {
+	case m.cfg.VerifyAfter && m.mode == modeMigrate:
+		sample = m.newSampler()
+		job.synced = make(map[string]outcome)
+	case m.cfg.VerifyBackupAfter && m.mode == modeBackupDir:
+		sample = m.newSampler()
+		job.backedUp = make(map[string]manifestEntry)
+	}
+
+	// Estimates HEAD a sample of the keys only.
+	headed := m.newEstimateSampler()
+
+	// The key list is only held in memory when incremental backups need
+	// it to find disappeared keys.
+	var keys []string
+	m.setPhase(phaseListing)
+	err = m.listKeys(dispatchCtx, m.source, bucketType, bucket, func(key string) error {
+		if !m.inShard(bucket, key) {
+			return nil
+		}
+		if listed == 0 {
+			m.setPhase(m.syncPhase())
+		}
+		if m.cfg.MaxKeysPerBucket > 0 && listed >= m.cfg.MaxKeysPerBucket {
+			return errKeyLimit
+		}
+		listed++
+		atomic.StoreInt64(&job.listed, listed)
+		if m.previous != nil && !resumed {
+			keys = append(keys, key)
+		}
+		if headed != nil && !headed.offer(key) {
+			return nil
+		}
+
+		item := workItem{bucketType: bucketType, bucket: bucket, key: key, job: job}
+		item.sample = sample != nil && sample.offer(key)
+		return dispatch(item)
+	}, wait)
+	switch {
+	case errors.Is(err, errNotFound):
+		m.log.Printf("WARN: bucket %s haven't keys", bucket)
+		if m.previous != nil {
+			m.previous.listKeys(bucketType, bucket, nil)
+		}
+	case dispatchCtx.Err() != nil:
+		// Stopped by a failed key or by ctx, reported below.
+	case errors.Is(err, errKeyLimit):
+		// The keys past the limit weren't listed, so incremental backups
+		// keep the previous keys of the bucket.
+		m.log.Printf("WARN: bucket '%s' truncated to its first %d keys\n", bucket, listed)
+		m.truncate(bucketType, bucket)
+	case err != nil:
+		job.fail(fmt.Errorf("list keys: %w", err))
+	case m.previous != nil && !resumed:
+		m.previous.listKeys(bucketType, bucket, keys)
+	}
+
+	wait()
+	if err = job.err(); err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	if sample != nil {
+		// Only keys written or found unchanged on the destination are
+		// expected to match, and only keys written to a backup by this
+		// run are checked.
+		m.setPhase(phaseVerifying)
+		for _, key := range sample.keys() {
+			if job.backedUp != nil {
+				if _, ok := job.backedUp[key]; !ok {
+					continue
+				}
+			} else if o, ok := job.synced[key]; !ok || o != copied && o != unchanged {
+				continue
+			}
+			if dispatch(workItem{bucketType: bucketType, bucket: bucket, key: key, job: job, verify: true}) != nil {
+				break
+			}
+		}
+		wait()
+		if err = job.err(); err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		m.log.Printf("INFO: bucket '%s' verified %d keys, %d mismatched\n",
+			bucket, job.stats.get(verified)+job.stats.get(mismatched), job.stats.get(mismatched))
+	}
+
+	if m.mode == modeEstimate {
+		m.addEstimate(job)
+	}
+	if m.listState != nil {
+		return m.listState.set(bucketType, bucket, "")
+	}
+	return nil
+}
+
+// syncKey syncs the key of item, adding its requests to the throughput of
+// its bucket.
+func (m *Migrator) syncKey(ctx context.Context, item workItem) (o outcome, err error) {
+	bucketType, bucket, key, tp := item.bucketType, item.bucket, item.key, &item.job.throughput
+	ctx = m.trace(ctx, bucketType, bucket, key)
+	switch m.mode {
+	case modeDelete:
+		return m.deleteKey(ctx, bucketType, bucket, key)
+	case modeEstimate:
+		return m.estimateKey(ctx, item)
+	}
+	dstKey, ok := m.destKey(key)
+	if !ok && m.mode == modeMigrate {
+		return skippedUnprefixed, nil
+	}
+	fileKey := escapeKey(key)
+	if m.mode == modeBackupDir {
+		fileKey, _ = keyFileName(key)
+	}
+	if m.resume != nil && m.resume.has(bucketType, bucket, fileKey) {
+		return skippedResumed, nil
+	}
+	if m.cfg.SkipExisting && m.mode == modeBackupDir {
+		if info, err := os.Stat(filepath.Join(m.cfg.BackupDir, bucketDir(bucketType, bucket), fileKey)); err == nil && info.Size() > 0 {
+			return skippedExisting, nil
+		}
+	}
+
+	var destHeader http.Header
+	if (m.cfg.Overwrite != OverwriteAlways || m.cfg.Delta || m.cfg.SkipIdentical) && m.mode == modeMigrate {
+		var err error
+		start := time.Now()
+		destHeader, err = m.destination.HeadObject(ctx, m.destType(bucketType), m.destBucket(bucket), dstKey)
+		m.latencies.record(bucketType, opDestHead, time.Since(start))
+		if err != nil && !errors.Is(err, errNotFound) {
+			return 0, fmt.Errorf("head destination: %w", err)
+		}
+		if destHeader != nil && m.cfg.Overwrite == OverwriteIfMissing {
+			return skippedExisting, nil
+		}
+	}
+	if destHeader != nil && (m.cfg.Delta || m.cfg.SkipIdentical) {
+		start := time.Now()
+		srcHeader, err := m.source.HeadObject(ctx, bucketType, bucket, key)
+		m.latencies.record(bucketType, opSourceHead, time.Since(start))
+		if errors.Is(err, errNotFound) && !m.cfg.Strict {
+			return m.vanished(bucket, key), nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("head key: %w", err)
+		}
+		if m.cfg.SkipIdentical && identical(srcHeader, destHeader) {
+			return skippedIdentical, nil
+		}
+		if m.cfg.Delta {
+			if o, err := compareDelta(srcHeader, destHeader); err != nil || o != copied {
+				return o, err
+			}
+		}
+	}
+
+	var header http.Header
+	if m.previous != nil {
+		header = m.previous.conditional(bucketType, bucket, fileKey)
+	}
+	if m.mode == modeBackupStream {
+		// NDJSON records keep every value of keys with siblings.
+		header = header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set("Accept", "multipart/mixed, */*;q=0.9")
+	}
+	start := time.Now()
+	obj, err := m.source.GetObject(ctx, bucketType, bucket, key, header)
+	tp.get(time.Since(start))
+	m.latencies.record(bucketType, opSourceGet, time.Since(start))
+	if errors.Is(err, errNotModified) {
+		return unchanged, nil
+	}
+	if errors.Is(err, errNotFound) && !m.cfg.Strict {
+		return m.vanished(bucket, key), nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("get key: %w", err)
+	}
+	defer obj.Body.Close()
+	obj.Body = &countingReader{r: obj.Body, n: &tp.bytes}
+
+	if m.cfg.MaxObjectSize > 0 {
+		if obj.Size > m.cfg.MaxObjectSize {
+			return m.oversize(bucketType, bucket, key, obj.Size)
+		}
+		if obj.Size < 0 && m.mode == modeMigrate {
+			// Read it before the PUT, an aborted PUT could leave a
+			// truncated value behind.
+			buf, err := io.ReadAll(io.LimitReader(obj.Body, m.cfg.MaxObjectSize+1))
+			if err != nil {
+				return 0, fmt.Errorf("get key: %w", err)
+			}
+			if int64(len(buf)) > m.cfg.MaxObjectSize {
+				return m.oversize(bucketType, bucket, key, -1)
+			}
+			obj.Body, obj.Size = io.NopCloser(bytes.NewReader(buf)), int64(len(buf))
+		}
+		if obj.Size < 0 {
+			obj.Body = &limitedBody{ReadCloser: obj.Body, left: m.cfg.MaxObjectSize}
+			defer func() {
+				if errors.Is(err, errOversize) {
+					o, err = m.oversize(bucketType, bucket, key, -1)
+				}
+			}()
+		}
+	}
+
+	if m.matcher != nil {
+		ok, err := m.matchValue(obj)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return skippedUnmatched, nil
+		}
+	}
+	if m.cfg.ValidateJSON {
+		if o, err := m.validateJSON(bucketType, bucket, key, obj); err != nil || o != copied {
+			return o, err
+		}
+	}
+
+	switch m.mode {
+	case modeBackupDir:
+		o, entry, err := m.backupKey(bucketType, bucket, key, obj)
+		if err == nil && item.sample && item.job.backedUp != nil {
+			item.job.mu.Lock()
+			item.job.backedUp[key] = entry
+			item.job.mu.Unlock()
+		}
+		return o, err
+	case modeBackupStream:
+		o, err := m.writeRecord(bucketType, bucket, fileKey, obj)
+		if err == nil && m.resume != nil {
+			err = m.resume.add(bucketType, bucket, fileKey)
+		}
+		return o, err
+	}
+
+	if destHeader != nil && m.cfg.Overwrite == OverwriteIfNewer {
+		o, err := compareLastModified(obj.Header, destHeader)
+		if err != nil {
+			return 0, err
+		}
+		if o != copied {
+			return o, nil
+		}
+	}
+
+	if m.transformer != nil {
+		if o, err := m.transform(ctx, bucketType, bucket, key, obj); err != nil || o != copied {
+			return o, err
+		}
+	}
+
+	// The vclock of the source object is never sent, it is the history of
+	// another key, even within one cluster.
+	header = http.Header{"Content-Type": {"application/json"}}
+	if m.cfg.ConditionalPut {
+		header.Set("If-None-Match", "*")
+	}
+	start = time.Now()
+	err = m.destination.PutObject(ctx, m.destType(bucketType), m.destBucket(bucket), dstKey, m.putBody(obj.Body, header), header)
+	tp.put(time.Since(start))
+	m.latencies.record(bucketType, opDestPut, time.Since(start))
+	if m.throttle != nil {
+		m.throttle.observe(time.Since(start))
+	}
+	if errors.Is(err, errPreconditionFailed) {
+		return preconditionFailed, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return copied, nil
+}
+
+// errKeyLimit stops the listing of a bucket at MaxKeysPerBucket keys.
+var errKeyLimit = errors.New("key limit reached")
+
+// truncate records a bucket whose keys were cut at MaxKeysPerBucket.
+func (m *Migrator) truncate(bucketType, bucket string) {
+	m.truncatedMu.Lock()
+	m.truncated = append(m.truncated, bucketType+"/"+bucket)
+	m.truncatedMu.Unlock()
+}
+
+// vanished logs a listed key deleted from the source before it was
+// fetched, which key listings being eventually consistent allows.
+func (m *Migrator) vanished(bucket, key string) outcome {
+	m.log.Printf("WARN: key '%s' of bucket '%s' vanished from source after listing\n", key, bucket)
+	return skippedVanished
+}
+
+// compareLastModified decides whether the source copy of a key should
+// overwrite the destination one under the if-newer policy. Only a strictly
+// newer source copy is written; equal timestamps (Last-Modified has
+// one-second resolution) count as unchanged, so a destination written in
+// the same second as the source is never clobbered.
+func compareLastModified(src, dst http.Header) (outcome, error) {
+	srcTime, err := http.ParseTime(src.Get("Last-Modified"))
+	if err != nil {
+		return 0, fmt.Errorf("source last-modified: %w", err)
+	}
+	dstTime, err := http.ParseTime(dst.Get("Last-Modified"))
+	if err != nil {
+		return 0, fmt.Errorf("destination last-modified: %w", err)
+	}
+
+	switch {
+	case srcTime.After(dstTime):
+		return copied, nil
+	case srcTime.Equal(dstTime):
+		return unchanged, nil
+	default:
+		return skippedNewer, nil
+	}
+}
+
+// compareDelta decides whether the source copy of a key should overwrite
+// the destination one in a delta sync: copies with the same ETag were
+// written by the same write and are unchanged, otherwise Last-Modified
+// decides as for the if-newer policy.
+func compareDelta(src, dst http.Header) (outcome, error) {
+	if etag := src.Get("ETag"); etag != "" && etag == dst.Get("ETag") {
+		return unchanged, nil
+	}
+	return compareLastModified(src, dst)
+}
+
+// identical reports whether the headers of the source and destination
+// copies of a key show the same content: the same length, and the same
+// ETag or Content-MD5. Riak ETags only match for replicated writes and it
+// only returns a Content-MD5 stored as metadata, so copies without them
+// count as different.
+func identical(src, dst http.Header) bool {
+	if length := src.Get("Content-Length"); length == "" || length != dst.Get("Content-Length") {
+		return false
+	}
+	if etag := src.Get("ETag"); etag != "" && etag == dst.Get("ETag") {
+		return true
+	}
+	sum := src.Get("Content-MD5")
+	return sum != "" && sum == dst.Get("Content-MD5")
+}
+
+// escapeKey maps a listed key to the form used in backup file names and
+// records. URLs use escapePath instead.
+func escapeKey(key string) string {
+	return url.QueryEscape(key)
+}
+
+// unescapeKey reverses escapeKey for keys read from backups.
+func unescapeKey(key string) (string, error) {
+	return url.QueryUnescape(key)
+}
+
+func (m *Migrator) syncProperties(ctx context.Context, bucketType, bucket string) error {
+	props, err := m.source.GetProps(ctx, bucketType, bucket)
+	if errors.Is(err, errNotFound) {
+		m.log.Printf("WARN: bucket '%s' not found props", bucket)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get properties: %w", err)
+	}
+
+	bucketType = m.destType(bucketType)
+	err = m.destination.PutProps(ctx, bucketType, m.destBucket(bucket), props)
+	var se *statusError
+	if errors.As(err, &se) && se.code == 400 {
+		m.log.Printf("WARN: bucket '%s' props rejected by the destination, keeping its own%s: %s\n", bucket, m.untypedHint(bucketType), err)
+		return nil
+	}
+	return err
+}
+
+// untypedHint suggests UntypedDest for props of the destination bucket
+// type rejected.
+func (m *Migrator) untypedHint(bucketType string) string {
+	if bucketType == "default" && !m.cfg.UntypedDest {
+		return ", -destination-untyped-default may help"
+	}
+	return ""
+}
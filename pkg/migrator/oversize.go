@@ -0,0 +1,102 @@
+package migrator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// errOversize is a value found longer than MaxObjectSize while reading it.
+var errOversize = errors.New("object over max object size")
+
+// oversizeRecord is a line of the oversize report. Key is escaped like in
+// backups, Size is missing when the object had no Content-Length.
+type oversizeRecord struct {
+	BucketType string `json:"bucket_type"`
+	Bucket     string `json:"bucket"`
+	Key        string `json:"key"`
+	Size       *int64 `json:"size,omitempty"`
+}
+
+// keyReport writes an NDJSON report of keys of a run, like the oversize
+// report, creating the file at the first key. It is safe for concurrent
+// use.
+type keyReport struct {
+	name string
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func (r *keyReport) add(rec interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		file, err := os.Create(r.path)
+		if err != nil {
+			return fmt.Errorf("create %s: %w", r.name, err)
+		}
+		r.file, r.enc = file, json.NewEncoder(file)
+	}
+	return r.enc.Encode(rec)
+}
+
+func (r *keyReport) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// oversize skips an object over MaxObjectSize, or fails it with
+// FailOnOversize, and records it in the report. size is -1 when unknown.
+func (m *Migrator) oversize(bucketType, bucket, key string, size int64) (outcome, error) {
+	rec := oversizeRecord{BucketType: bucketType, Bucket: bucket, Key: escapeKey(key)}
+	desc := fmt.Sprintf("over %d bytes", m.cfg.MaxObjectSize)
+	if size >= 0 {
+		rec.Size = &size
+		desc = fmt.Sprintf("of %d bytes", size)
+	}
+	if m.oversizeReport != nil {
+		if err := m.oversizeReport.add(rec); err != nil {
+			return 0, err
+		}
+	}
+
+	if m.cfg.FailOnOversize {
+		return 0, fmt.Errorf("value %s: %w", desc, errOversize)
+	}
+	m.log.Printf("WARN: skip key '%s' of bucket '%s', its value is %s\n", key, bucket, desc)
+	return skippedOversize, nil
+}
+
+// limitedBody fails reads past limit bytes with errOversize, for values
+// without a Content-Length.
+type limitedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.left < 0 {
+		return 0, errOversize
+	}
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	if b.left < 0 {
+		return n, errOversize
+	}
+	return n, err
+}
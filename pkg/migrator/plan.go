@@ -0,0 +1,122 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PlannedBucket is a bucket a run deletes keys of, with the number of its
+// keys it would delete now.
+type PlannedBucket struct {
+	BucketType string `json:"bucket_type"`
+	Bucket     string `json:"bucket"`
+	Keys       int64  `json:"keys"`
+}
+
+// DeletionPlan is what Delete, or a restore with CleanDest, is about to
+// delete, for the operator to confirm.
+type DeletionPlan struct {
+	// Cluster is the URL of the cluster the keys are deleted from.
+	Cluster string
+	Buckets []PlannedBucket
+	// Keys sums the keys of Buckets.
+	Keys int64
+}
+
+// PlanDelete lists the buckets Delete empties on the source and counts
+// their keys.
+func (m *Migrator) PlanDelete(ctx context.Context) (DeletionPlan, error) {
+	plan := DeletionPlan{Cluster: m.cfg.Source}
+	types, err := m.bucketTypes(ctx)
+	if err != nil {
+		return plan, err
+	}
+	for _, bucketType := range types {
+		for _, bucket := range m.cfg.DeleteBuckets {
+			if err = m.planBucket(ctx, &plan, m.source, bucketType, bucket, ""); err != nil {
+				return plan, err
+			}
+		}
+	}
+	return plan, nil
+}
+
+// PlanClean lists the destination buckets a restore of the directory
+// backup in BackupDir empties with CleanDest, and counts their keys with
+// KeyPrefixAdd. The buckets of other backups are only known once read,
+// so their plan has none.
+func (m *Migrator) PlanClean(ctx context.Context) (DeletionPlan, error) {
+	plan := DeletionPlan{Cluster: m.cfg.Destination}
+	if m.cfg.BackupDir == "" {
+		return plan, nil
+	}
+	version, err := checkDirFormat(m.cfg.BackupDir)
+	if err != nil {
+		return plan, err
+	}
+
+	types, err := os.ReadDir(m.cfg.BackupDir)
+	if err != nil {
+		return plan, err
+	}
+	seen := make(map[string]bool)
+	for _, typeDir := range types {
+		if !typeDir.IsDir() {
+			continue
+		}
+		buckets, err := os.ReadDir(filepath.Join(m.cfg.BackupDir, typeDir.Name()))
+		if err != nil {
+			return plan, err
+		}
+		for _, bucketDir := range buckets {
+			if !bucketDir.IsDir() {
+				continue
+			}
+			bucketType, bucket := typeDir.Name(), bucketDir.Name()
+			if version >= 2 {
+				if bucketType, err = url.PathUnescape(bucketType); err != nil {
+					continue
+				}
+				if bucket, err = url.PathUnescape(bucket); err != nil {
+					continue
+				}
+			}
+			if len(m.cfg.RestoreTypes) > 0 && !contains(m.cfg.RestoreTypes, bucketType) ||
+				len(m.cfg.RestoreBuckets) > 0 && !contains(m.cfg.RestoreBuckets, bucket) {
+				continue
+			}
+			dstType, dstBucket := m.destType(bucketType), m.destBucket(bucket)
+			if seen[dstType+"/"+dstBucket] {
+				continue
+			}
+			seen[dstType+"/"+dstBucket] = true
+			if err = m.planBucket(ctx, &plan, m.destination, dstType, dstBucket, m.cfg.KeyPrefixAdd); err != nil {
+				return plan, err
+			}
+		}
+	}
+	return plan, nil
+}
+
+// planBucket adds a bucket of client to plan with the number of its keys
+// with prefix.
+func (m *Migrator) planBucket(ctx context.Context, plan *DeletionPlan, client riakClient, bucketType, bucket, prefix string) error {
+	var n int64
+	err := m.listKeys(ctx, client, bucketType, bucket, func(key string) error {
+		if strings.HasPrefix(key, prefix) {
+			n++
+		}
+		return nil
+	}, func() {})
+	if err != nil && !errors.Is(err, errNotFound) {
+		return fmt.Errorf("list keys of bucket %s: %w", bucket, err)
+	}
+	plan.Buckets = append(plan.Buckets, PlannedBucket{BucketType: bucketType, Bucket: bucket, Keys: n})
+	plan.Keys += n
+	return nil
+}
@@ -0,0 +1,175 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// workItem is a key handed to the worker pool.
+type workItem struct {
+	bucketType string
+	bucket     string
+	key        string
+	job        *bucketJob
+	// sample marks keys picked for verification after the sync, verify
+	// the verification of a key instead of its sync.
+	sample bool
+	verify bool
+	// restored is the backed up value of a key to verify on the
+	// destination after a restore, instead of syncing it.
+	restored *restoredValue
+}
+
+// bucketJob tracks the keys of a bucket in the worker pool.
+type bucketJob struct {
+	bucketType string
+	bucket     string
+	stats      counters
+	throughput throughput
+	// done counts the keys processed, failed ones included, listed the
+	// keys listed so far.
+	done    int64
+	listed  int64
+	pending sync.WaitGroup
+	// stop stops the dispatch of the remaining keys of the bucket.
+	stop context.CancelFunc
+
+	mu       sync.Mutex
+	failures multiError
+	// synced has the outcomes of the sample keys, backedUp the manifest
+	// entries of the ones written to a directory backup.
+	synced   map[string]outcome
+	backedUp map[string]manifestEntry
+	// span is the span of the bucket, nil when not tracing.
+	span *span
+	// sized sums the sizes of the values of the keys an estimate HEADed.
+	sized int64
+}
+
+func (j *bucketJob) fail(err error) {
+	j.mu.Lock()
+	j.failures = append(j.failures, err)
+	j.mu.Unlock()
+	j.stop()
+}
+
+func (j *bucketJob) err() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.failures) > 0 {
+		return j.failures
+	}
+	return nil
+}
+
+// startPool starts the cfg.Parallel workers shared by all buckets of a
+// run. The returned func closes the pool and waits for the workers.
+func (m *Migrator) startPool(ctx context.Context) func() {
+	m.limit = newLimiter(m.cfg.Parallel)
+	m.throttle = nil
+	if m.cfg.AutoParallel || m.cfg.LatencyThreshold > 0 {
+		m.throttle = newThrottle(m.log, m.limit, m.cfg.Parallel, m.cfg.LatencyThreshold, m.cfg.MaxErrorRate)
+	}
+	if m.cfg.AutoParallel && m.cfg.Parallel > autoParallelStart {
+		m.limit.set(autoParallelStart)
+	}
+
+	work := make(chan workItem)
+	var wg sync.WaitGroup
+	for i := 0; i < m.cfg.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.worker(ctx, work)
+		}()
+	}
+
+	m.work = work
+	return func() {
+		close(work)
+		wg.Wait()
+		m.work = nil
+	}
+}
+
+func (m *Migrator) worker(ctx context.Context, work <-chan workItem) {
+	for item := range work {
+		m.limit.acquire()
+		m.process(ctx, item)
+		m.limit.release()
+	}
+}
+
+// process syncs or verifies a key handed to the pool.
+func (m *Migrator) process(ctx context.Context, item workItem) {
+	defer item.job.pending.Done()
+	if item.verify {
+		m.verifyItem(ctx, item)
+		return
+	}
+	if item.restored != nil {
+		m.verifyRestoredItem(ctx, item)
+		return
+	}
+
+	ctx, requestID := m.keyRequest(ctx)
+	ctx, span := m.tracer.startKey(ctx, item.job.span, item.bucketType, item.bucket, item.key)
+	var o outcome
+	err := m.retry(ctx, func() (err error) {
+		o, err = m.syncKey(ctx, item)
+		return err
+	})
+	if err == nil {
+		span.setAttr(stringAttr("riak.outcome", outcomeNames[o]))
+	}
+	span.finish(err)
+	if err != nil {
+		item.job.fail(fmt.Errorf("sync key '%s' (request %s) err: %w", item.key, requestID, err))
+		m.recordFailure(item, err)
+		atomic.AddInt64(&m.failed, 1)
+		if m.throttle != nil {
+			m.throttle.fail()
+		}
+	} else {
+		item.job.stats.add(o)
+		m.totals.add(o)
+		if item.sample && item.job.synced != nil {
+			item.job.mu.Lock()
+			item.job.synced[item.key] = o
+			item.job.mu.Unlock()
+		}
+	}
+	atomic.AddInt64(&item.job.done, 1)
+	atomic.AddInt64(&m.progress.keys, 1)
+}
+
+// verifyItem compares a synced key between the clusters, or checks a
+// backed up one. Keys gone from or changed on the source meanwhile aren't
+// checked.
+func (m *Migrator) verifyItem(ctx context.Context, item workItem) {
+	ctx, requestID := m.keyRequest(ctx)
+	var (
+		problem string
+		err     error
+	)
+	if m.mode == modeBackupDir {
+		problem, err = m.checkBackedUp(ctx, item)
+	} else {
+		problem, err = m.compareKey(ctx, item.bucketType, item.bucket, item.key)
+	}
+	switch {
+	case errors.Is(err, errNotFound), errors.Is(err, errUnmatched), errors.Is(err, errChanged):
+	case err != nil:
+		item.job.fail(fmt.Errorf("verify key '%s' (request %s) err: %w", item.key, requestID, err))
+	case problem != "":
+		m.log.Printf("ERR: verified key '%s' of bucket '%s' %s\n", item.key, item.bucket, problem)
+		item.job.stats.add(mismatched)
+		m.totals.add(mismatched)
+	default:
+		item.job.stats.add(verified)
+		m.totals.add(verified)
+	}
+}
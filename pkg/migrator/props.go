@@ -0,0 +1,180 @@
+package migrator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// propsName is the file in a bucket dir recording the props of the bucket
+// at backup time. Restores don't read it.
+const propsName = "props.json"
+
+// bucketProps is the content of a props file: the props object of the
+// bucket, as the props endpoint returned it.
+type bucketProps struct {
+	FetchedAt time.Time       `json:"fetched_at"`
+	Props     json.RawMessage `json:"props"`
+}
+
+// backupProps writes the props of a bucket to the props file of its dir.
+func (m *Migrator) backupProps(ctx context.Context, bucketType, bucket, dir string) error {
+	var body []byte
+	err := m.retry(ctx, func() (err error) {
+		body, err = m.source.GetProps(ctx, bucketType, bucket)
+		return err
+	})
+	if errors.Is(err, errNotFound) {
+		m.log.Printf("WARN: bucket '%s' (%s) not found props, backed up without them\n", bucket, bucketType)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get properties: %w", err)
+	}
+
+	var res struct {
+		Props json.RawMessage `json:"props"`
+	}
+	if err = json.Unmarshal(body, &res); err != nil || len(res.Props) == 0 {
+		return fmt.Errorf("malformed properties of bucket '%s': %s", bucket, body)
+	}
+	b, err := json.Marshal(bucketProps{FetchedAt: time.Now().UTC(), Props: res.Props})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, propsName), append(b, '\n'), m.fsync)
+}
+
+// checkPropsFile checks that the props file of the bucket dir at dir
+// exists and holds a timestamp and a props object.
+func checkPropsFile(dir string) error {
+	b, err := os.ReadFile(filepath.Join(dir, propsName))
+	if err != nil {
+		return err
+	}
+	var props bucketProps
+	if err = json.Unmarshal(b, &props); err != nil {
+		return fmt.Errorf("decode %s: %w", propsName, err)
+	}
+	if props.FetchedAt.IsZero() {
+		return fmt.Errorf("%s has no fetched_at", propsName)
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(props.Props), []byte("{")) {
+		return fmt.Errorf("%s has no props object", propsName)
+	}
+	return nil
+}
+
+// bucketNameProps name the bucket rather than configure it, so they aren't
+// compared between the clusters.
+var bucketNameProps = []string{"name", "bucket_type"}
+
+// SyncProps copies the props of every bucket of the configured bucket
+// types from the source to the destination, without touching any key.
+// Props the destination bucket already has aren't written. The buckets
+// updated, already identical and failed are logged.
+func (m *Migrator) SyncProps(ctx context.Context) error {
+	types, err := m.bucketTypes(ctx)
+	if err != nil {
+		return err
+	}
+	if m.sameCluster() {
+		if err = m.checkSameCluster(types); err != nil {
+			return err
+		}
+	}
+
+	var (
+		updated, identical []string
+		failures           multiError
+	)
+	for _, bucketType := range types {
+		buckets := mappedBuckets(m.cfg.BucketMap)
+		if !m.sameCluster() {
+			if buckets, err = m.source.ListBuckets(ctx, bucketType); err != nil {
+				return fmt.Errorf("get list of bucket err: %w", err)
+			}
+		}
+		for _, bucket := range buckets {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+			name := fmt.Sprintf("'%s' (%s)", bucket, bucketType)
+			var changed bool
+			err := m.retry(ctx, func() (err error) {
+				changed, err = m.syncBucketProps(ctx, bucketType, bucket)
+				return err
+			})
+			switch {
+			case err != nil:
+				err = fmt.Errorf("bucket %s props: %w", name, err)
+				m.log.Printf("ERR: %s\n", err)
+				failures = append(failures, err)
+				if m.cfg.FailFast {
+					return failures
+				}
+			case changed:
+				m.log.Printf("INFO: bucket %s props updated\n", name)
+				updated = append(updated, name)
+			default:
+				identical = append(identical, name)
+			}
+		}
+	}
+
+	if len(identical) > 0 {
+		m.log.Printf("INFO: props already identical: %s\n", strings.Join(identical, ", "))
+	}
+	m.log.Printf("INFO: props: %d buckets updated, %d already identical, %d failed\n", len(updated), len(identical), len(failures))
+	if len(failures) > 0 {
+		return failures
+	}
+	return nil
+}
+
+// syncBucketProps writes the props of a source bucket to the destination
+// unless it has them already, and reports whether it wrote them.
+func (m *Migrator) syncBucketProps(ctx context.Context, bucketType, bucket string) (bool, error) {
+	props, err := m.source.GetProps(ctx, bucketType, bucket)
+	if err != nil {
+		return false, fmt.Errorf("get source properties: %w", err)
+	}
+	dstType, dstBucket := m.destType(bucketType), m.destBucket(bucket)
+	current, err := m.destination.GetProps(ctx, dstType, dstBucket)
+	if err != nil && !errors.Is(err, errNotFound) {
+		return false, fmt.Errorf("get destination properties: %w", err)
+	}
+	if err == nil && sameProps(props, current) {
+		return false, nil
+	}
+
+	err = m.destination.PutProps(ctx, dstType, dstBucket, props)
+	var se *statusError
+	if errors.As(err, &se) && se.code == 400 {
+		return false, fmt.Errorf("rejected by the destination%s: %w", m.untypedHint(dstType), err)
+	}
+	return err == nil, err
+}
+
+// sameProps reports whether two props responses configure a bucket the
+// same, whatever the order of their fields and the name of the bucket.
+func sameProps(a, b []byte) bool {
+	var pa, pb struct {
+		Props map[string]interface{} `json:"props"`
+	}
+	if json.Unmarshal(a, &pa) != nil || json.Unmarshal(b, &pb) != nil {
+		return false
+	}
+	for _, name := range bucketNameProps {
+		delete(pa.Props, name)
+		delete(pb.Props, name)
+	}
+	return pa.Props != nil && reflect.DeepEqual(pa.Props, pb.Props)
+}
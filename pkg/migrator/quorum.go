@@ -0,0 +1,68 @@
+package migrator
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// Quorum holds the Riak quorum parameters of key requests: R and PR are
+// sent with GETs from the source, W, DW and PW with PUTs to the
+// destination. Each is a number of replicas or one, quorum, all or
+// default; empty ones are left to the bucket props.
+type Quorum struct {
+	R, PR     string
+	W, DW, PW string
+}
+
+func (q Quorum) validate() error {
+	params := []struct{ name, value string }{
+		{"r", q.R}, {"pr", q.PR}, {"w", q.W}, {"dw", q.DW}, {"pw", q.PW},
+	}
+	for _, p := range params {
+		switch p.value {
+		case "", "one", "quorum", "all", "default":
+			continue
+		}
+		if n, err := strconv.Atoi(p.value); err != nil || n < 0 {
+			return fmt.Errorf("invalid %s '%s', want a number of replicas or one, quorum, all, default", p.name, p.value)
+		}
+	}
+
+	// Riak can't wait for more primaries or durable writes than replies.
+	if exceeds(q.PR, q.R) || exceeds(q.DW, q.W) || exceeds(q.PW, q.W) {
+		return fmt.Errorf("pr can't exceed r, nor dw or pw exceed w")
+	}
+	return nil
+}
+
+// atMost reports whether both values are numbers and a exceeds b.
+func exceeds(a, b string) bool {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	return errA == nil && errB == nil && x > y
+}
+
+// keyQueries returns the queries of key GETs from the source and PUTs to
+// the destination.
+func keyQueries(cfg Config) (get, put url.Values) {
+	var timeout string
+	if cfg.RiakTimeout > 0 {
+		timeout = strconv.FormatInt(cfg.RiakTimeout.Milliseconds(), 10)
+	}
+	get = query("r", cfg.Quorum.R, "pr", cfg.Quorum.PR, "timeout", timeout)
+	put = query("w", cfg.Quorum.W, "dw", cfg.Quorum.DW, "pw", cfg.Quorum.PW, "timeout", timeout,
+		"returnbody", strconv.FormatBool(cfg.ReturnBody))
+	return get, put
+}
+
+// query builds the query of name, value pairs, leaving out empty values.
+func query(pairs ...string) url.Values {
+	values := make(url.Values)
+	for i := 0; i < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			values.Set(pairs[i], pairs[i+1])
+		}
+	}
+	return values
+}
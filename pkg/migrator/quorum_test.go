@@ -0,0 +1,76 @@
+package migrator
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyQueries(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		cfg      Config
+		get, put string
+	}{
+		{"defaults", Config{}, "", "returnbody=false"},
+		{"return body", Config{ReturnBody: true}, "", "returnbody=true"},
+		{"timeout", Config{RiakTimeout: 90 * time.Second}, "timeout=90000", "returnbody=false&timeout=90000"},
+		{"read quorum", Config{Quorum: Quorum{R: "quorum", PR: "1"}}, "pr=1&r=quorum", "returnbody=false"},
+		{"write quorum", Config{Quorum: Quorum{W: "all", DW: "2", PW: "one"}}, "", "dw=2&pw=one&returnbody=false&w=all"},
+		{
+			"everything",
+			Config{Quorum: Quorum{R: "3", PR: "2", W: "3", DW: "default", PW: "2"}, RiakTimeout: 1500 * time.Millisecond, ReturnBody: true},
+			"pr=2&r=3&timeout=1500",
+			"dw=default&pw=2&returnbody=true&timeout=1500&w=3",
+		},
+	} {
+		get, put := keyQueries(tc.cfg)
+		if got := get.Encode(); got != tc.get {
+			t.Errorf("%s: GET query %q, want %q", tc.name, got, tc.get)
+		}
+		if got := put.Encode(); got != tc.put {
+			t.Errorf("%s: PUT query %q, want %q", tc.name, got, tc.put)
+		}
+	}
+}
+
+func TestKeyQueriesSent(t *testing.T) {
+	cfg := Config{Quorum: Quorum{R: "2", W: "quorum"}, RiakTimeout: 30 * time.Second}
+	source, destination := newFakeRiak(t), newFakeRiak(t)
+	source.put("default", "b1", "k1", "v1")
+	cfg.Source, cfg.Destination = source.URL, destination.URL
+	if err := newTestMigrator(t, cfg).Migrate(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if got, want := source.requested("GET"), "/types/default/buckets/b1/keys/k1?r=2&timeout=30000"; !contains(got, want) {
+		t.Errorf("GETs of the source %q, want %q", got, want)
+	}
+	want := []string{"/types/default/buckets/b1/keys/k1?returnbody=false&timeout=30000&w=quorum"}
+	if got := keyPuts(destination.requested("PUT")); !reflect.DeepEqual(got, want) {
+		t.Errorf("PUTs of keys to the destination %q, want %q", got, want)
+	}
+
+	// Restores PUT with the same query.
+	restored := newFakeRiak(t)
+	cfg.Source, cfg.Destination = restored.URL, restored.URL
+	backup := `{"bucket_type":"default","bucket":"b1","key":"k1","value":"djE="}` + "\n"
+	if err := newTestMigrator(t, cfg).Restore(context.Background(), strings.NewReader(backup)); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if got := keyPuts(restored.requested("PUT")); !reflect.DeepEqual(got, want) {
+		t.Errorf("PUTs of restored keys %q, want %q", got, want)
+	}
+}
+
+// keyPuts returns the requests of paths that are keys.
+func keyPuts(paths []string) []string {
+	var keys []string
+	for _, p := range paths {
+		if strings.Contains(p, "/keys/") {
+			keys = append(keys, p)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,248 @@
+package migrator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// record is a single key of an NDJSON backup stream. Everything after
+// Value is optional, records of older backups restore without it.
+type record struct {
+	BucketType string `json:"bucket_type"`
+	Bucket     string `json:"bucket"`
+	Key        string `json:"key"`
+	Format     int    `json:"format,omitempty"`
+	Value      []byte `json:"value"`
+	SHA256     string `json:"sha256,omitempty"`
+
+	ContentType string            `json:"content_type,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	// VClock is the base64 vector clock of the key on the source, sent
+	// back on restore so the restored value supersedes the one it was
+	// read from instead of becoming its sibling.
+	VClock string `json:"vclock,omitempty"`
+
+	// LastModified is informational only: Riak assigns it on every write,
+	// so a restored key can't keep it.
+	LastModified string `json:"last_modified,omitempty"`
+
+	// Siblings are the values of a key with siblings on the source, Value
+	// and its metadata fields are then empty. Since format 3.
+	Siblings []sibling `json:"siblings,omitempty"`
+}
+
+// sibling is one of the values of a key with siblings.
+type sibling struct {
+	Value        []byte            `json:"value"`
+	SHA256       string            `json:"sha256,omitempty"`
+	ContentType  string            `json:"content_type,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	VTag         string            `json:"vtag,omitempty"`
+	LastModified string            `json:"last_modified,omitempty"`
+}
+
+// resolve returns rec with the value and metadata of its last modified
+// sibling, the later one on ties and unparsable dates. The vclock is kept,
+// so writing it back resolves the siblings.
+func (rec record) resolve() record {
+	if len(rec.Siblings) == 0 {
+		return rec
+	}
+	var (
+		latest sibling
+		at     time.Time
+	)
+	for _, s := range rec.Siblings {
+		t, _ := http.ParseTime(s.LastModified)
+		if !t.Before(at) {
+			latest, at = s, t
+		}
+	}
+	rec.Value, rec.SHA256 = latest.Value, latest.SHA256
+	rec.ContentType, rec.Headers = latest.ContentType, latest.Headers
+	rec.LastModified = latest.LastModified
+	rec.Siblings = nil
+	return rec
+}
+
+// header returns the stored object metadata as restore PUT headers.
+func (rec record) header() http.Header {
+	contentType := rec.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	header := http.Header{"Content-Type": {contentType}}
+
+	for name, value := range rec.Headers {
+		header.Set(name, value)
+	}
+	if rec.VClock != "" {
+		header.Set("X-Riak-Vclock", rec.VClock)
+	}
+	return header
+}
+
+// metadataHeaders picks the user metadata, secondary indexes and links of
+// an object, which Riak accepts back on PUT.
+func metadataHeaders(h http.Header) map[string]string {
+	var kept map[string]string
+	for name, values := range h {
+		if !strings.HasPrefix(name, "X-Riak-Meta-") && !strings.HasPrefix(name, "X-Riak-Index-") && name != "Link" {
+			continue
+		}
+		if kept == nil {
+			kept = make(map[string]string)
+		}
+		kept[name] = strings.Join(values, ", ")
+	}
+	return kept
+}
+
+// recordWriter writes NDJSON records from concurrent key workers, keeping
+// each record and its newline in a single write so lines never interleave.
+// Once a write fails partway, leaving a partial line, every later write
+// fails too, as no record may follow it.
+type recordWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+func (rw *recordWriter) Write(rec record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.err != nil {
+		return rw.err
+	}
+	n, err := rw.w.Write(data)
+	return rw.failed(int64(n), err)
+}
+
+// WriteStream writes rec with the value read from value instead of
+// rec.Value, base64 encoding it on the fly as json.Marshal would. The line
+// is spilled to a temp file and copied to the output once complete, so a
+// value failing to read partway writes nothing a retry would duplicate.
+func (rw *recordWriter) WriteStream(rec record, value io.Reader) error {
+	rec.Value = nil
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	// Quotes inside strings are escaped, so the first match is the field.
+	null := []byte(`"value":null`)
+	i := bytes.Index(data, null)
+
+	tmp, err := os.CreateTemp("", "riak-migrator-record-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriter(tmp)
+	_, _ = w.Write(data[:i])
+	_, _ = w.WriteString(`"value":"`)
+	enc := base64.NewEncoder(base64.StdEncoding, w)
+	if _, err = io.Copy(enc, value); err != nil {
+		return err
+	}
+	if err = enc.Close(); err != nil {
+		return err
+	}
+	_ = w.WriteByte('"')
+	_, _ = w.Write(data[i+len(null):])
+	_ = w.WriteByte('\n')
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.err != nil {
+		return rw.err
+	}
+	if r, ok := rw.w.(interface{ reserve(n int64) error }); ok {
+		if err = r.reserve(size); err != nil {
+			return err
+		}
+	}
+	n, err := io.Copy(rw.w, tmp)
+	return rw.failed(n, err)
+}
+
+// failed returns err of a write of n bytes, keeping it for every later
+// write when it left a partial line behind.
+func (rw *recordWriter) failed(n int64, err error) error {
+	if err != nil && n > 0 {
+		rw.err = fmt.Errorf("output ends in a partial record: %w", err)
+		return rw.err
+	}
+	return err
+}
+
+// flush makes the records written so far durable in the output, which
+// an output with a flush or Flush method does, syncing them with s where
+// it would, and which a regular file is synced with s for.
+func (rw *recordWriter) flush(s *syncer) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	switch w := rw.w.(type) {
+	case interface{ flush() error }:
+		return w.flush()
+	case interface{ Flush() error }:
+		return w.Flush()
+	case *os.File:
+		if info, err := w.Stat(); err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		return s.file(w)
+	}
+	return nil
+}
+
+type LineIterator struct {
+	reader *bufio.Reader
+}
+
+func NewLineIterator(rd io.Reader) *LineIterator {
+	return &LineIterator{
+		reader: bufio.NewReader(rd),
+	}
+}
+
+func (ln *LineIterator) Next() ([]byte, error) {
+	var bytes []byte
+	for {
+		line, isPrefix, err := ln.reader.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		bytes = append(bytes, line...)
+		if !isPrefix {
+			break
+		}
+	}
+	return bytes, nil
+}
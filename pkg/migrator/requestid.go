@@ -0,0 +1,40 @@
+package migrator
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+)
+
+// requestIDCtxKey holds the X-Request-Id of the requests for a key.
+type requestIDCtxKey struct{}
+
+// newRunID returns a random ID of a run.
+func newRunID() string {
+	var id [8]byte
+	_, _ = crand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// RunID returns the ID of the Migrator, RunID or a random one, which the
+// X-Request-Id headers of its requests start with.
+func (m *Migrator) RunID() string {
+	return m.cfg.RunID
+}
+
+// keyRequest returns ctx with a new request ID for the requests of a key,
+// and the ID, for errors to name it.
+func (m *Migrator) keyRequest(ctx context.Context) (context.Context, string) {
+	id := fmt.Sprintf("%s-%d", m.cfg.RunID, atomic.AddInt64(&m.requests, 1))
+	return context.WithValue(ctx, requestIDCtxKey{}, id), id
+}
+
+// requestID returns the request ID of ctx, or else runID.
+func requestID(ctx context.Context, runID string) string {
+	if id, ok := ctx.Value(requestIDCtxKey{}).(string); ok {
+		return id
+	}
+	return runID
+}
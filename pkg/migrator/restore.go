@@ -0,0 +1,541 @@
+package migrator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RestoreDir writes every key file of the directory backup in BackupDir
+// to the destination on Parallel workers. Files that don't match the size
+// and checksum of their manifest entry aren't restored, unless
+// IgnoreManifest is set.
+func (m *Migrator) RestoreDir(ctx context.Context) error {
+	version, err := checkDirFormat(m.cfg.BackupDir)
+	if err != nil {
+		return err
+	}
+	var manifest map[string]manifestEntry
+	if !m.cfg.IgnoreManifest {
+		manifest, err = readManifest(m.cfg.BackupDir)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			return fmt.Errorf("read manifest: %w", err)
+		default:
+			m.log.Printf("INFO: checking the backup files against the %d entries of the manifest\n", len(manifest))
+		}
+	}
+	if err = m.checkCompression(ctx); err != nil {
+		return err
+	}
+	m.setPhase(phaseRestoring)
+
+	total := -1
+	if m.cfg.RestoreCount {
+		n, err := countFiles(m.cfg.BackupDir)
+		if err != nil {
+			return fmt.Errorf("count backup files: %w", err)
+		}
+		total = n
+	}
+
+	tick := time.NewTicker(time.Second * 5)
+	defer tick.Stop()
+
+	// The long keys of the bucket dir being walked.
+	var (
+		longKeysDir string
+		longKeys    map[string]string
+	)
+
+	var (
+		stats             counters
+		attempted, failed int
+		dry               *dryRun
+		// corrupt has the files not matching the manifest.
+		corrupt []string
+	)
+	if m.cfg.DryRun {
+		dry = newDryRun()
+	}
+
+	var (
+		mu          sync.Mutex
+		failure     error
+		failureOnce sync.Once
+	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pool := m.startRestorePool(ctx)
+	err = filepath.WalkDir(m.cfg.BackupDir, func(path string, file fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if file.IsDir() || !isKeyFile(file.Name()) {
+			return nil
+		}
+
+		select {
+		case <-tick.C:
+			if total >= 0 {
+				m.log.Printf("INFO: restore progress: %d/%d files\n", attempted, total)
+			} else {
+				m.log.Printf("INFO: restore progress: %d files\n", attempted)
+			}
+		default:
+		}
+
+		rel, err := filepath.Rel(m.cfg.BackupDir, path)
+		if err != nil {
+			return err
+		}
+		bucketType, bucket, key, err := parseBackupPath(rel, version)
+		if err != nil {
+			if dry != nil {
+				dry.invalid(rel, err)
+				return nil
+			}
+			m.log.Printf("WARN: skip '%s': %s\n", rel, err)
+			return nil
+		}
+
+		if isHashedFileName(key) {
+			if dir := filepath.Dir(path); dir != longKeysDir {
+				if longKeys, err = readLongKeys(dir); err != nil {
+					return err
+				}
+				longKeysDir = dir
+			}
+			name := key
+			if key = longKeys[name]; key == "" {
+				if dry != nil {
+					dry.invalid(rel, fmt.Errorf("key missing from %s", longKeysName))
+					return nil
+				}
+				m.log.Printf("WARN: skip '%s', its key is missing from %s\n", rel, longKeysName)
+				return nil
+			}
+		}
+
+		attempted++
+		atomic.AddInt64(&m.progress.keys, 1)
+		if !m.restoreFilter(bucketType, bucket, key) {
+			stats.add(skippedFiltered)
+			return nil
+		}
+		if err = m.cleanDestination(ctx, bucketType, bucket); err != nil {
+			return fmt.Errorf("clean destination: %w", err)
+		}
+		var expected *manifestEntry
+		if entry, ok := manifest[rel]; ok {
+			expected = &entry
+		}
+		if dry != nil {
+			info, err := file.Info()
+			if err != nil {
+				return err
+			}
+			if expected != nil {
+				if size, sum, err := fileChecksum(path); err != nil || size != expected.Size || sum != expected.SHA256 {
+					dry.invalid(rel, errCorruptFile)
+					return nil
+				}
+			}
+			dry.check(rel, bucketType, bucket, key, info.Size())
+			return nil
+		}
+		task := &restoreTask{kv: record{BucketType: bucketType, Bucket: bucket, Key: key}, path: path, expected: expected}
+		task.done = func(o outcome, err error) {
+			if err == nil {
+				stats.add(o)
+				return
+			}
+			mu.Lock()
+			if errors.Is(err, errCorruptFile) {
+				corrupt = append(corrupt, rel)
+			}
+			failed++
+			mu.Unlock()
+			atomic.AddInt64(&m.failed, 1)
+			m.log.Printf("ERR: restore '%s': %s\n", rel, err)
+			if m.cfg.FailFast {
+				failureOnce.Do(func() {
+					failure = fmt.Errorf("restore '%s': %w", rel, err)
+					cancel()
+				})
+			}
+		}
+		return pool.add(ctx, task)
+	})
+	pool.wait()
+	if failure != nil {
+		err = failure
+	}
+	m.log.Printf("INFO: restore: attempted %d files, failed %d (%s)\n", attempted, failed, &stats)
+	m.totals.merge(&stats)
+	m.logRetries()
+	m.logTransfer()
+	m.logLatencies()
+	if len(corrupt) > 0 {
+		m.log.Printf("ERR: %d files don't match the manifest and weren't restored: %s\n", len(corrupt), strings.Join(corrupt, ", "))
+	}
+	if err != nil {
+		return err
+	}
+	if dry != nil {
+		return m.reportDryRun(dry)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed: %w", failed, attempted, ErrKeysFailed)
+	}
+	return nil
+}
+
+// errCorruptFile is a backup file whose size or checksum doesn't match
+// its manifest entry.
+var errCorruptFile = errors.New("doesn't match the manifest")
+
+// countFiles counts the key files of a directory backup.
+func countFiles(dir string) (int, error) {
+	n := 0
+	err := filepath.WalkDir(dir, func(path string, file fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !file.IsDir() && isKeyFile(file.Name()) {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// restoreFile writes the key file at path of a directory backup to the
+// destination, unless it doesn't match expected when set. key is escaped.
+// The file is streamed into the PUT rather than read into memory, so it is
+// read twice when checked against expected.
+func (m *Migrator) restoreFile(ctx context.Context, path, bucketType, bucket, key string, expected *manifestEntry) (outcome, error) {
+	if expected != nil {
+		size, sum, err := fileChecksum(path)
+		if err != nil {
+			return 0, err
+		}
+		if size != expected.Size || sum != expected.SHA256 {
+			return 0, fmt.Errorf("%w: size %d sha256 %s, manifest size %d sha256 %s",
+				errCorruptFile, size, sum, expected.Size, expected.SHA256)
+		}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	// Every attempt reads the file from the start through its own reader,
+	// the encoding of a failed compressed PUT may still be reading.
+	value := func() io.Reader {
+		return io.NewSectionReader(file, 0, info.Size())
+	}
+	return m.restoreValue(ctx, record{BucketType: bucketType, Bucket: bucket, Key: key}, value)
+}
+
+// Restore writes every record of an NDJSON backup read from r to the
+// destination on Parallel workers.
+func (m *Migrator) Restore(ctx context.Context, r io.Reader) error {
+	if err := m.checkCompression(ctx); err != nil {
+		return err
+	}
+	m.setPhase(phaseRestoring)
+
+	var (
+		stats   counters
+		records int
+		dry     *dryRun
+	)
+	if m.cfg.DryRun {
+		dry = newDryRun()
+	}
+	defer func() {
+		m.log.Printf("INFO: restore: %d records (%s)\n", records, &stats)
+		m.totals.merge(&stats)
+		m.logRetries()
+		m.logTransfer()
+		m.logLatencies()
+	}()
+
+	var (
+		failure     error
+		failureOnce sync.Once
+	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pool := m.startRestorePool(ctx)
+	err := func() error {
+		lines := NewLineIterator(r)
+		for n := 1; ; n++ {
+			line, err := lines.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("read backup: %w", err)
+			}
+
+			var kv record
+			err = json.Unmarshal(line, &kv)
+			if err == nil {
+				err = checkFormat(kv.Format)
+			}
+			if err != nil {
+				if dry != nil {
+					dry.invalid(fmt.Sprintf("line %d", n), err)
+					continue
+				}
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+
+			records++
+			atomic.AddInt64(&m.progress.keys, 1)
+			if !m.restoreFilter(kv.BucketType, kv.Bucket, kv.Key) {
+				stats.add(skippedFiltered)
+				continue
+			}
+			if err = m.cleanDestination(ctx, kv.BucketType, kv.Bucket); err != nil {
+				return fmt.Errorf("clean destination: %w", err)
+			}
+			if dry != nil {
+				dry.check(fmt.Sprintf("line %d", n), kv.BucketType, kv.Bucket, kv.Key, int64(len(kv.resolve().Value)))
+				continue
+			}
+			n := n
+			task := &restoreTask{kv: kv, done: func(o outcome, err error) {
+				if err == nil {
+					stats.add(o)
+					return
+				}
+				atomic.AddInt64(&m.failed, 1)
+				failureOnce.Do(func() {
+					failure = fmt.Errorf("line %d: %w", n, err)
+					cancel()
+				})
+			}}
+			if err = pool.add(ctx, task); err != nil {
+				return err
+			}
+		}
+	}()
+	pool.wait()
+	if failure != nil {
+		return failure
+	}
+	if err != nil {
+		return err
+	}
+	if dry != nil {
+		return m.reportDryRun(dry)
+	}
+	return nil
+}
+
+// restoreFilter reports whether the restore filters keep a backed up key.
+// key is escaped.
+func (m *Migrator) restoreFilter(bucketType, bucket, key string) bool {
+	if len(m.cfg.RestoreTypes) > 0 && !contains(m.cfg.RestoreTypes, bucketType) {
+		return false
+	}
+	if len(m.cfg.RestoreBuckets) > 0 && !contains(m.cfg.RestoreBuckets, bucket) {
+		return false
+	}
+	if m.cfg.RestoreKeyPrefix != "" {
+		raw, err := unescapeKey(key)
+		// A malformed key is left to restoreRecord to report.
+		return err != nil || strings.HasPrefix(raw, m.cfg.RestoreKeyPrefix)
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreRecord writes a backed up key to the destination, unless the key
+// prefix options skip it.
+func (m *Migrator) restoreRecord(ctx context.Context, kv record) (outcome, error) {
+	return m.restoreValue(ctx, kv, nil)
+}
+
+// restoreValue is restoreRecord for a value read from the reader value
+// returns for each attempt, kv.Value when nil.
+func (m *Migrator) restoreValue(ctx context.Context, kv record, value func() io.Reader) (outcome, error) {
+	key, err := unescapeKey(kv.Key)
+	if err != nil {
+		return 0, fmt.Errorf("unescape key: %w", err)
+	}
+	dstKey, ok := m.destKey(key)
+	if !ok {
+		return skippedUnprefixed, nil
+	}
+	ctx = m.trace(ctx, kv.BucketType, kv.Bucket, key)
+	ctx, requestID := m.keyRequest(ctx)
+	if len(kv.Siblings) > 0 {
+		if m.cfg.FailOnSiblings {
+			return 0, fmt.Errorf("key '%s' of bucket '%s' has %d siblings", kv.Key, kv.Bucket, len(kv.Siblings))
+		}
+		m.log.Printf("WARN: key '%s' of bucket '%s' has %d siblings, restoring the last modified one\n", kv.Key, kv.Bucket, len(kv.Siblings))
+		kv = kv.resolve()
+	}
+	if value == nil {
+		value = func() io.Reader {
+			return bytes.NewReader(kv.Value)
+		}
+	}
+	dstType, dstBucket := m.destType(kv.BucketType), m.destBucket(kv.Bucket)
+	if m.cfg.IgnoreVClocks || dstType != kv.BucketType || dstBucket != kv.Bucket || dstKey != key {
+		// The stored vclock is the history of the backed up key only.
+		kv.VClock = ""
+	}
+	err = m.retry(ctx, func() error {
+		if m.cfg.RestoreVClock {
+			start := time.Now()
+			current, err := m.destination.HeadObject(ctx, dstType, dstBucket, dstKey)
+			m.latencies.record(kv.BucketType, opDestHead, time.Since(start))
+			switch {
+			case errors.Is(err, errNotFound):
+				kv.VClock = ""
+			case err != nil:
+				return fmt.Errorf("head destination: %w", err)
+			default:
+				kv.VClock = current.Get("X-Riak-Vclock")
+			}
+		}
+		header := kv.header()
+		body := m.putBody(value(), header)
+		start := time.Now()
+		err := m.destination.PutObject(ctx, dstType, dstBucket, dstKey, body, header)
+		m.latencies.record(kv.BucketType, opDestPut, time.Since(start))
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("request %s: %w", requestID, err)
+	}
+	return copied, nil
+}
+
+// restorePool writes the records and key files of a restore to the
+// destination on Parallel workers. The writes of a destination key are
+// done one at a time in backup order, so a key backed up twice ends as its
+// last record and RestoreVClock reads the vclock of the write before
+// rather than racing it into siblings.
+type restorePool struct {
+	m     *Migrator
+	tasks chan *restoreTask
+	wg    sync.WaitGroup
+
+	mu sync.Mutex
+	// writing has the keys being written, closed once written.
+	writing map[string]chan struct{}
+}
+
+// restoreTask is a record, or the key file at path, to restore, and the
+// func called with the outcome.
+type restoreTask struct {
+	kv       record
+	path     string
+	expected *manifestEntry
+	done     func(o outcome, err error)
+
+	name    string
+	written chan struct{}
+}
+
+func (m *Migrator) startRestorePool(ctx context.Context) *restorePool {
+	p := &restorePool{
+		m:       m,
+		tasks:   make(chan *restoreTask),
+		writing: make(map[string]chan struct{}),
+	}
+	for i := 0; i < m.cfg.Parallel; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for task := range p.tasks {
+				var (
+					o   outcome
+					err error
+				)
+				if task.path != "" {
+					o, err = m.restoreFile(ctx, task.path, task.kv.BucketType, task.kv.Bucket, task.kv.Key, task.expected)
+				} else {
+					o, err = m.restoreRecord(ctx, task.kv)
+				}
+				p.release(task)
+				task.done(o, err)
+			}
+		}()
+	}
+	return p
+}
+
+// add hands task to the workers once the previous write of its
+// destination key is done.
+func (p *restorePool) add(ctx context.Context, task *restoreTask) error {
+	task.name = p.m.destType(task.kv.BucketType) + "/" + p.m.destBucket(task.kv.Bucket) + "/" + task.kv.Key
+	p.mu.Lock()
+	previous := p.writing[task.name]
+	p.mu.Unlock()
+	if previous != nil {
+		select {
+		case <-previous:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	task.written = make(chan struct{})
+	p.mu.Lock()
+	p.writing[task.name] = task.written
+	p.mu.Unlock()
+	select {
+	case p.tasks <- task:
+		return nil
+	case <-ctx.Done():
+		p.release(task)
+		return ctx.Err()
+	}
+}
+
+// release marks the key of task written.
+func (p *restorePool) release(task *restoreTask) {
+	p.mu.Lock()
+	delete(p.writing, task.name)
+	p.mu.Unlock()
+	close(task.written)
+}
+
+// wait waits for the workers to finish the tasks added.
+func (p *restorePool) wait() {
+	close(p.tasks)
+	p.wg.Wait()
+}
@@ -0,0 +1,210 @@
+package migrator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// roundTripKeys are the keys the backup and restore tests store on the
+// source: key, value and headers.
+var roundTripKeys = []struct {
+	bucket, key, value string
+	header             []string
+}{
+	{"b1", "k1", "hello", []string{
+		"X-Riak-Meta-Owner", "alice",
+		"X-Riak-Index-Email_bin", "alice@example.com",
+		"Link", `</buckets/b2/keys/k3>; riaktag="next"`,
+	}},
+	{"b1", "a/b c+d", "\x00\x01\xfe\xff", []string{"Content-Type", "application/octet-stream"}},
+	{"b1", "данные", "{}", []string{"Content-Type", "application/json", "X-Riak-Index-Age_int", "42"}},
+	{"b2", "k3", "", nil},
+}
+
+func newRoundTripSource(t *testing.T) *fakeRiak {
+	source := newFakeRiak(t)
+	for _, k := range roundTripKeys {
+		source.put("default", k.bucket, k.key, k.value, k.header...)
+	}
+	return source
+}
+
+func TestBackupRestoreRoundTrip(t *testing.T) {
+	source := newRoundTripSource(t)
+	var backup bytes.Buffer
+	m := newTestMigrator(t, Config{Source: source.URL, Destination: source.URL})
+	if err := m.Backup(context.Background(), &backup); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+
+	destination := newFakeRiak(t)
+	m = newTestMigrator(t, Config{Source: destination.URL, Destination: destination.URL})
+	if err := m.Restore(context.Background(), &backup); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+
+	for _, k := range roundTripKeys {
+		want, got := source.get("default", k.bucket, k.key), destination.get("default", k.bucket, k.key)
+		if got == nil {
+			t.Errorf("%s/%s not restored", k.bucket, k.key)
+			continue
+		}
+		if !bytes.Equal(got.value, want.value) {
+			t.Errorf("%s/%s restored as %q, want %q", k.bucket, k.key, got.value, want.value)
+		}
+		if !reflect.DeepEqual(got.header, want.header) {
+			t.Errorf("%s/%s restored with %v, want %v", k.bucket, k.key, got.header, want.header)
+		}
+	}
+}
+
+func TestBackupDirRestoreDirRoundTrip(t *testing.T) {
+	source := newRoundTripSource(t)
+	dir := filepath.Join(t.TempDir(), "backup")
+	m := newTestMigrator(t, Config{Source: source.URL, Destination: source.URL, BackupDir: dir})
+	if err := m.BackupDir(context.Background()); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+
+	destination := newFakeRiak(t)
+	m = newTestMigrator(t, Config{Source: destination.URL, Destination: destination.URL, BackupDir: dir})
+	if err := m.RestoreDir(context.Background()); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+
+	// Directory backups keep the values only, restored as JSON.
+	for _, k := range roundTripKeys {
+		got := destination.get("default", k.bucket, k.key)
+		if got == nil {
+			t.Errorf("%s/%s not restored", k.bucket, k.key)
+			continue
+		}
+		if string(got.value) != k.value {
+			t.Errorf("%s/%s restored as %q, want %q", k.bucket, k.key, got.value, k.value)
+		}
+		if want := (http.Header{"Content-Type": {"application/json"}}); !reflect.DeepEqual(got.header, want) {
+			t.Errorf("%s/%s restored with %v, want %v", k.bucket, k.key, got.header, want)
+		}
+	}
+}
+
+func TestRestoreDirStreamsValues(t *testing.T) {
+	if testing.Short() {
+		t.Skip("restores a value of several hundred MB")
+	}
+	const size = 384 << 20
+	dir := t.TempDir()
+	if err := writeDirFormat(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	bucketDir := filepath.Join(dir, "default", "b1")
+	if err := os.MkdirAll(bucketDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// A sparse file, which takes no disk space.
+	f, err := os.Create(filepath.Join(bucketDir, "big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Truncate(size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destination := newFakeRiak(t)
+	destination.discard = true
+	m := newTestMigrator(t, Config{Source: destination.URL, Destination: destination.URL, BackupDir: dir})
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	if err = m.RestoreDir(context.Background()); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	runtime.ReadMemStats(&after)
+
+	if obj := destination.get("default", "b1", "big"); obj == nil || obj.size != size {
+		t.Fatalf("restored %+v, want %d bytes", obj, size)
+	}
+	// The client and the fake server together, far below the value.
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/8 {
+		t.Errorf("allocated %d MB restoring a value of %d MB", allocated>>20, size>>20)
+	}
+}
+
+func TestRestoreVClockNoSiblings(t *testing.T) {
+	source := newFakeRiak(t)
+	for i := 0; i < 20; i++ {
+		source.put("default", "b1", fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+	}
+	var backup bytes.Buffer
+	m := newTestMigrator(t, Config{Source: source.URL, Destination: source.URL})
+	if err := m.Backup(context.Background(), &backup); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	dir := filepath.Join(t.TempDir(), "backup")
+	m = newTestMigrator(t, Config{Source: source.URL, Destination: source.URL, BackupDir: dir})
+	if err := m.BackupDir(context.Background()); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		restore func(m *Migrator) error
+	}{
+		// Every key is in the backup three times in a row.
+		{"ndjson", func(m *Migrator) error {
+			var repeated bytes.Buffer
+			for _, line := range bytes.SplitAfter(backup.Bytes(), []byte("\n")) {
+				repeated.Write(bytes.Repeat(line, 3))
+			}
+			return m.Restore(context.Background(), &repeated)
+		}},
+		{"dir", func(m *Migrator) error {
+			return m.RestoreDir(context.Background())
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			destination := newFakeRiak(t)
+			destination.allowMult = true
+			// Slow HEADs, for restores of a key at once to read the same vclock.
+			handler := destination.Config.Handler
+			destination.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodHead {
+					time.Sleep(10 * time.Millisecond)
+				}
+				handler.ServeHTTP(w, r)
+			})
+			for i := 0; i < 20; i += 2 {
+				destination.put("default", "b1", fmt.Sprintf("k%d", i), "old")
+			}
+			m := newTestMigrator(t, Config{
+				Source:        destination.URL,
+				Destination:   destination.URL,
+				BackupDir:     dir,
+				Parallel:      8,
+				RestoreVClock: true,
+			})
+			if err := tc.restore(m); err != nil {
+				t.Fatalf("restore: %v", err)
+			}
+			for i := 0; i < 20; i++ {
+				key := fmt.Sprintf("k%d", i)
+				got := destination.get("default", "b1", key)
+				if got == nil || string(got.value) != fmt.Sprintf("v%d", i) || got.siblings != 0 {
+					t.Errorf("%s restored as %+v, want v%d without siblings", key, got, i)
+				}
+			}
+		})
+	}
+}
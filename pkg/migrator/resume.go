@@ -0,0 +1,155 @@
+package migrator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+)
+
+// resumeBatch is the number of keys added to a resume index between
+// flushes of its file.
+const resumeBatch = 1000
+
+// keyHash is a 128 bit hash of a key, which resume indexes hold in memory
+// instead of the keys.
+type keyHash [16]byte
+
+func hashKey(bucketType, bucket, key string) keyHash {
+	h := fnv.New128a()
+	for _, s := range []string{bucketType, bucket, key} {
+		_, _ = h.Write([]byte(s))
+		_, _ = h.Write([]byte{0})
+	}
+	var sum keyHash
+	h.Sum(sum[:0])
+	return sum
+}
+
+// resumeIndex records the keys a stream backup wrote in a key listing
+// file, see ResumeIndex. The keys of previous runs are looked up in
+// memory, by their sorted hashes.
+type resumeIndex struct {
+	done []keyHash
+
+	mu      sync.Mutex
+	file    *os.File
+	out     bytes.Buffer
+	enc     *json.Encoder
+	pending int
+	// flushOutput, when set, makes the records of the keys added durable
+	// in the backup before the file records them, so a crash never leaves
+	// a key in the index whose record the backup lost.
+	flushOutput func() error
+}
+
+// openResumeIndex loads the keys recorded at path by previous runs and
+// opens it to record more, creating it if missing. A line cut short by a
+// crash is ignored.
+func openResumeIndex(path string) (*resumeIndex, error) {
+	idx := &resumeIndex{}
+	f, err := os.Open(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		lines := NewLineIterator(bufio.NewReader(f))
+		for {
+			line, err := lines.Next()
+			if err != nil {
+				break
+			}
+			var rec keyRecord
+			if json.Unmarshal(line, &rec) != nil {
+				continue
+			}
+			idx.done = append(idx.done, hashKey(rec.BucketType, rec.Bucket, rec.Key))
+		}
+		_ = f.Close()
+	}
+	sort.Slice(idx.done, func(i, j int) bool { return lessHash(idx.done[i], idx.done[j]) })
+
+	if idx.file, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644); err != nil {
+		return nil, err
+	}
+	// A line cut short by a crash must not swallow the next one.
+	if info, err := idx.file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err = idx.file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			_, err = idx.file.WriteString("\n")
+		}
+		if err != nil {
+			_ = idx.file.Close()
+			return nil, err
+		}
+	}
+	idx.enc = json.NewEncoder(&idx.out)
+	return idx, nil
+}
+
+func lessHash(a, b keyHash) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// has reports whether a previous run recorded the key. key is escaped.
+func (idx *resumeIndex) has(bucketType, bucket, key string) bool {
+	h := hashKey(bucketType, bucket, key)
+	i := sort.Search(len(idx.done), func(i int) bool { return !lessHash(idx.done[i], h) })
+	return i < len(idx.done) && idx.done[i] == h
+}
+
+// add records a key written to the backup. The file is written in batches
+// of resumeBatch keys, so the keys of a crashed run since the last batch
+// are backed up again. key is escaped.
+func (idx *resumeIndex) add(bucketType, bucket, key string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if err := idx.enc.Encode(keyRecord{BucketType: bucketType, Bucket: bucket, Key: key}); err != nil {
+		return err
+	}
+	if idx.pending++; idx.pending < resumeBatch {
+		return nil
+	}
+	idx.pending = 0
+	return idx.flush()
+}
+
+// flush writes the keys added to the file, after their records to the
+// backup. They are held in out until then, a bufio.Writer would write
+// them whenever its buffer fills.
+func (idx *resumeIndex) flush() error {
+	if idx.flushOutput != nil {
+		if err := idx.flushOutput(); err != nil {
+			return fmt.Errorf("flush backup: %w", err)
+		}
+	}
+	_, err := idx.out.WriteTo(idx.file)
+	return err
+}
+
+// Close writes the keys left and closes the file, syncing it with s.
+func (idx *resumeIndex) Close(s *syncer) error {
+	err := idx.flush()
+	if syncErr := s.file(idx.file); err == nil {
+		err = syncErr
+	}
+	if closeErr := idx.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("resume index: %w", err)
+	}
+	return nil
+}
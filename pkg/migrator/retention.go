@@ -0,0 +1,122 @@
+package migrator
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// timestampFormat names timestamped backup dirs by the UTC start time
+	// of their run, so they sort by age.
+	timestampFormat = "20060102T150405Z"
+	// completeName marks a timestamped backup finished successfully.
+	completeName = ".migrator-complete"
+	// latestName is the symlink to the latest complete timestamped backup.
+	latestName = "latest"
+)
+
+// TimestampedDir returns the dir under root of a timestamped backup
+// started at start.
+func TimestampedDir(root string, start time.Time) string {
+	return filepath.Join(root, start.UTC().Format(timestampFormat))
+}
+
+// CompleteBackup marks the timestamped backup in BackupDir complete and
+// points the latest symlink of its root at it.
+func (m *Migrator) CompleteBackup() error {
+	dir := m.cfg.BackupDir
+	if err := writeFileAtomic(filepath.Join(dir, completeName), []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), m.fsync); err != nil {
+		return err
+	}
+
+	// Replaced by a rename, so latest always points at a backup.
+	root := filepath.Dir(dir)
+	tmp := filepath.Join(root, "."+latestName+".tmp")
+	_ = os.Remove(tmp)
+	if err := os.Symlink(filepath.Base(dir), tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(root, latestName))
+}
+
+// PruneBackups removes the timestamped backups under root older than the
+// keep latest complete ones. Incomplete backups, which may be failed runs
+// or running ones, are only removed with incomplete, and never while
+// locked.
+func (m *Migrator) PruneBackups(root string, keep int, incomplete bool) error {
+	names, err := timestampedDirs(root)
+	if err != nil {
+		return err
+	}
+
+	kept := 0
+	for _, name := range names {
+		dir := filepath.Join(root, name)
+		complete := exists(filepath.Join(dir, completeName))
+		switch {
+		case complete && kept < keep:
+			kept++
+			continue
+		case kept < keep:
+			// Newer than the oldest backup kept.
+			continue
+		case !complete && !incomplete:
+			m.log.Printf("WARN: keep incomplete backup %s, prune it with -prune-incomplete\n", dir)
+			continue
+		case !complete && exists(filepath.Join(dir, lockName)):
+			m.log.Printf("WARN: keep locked backup %s\n", dir)
+			continue
+		}
+
+		m.log.Printf("INFO: prune backup %s\n", dir)
+		if err = os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("prune %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// LatestBackup returns the dir of the newest complete timestamped backup
+// under root.
+func LatestBackup(root string) (string, error) {
+	names, err := timestampedDirs(root)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		if dir := filepath.Join(root, name); exists(filepath.Join(dir, completeName)) {
+			return dir, nil
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("no timestamped backups in %s", root)
+	}
+	return "", fmt.Errorf("no complete backup in %s, only incomplete ones: %s", root, strings.Join(names, ", "))
+}
+
+// timestampedDirs returns the names of the timestamped backups under
+// root, newest first.
+func timestampedDirs(root string) ([]string, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if _, err := time.Parse(timestampFormat, entry.Name()); err == nil && entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names, nil
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return !errors.Is(err, os.ErrNotExist)
+}
@@ -0,0 +1,70 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// retryDelay is the wait before the first retry, doubled for each
+// following one.
+const retryDelay = 100 * time.Millisecond
+
+// retryStats counts the retried operations of a run and the ones that then
+// succeeded. It is safe for concurrent use.
+type retryStats struct {
+	retried   int64
+	recovered int64
+}
+
+// retry calls fn until it succeeds, fails with an error that isn't
+// retryable, or was retried cfg.Retries times. GETs are idempotent and
+// PUTs last-write-wins, so a request that may or may not have reached
+// Riak can be sent again.
+func (m *Migrator) retry(ctx context.Context, fn func() error) error {
+	delay := retryDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			if attempt > 0 {
+				atomic.AddInt64(&m.retries.recovered, 1)
+			}
+			return nil
+		}
+		if attempt >= m.cfg.Retries || !retryable(err) {
+			return err
+		}
+
+		atomic.AddInt64(&m.retries.retried, 1)
+		m.log.Printf("WARN: retry %d of %d after: %s\n", attempt+1, m.cfg.Retries, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// retryable reports whether err is a connection dropped mid-request, e.g.
+// by a load balancer recycling it.
+func retryable(err error) bool {
+	var re *requestError
+	return errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.As(err, &re) && errors.Is(err, io.EOF)
+}
+
+// logRetries logs the retries of the run, if any.
+func (m *Migrator) logRetries() {
+	if retried := atomic.LoadInt64(&m.retries.retried); retried > 0 {
+		m.log.Printf("INFO: retried %d times, %d operations recovered\n",
+			retried, atomic.LoadInt64(&m.retries.recovered))
+	}
+}
@@ -0,0 +1,143 @@
+package migrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnstableRing is returned by runs with RequireStableRing when the
+// source ring isn't known to be stable.
+var ErrUnstableRing = errors.New("source ring is not stable")
+
+// ownershipEntry matches a node and its partition count in the
+// ring_ownership stat, e.g. [{'riak@10.0.0.1',32},{'riak@10.0.0.2',32}].
+var ownershipEntry = regexp.MustCompile(`\{'([^']*)',(\d+)\}`)
+
+// RingCheck is what the stats of the source showed of its ring before a
+// run. Listings of a ring resizing or handing off partitions can miss the
+// keys of the partitions moving.
+type RingCheck struct {
+	CheckedAt  time.Time `json:"checked_at"`
+	Members    []string  `json:"ring_members,omitempty"`
+	Partitions int64     `json:"ring_num_partitions,omitempty"`
+	// Stable is whether no transfers were seen, Problems what was seen
+	// otherwise.
+	Stable   bool     `json:"stable"`
+	Problems []string `json:"problems,omitempty"`
+	// Error is why the stats couldn't be read, the ring is then not
+	// known to be stable.
+	Error string `json:"error,omitempty"`
+}
+
+// checkRing reads the stats of the source and logs whether its ring is
+// stable, failing the run with RequireStableRing when it isn't known to be.
+func (m *Migrator) checkRing(ctx context.Context) error {
+	check := &RingCheck{CheckedAt: time.Now().UTC()}
+	var body []byte
+	err := m.retry(ctx, func() (err error) {
+		body, err = m.source.GetStats(ctx)
+		return err
+	})
+	if err == nil {
+		err = check.parse(body)
+	}
+	if err != nil {
+		check.Error = err.Error()
+	}
+	m.bucketsMu.Lock()
+	m.ring = check
+	m.bucketsMu.Unlock()
+
+	switch {
+	case err != nil:
+		m.log.Printf("WARN: can't check the source ring, its stats are unavailable: %s\n", err)
+	case check.Stable:
+		m.log.Printf("INFO: source ring stable: %d members, %d partitions\n", len(check.Members), check.Partitions)
+		return nil
+	default:
+		m.log.Printf("WARN: source ring is transferring partitions, listings may miss keys: %s\n", strings.Join(check.Problems, "; "))
+	}
+	if m.cfg.RequireStableRing {
+		return ErrUnstableRing
+	}
+	return nil
+}
+
+// parse fills check from the stats of a node. The ring is unstable when
+// its size is changing, when its members and the owners of its partitions
+// differ, or when any stat counting transfers, where the node has such
+// stats, is above zero.
+func (check *RingCheck) parse(body []byte) error {
+	var stats map[string]interface{}
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return fmt.Errorf("decode stats: %w", err)
+	}
+
+	members, ok := stats["ring_members"].([]interface{})
+	if !ok {
+		return errors.New("stats have no ring_members")
+	}
+	for _, member := range members {
+		if name, ok := member.(string); ok {
+			check.Members = append(check.Members, name)
+		}
+	}
+	sort.Strings(check.Members)
+	if n, ok := stats["ring_num_partitions"].(float64); ok {
+		check.Partitions = int64(n)
+	}
+
+	if size, ok := stats["ring_creation_size"].(float64); ok && check.Partitions > 0 && int64(size) != check.Partitions {
+		check.Problems = append(check.Problems, fmt.Sprintf("ring has %d partitions, resizing to %d", check.Partitions, int64(size)))
+	}
+
+	if ownership, ok := stats["ring_ownership"].(string); ok {
+		owners := make(map[string]bool)
+		for _, match := range ownershipEntry.FindAllStringSubmatch(ownership, -1) {
+			if n, _ := strconv.Atoi(match[2]); n > 0 {
+				owners[match[1]] = true
+			}
+		}
+		isMember := make(map[string]bool, len(check.Members))
+		for _, member := range check.Members {
+			isMember[member] = true
+			if !owners[member] {
+				check.Problems = append(check.Problems, fmt.Sprintf("member %s owns no partitions yet", member))
+			}
+		}
+		var leaving []string
+		for owner := range owners {
+			if !isMember[owner] {
+				leaving = append(leaving, owner)
+			}
+		}
+		sort.Strings(leaving)
+		for _, owner := range leaving {
+			check.Problems = append(check.Problems, fmt.Sprintf("%s owns partitions but isn't a member", owner))
+		}
+	}
+
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !strings.Contains(name, "transfers") {
+			continue
+		}
+		if n, ok := stats[name].(float64); ok && n > 0 {
+			check.Problems = append(check.Problems, fmt.Sprintf("%s %d", name, int64(n)))
+		}
+	}
+
+	check.Stable = len(check.Problems) == 0
+	return nil
+}
@@ -0,0 +1,253 @@
+package migrator
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+// VerifySample compares a sample of the keys of every bucket of the
+// configured bucket types between the source and the destination: a
+// SampleRate share of the keys, or SampleCount keys per bucket. The sample
+// is picked by a hash of SampleSeed and the key, so runs with the same
+// seed check the same keys. It returns ErrDifferent when a sampled key
+// differs.
+func (m *Migrator) VerifySample(ctx context.Context) error {
+	types, err := m.bucketTypes(ctx)
+	if err != nil {
+		return err
+	}
+
+	var listed, checked, mismatched int64
+	for _, bucketType := range types {
+		buckets, err := m.source.ListBuckets(ctx, bucketType)
+		if err != nil {
+			return fmt.Errorf("get list of bucket err: %w", err)
+		}
+
+		for _, bucket := range buckets {
+			keys, n, err := m.sampleKeys(ctx, bucketType, bucket)
+			if err != nil {
+				return fmt.Errorf("sample bucket %s err: %w", bucket, err)
+			}
+			c, bad, err := m.checkSample(ctx, bucketType, bucket, keys)
+			if err != nil {
+				return fmt.Errorf("check bucket %s err: %w", bucket, err)
+			}
+			m.log.Printf("INFO: verify sample: bucket '%s': checked %d of %d keys, %d mismatched\n", bucket, c, n, bad)
+			listed += n
+			checked += c
+			mismatched += bad
+		}
+	}
+
+	m.log.Printf("INFO: verify sample%s: checked %d of %d keys, %d mismatched, with 95%% confidence at most %.3f%% of keys differ\n",
+		m.shardLabel(), checked, listed, mismatched, 100*wilsonUpper(mismatched, checked))
+	if mismatched > 0 {
+		return fmt.Errorf("%d of %d sampled keys differ: %w", mismatched, checked, ErrDifferent)
+	}
+	return nil
+}
+
+// sampleKeys returns the sampled keys of a bucket and the number of keys
+// listed.
+func (m *Migrator) sampleKeys(ctx context.Context, bucketType, bucket string) ([]string, int64, error) {
+	var n int64
+	s := m.newSampler()
+	err := m.listKeys(ctx, m.source, bucketType, bucket, func(key string) error {
+		if !m.inShard(bucket, key) {
+			return nil
+		}
+		n++
+		s.offer(key)
+		return nil
+	}, func() {})
+	if err != nil && !errors.Is(err, errNotFound) {
+		return nil, 0, err
+	}
+	return s.keys(), n, nil
+}
+
+// sampler picks a sample of the keys of a bucket, a SampleRate share of
+// them or SampleCount of them, all of them when neither is set. The keys
+// with the lowest hashes of SampleSeed and the key are picked, so runs
+// with the same seed pick the same keys.
+type sampler struct {
+	seed    int64
+	count   int
+	maxHash uint64
+	picked  []string
+	lowest  sampleHeap
+}
+
+func (m *Migrator) newSampler() *sampler {
+	s := &sampler{seed: m.cfg.SampleSeed, count: m.cfg.SampleCount, maxHash: math.MaxUint64}
+	if rate := m.cfg.SampleRate; rate > 0 && rate < 1 {
+		s.maxHash = uint64(rate * (1 << 63) * 2)
+	}
+	return s
+}
+
+// offer adds key to the sample if it belongs there. It reports whether
+// key is in the sample for now: with SampleCount, a key with a lower hash
+// may still replace it.
+func (s *sampler) offer(key string) bool {
+	h := s.hash(key)
+	switch {
+	case s.count > 0:
+		// Keep the count keys with the lowest hashes.
+		if s.lowest.Len() < s.count {
+			heap.Push(&s.lowest, sampleKey{key, h})
+		} else if h < s.lowest[0].hash {
+			s.lowest[0] = sampleKey{key, h}
+			heap.Fix(&s.lowest, 0)
+		} else {
+			return false
+		}
+	case h <= s.maxHash:
+		s.picked = append(s.picked, key)
+	default:
+		return false
+	}
+	return true
+}
+
+// keys returns the sampled keys.
+func (s *sampler) keys() []string {
+	keys := s.picked
+	for _, k := range s.lowest {
+		keys = append(keys, k.key)
+	}
+	return keys
+}
+
+func (s *sampler) hash(key string) uint64 {
+	h := sha256.New()
+	_ = binary.Write(h, binary.LittleEndian, s.seed)
+	_, _ = h.Write([]byte(key))
+	return binary.LittleEndian.Uint64(h.Sum(nil))
+}
+
+type sampleKey struct {
+	key  string
+	hash uint64
+}
+
+// sampleHeap is a max-heap of keys by hash.
+type sampleHeap []sampleKey
+
+func (h sampleHeap) Len() int            { return len(h) }
+func (h sampleHeap) Less(i, j int) bool  { return h[i].hash > h[j].hash }
+func (h sampleHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sampleHeap) Push(x interface{}) { *h = append(*h, x.(sampleKey)) }
+func (h *sampleHeap) Pop() interface{} {
+	old := *h
+	k := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return k
+}
+
+// checkSample compares the keys of a bucket between the clusters. It
+// returns the number of keys checked and mismatched; keys gone from the
+// source meanwhile aren't checked.
+func (m *Migrator) checkSample(ctx context.Context, bucketType, bucket string, keys []string) (int64, int64, error) {
+	var (
+		mu                  sync.Mutex
+		checked, mismatched int64
+		failure             error
+		wg                  sync.WaitGroup
+	)
+	keysC := make(chan string)
+	for i := 0; i < m.cfg.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keysC {
+				problem, err := m.compareKey(ctx, bucketType, bucket, key)
+				mu.Lock()
+				switch {
+				case errors.Is(err, errNotFound), errors.Is(err, errUnmatched):
+				case err != nil:
+					if failure == nil {
+						failure = fmt.Errorf("compare key '%s': %w", key, err)
+					}
+				case problem != "":
+					m.log.Printf("ERR: sampled key '%s' of bucket '%s' %s\n", key, bucket, problem)
+					mismatched++
+					checked++
+				default:
+					checked++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, key := range keys {
+		keysC <- key
+	}
+	close(keysC)
+	wg.Wait()
+	return checked, mismatched, failure
+}
+
+// compareKey fetches a key from both clusters and describes how the
+// destination copy differs, empty when it doesn't. A key missing on the
+// source is reported as errNotFound, one ValueMatch leaves out as
+// errUnmatched.
+func (m *Migrator) compareKey(ctx context.Context, bucketType, bucket, key string) (string, error) {
+	ctx = m.trace(ctx, bucketType, bucket, key)
+	src, err := m.fetch(ctx, m.source, bucketType, bucket, key)
+	if err != nil {
+		return "", err
+	}
+	if m.matcher != nil && !m.matcher.match(src) {
+		return "", errUnmatched
+	}
+
+	dstKey, ok := m.destKey(key)
+	if !ok {
+		dstKey = key
+	}
+	dst, err := m.fetch(ctx, m.destination, m.destType(bucketType), m.destBucket(bucket), dstKey)
+	if errors.Is(err, errNotFound) {
+		return "is missing on destination", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("destination: %w", err)
+	}
+
+	if !bytes.Equal(src, dst) {
+		return fmt.Sprintf("differs: %d bytes on source, %d bytes on destination", len(src), len(dst)), nil
+	}
+	return "", nil
+}
+
+func (m *Migrator) fetch(ctx context.Context, client riakClient, bucketType, bucket, key string) ([]byte, error) {
+	obj, err := client.GetObject(ctx, bucketType, bucket, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+	return io.ReadAll(obj.Body)
+}
+
+// wilsonUpper is the upper bound of the 95% Wilson score interval of the
+// share of failures among n checks.
+func wilsonUpper(failures, n int64) float64 {
+	if n == 0 {
+		return 1
+	}
+	const z = 1.96
+	p := float64(failures) / float64(n)
+	nf := float64(n)
+	center := p + z*z/(2*nf)
+	margin := z * math.Sqrt(p*(1-p)/nf+z*z/(4*nf*nf))
+	return math.Min(1, (center+margin)/(1+z*z/nf))
+}
@@ -0,0 +1,31 @@
+package migrator
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// inShard reports whether the key belongs to the shard of this instance.
+// A key belongs to shard i of n when the 64-bit FNV-1a hash of its bucket,
+// a zero byte and the key, modulo n, is i. The hash doesn't depend on the
+// run or the host, so instances with the same sharding always split the
+// keys the same way.
+func (m *Migrator) inShard(bucket, key string) bool {
+	if m.cfg.ShardCount <= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(bucket))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(key))
+	return h.Sum64()%uint64(m.cfg.ShardCount) == uint64(m.cfg.ShardIndex)
+}
+
+// shardLabel describes the shard of this instance for summaries, empty
+// when unsharded.
+func (m *Migrator) shardLabel() string {
+	if m.cfg.ShardCount <= 1 {
+		return ""
+	}
+	return fmt.Sprintf(" (shard %d of %d)", m.cfg.ShardIndex, m.cfg.ShardCount)
+}
@@ -0,0 +1,161 @@
+package migrator
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// outcome is what syncKey or a restore did with a single key, or how the
+// verification of a synced key went.
+type outcome int
+
+const (
+	copied outcome = iota
+	skippedExisting
+	skippedIdentical
+	unchanged
+	skippedNewer
+	preconditionFailed
+	skippedUnprefixed
+	skippedFiltered
+	skippedVanished
+	skippedOversize
+	skippedInvalidJSON
+	skippedTransform
+	skippedUnmatched
+	skippedResumed
+	verified
+	mismatched
+	deleted
+	wouldDelete
+	estimated
+	numOutcomes
+)
+
+var outcomeNames = [numOutcomes]string{
+	copied:             "copied",
+	skippedExisting:    "skipped existing",
+	skippedIdentical:   "skipped identical",
+	unchanged:          "unchanged",
+	skippedNewer:       "skipped newer on destination",
+	preconditionFailed: "skipped by conditional put",
+	skippedUnprefixed:  "skipped without prefix",
+	skippedFiltered:    "skipped by filter",
+	skippedVanished:    "vanished from source",
+	skippedOversize:    "skipped oversize",
+	skippedInvalidJSON: "skipped invalid JSON",
+	skippedTransform:   "skipped by transform",
+	skippedUnmatched:   "skipped by value match",
+	skippedResumed:     "skipped by resume index",
+	verified:           "verified",
+	mismatched:         "mismatched on verify",
+	deleted:            "deleted",
+	wouldDelete:        "would delete",
+	estimated:          "estimated",
+}
+
+// counters tallies key outcomes. It is safe for concurrent use.
+type counters [numOutcomes]int64
+
+func (c *counters) add(o outcome) {
+	atomic.AddInt64(&c[o], 1)
+}
+
+func (c *counters) get(o outcome) int64 {
+	return atomic.LoadInt64(&c[o])
+}
+
+// byName returns the non-zero outcomes by name.
+func (c *counters) byName() map[string]int64 {
+	names := make(map[string]int64)
+	for o := outcome(0); o < numOutcomes; o++ {
+		if n := c.get(o); n > 0 {
+			names[outcomeNames[o]] = n
+		}
+	}
+	return names
+}
+
+// merge adds the outcomes of other to c.
+func (c *counters) merge(other *counters) {
+	for o := outcome(0); o < numOutcomes; o++ {
+		atomic.AddInt64(&c[o], other.get(o))
+	}
+}
+
+// String lists the non-zero outcomes, e.g. "copied 10, skipped existing 2".
+func (c *counters) String() string {
+	var parts []string
+	for o := outcome(0); o < numOutcomes; o++ {
+		if n := c.get(o); n > 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", outcomeNames[o], n))
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// typeCounters returns the outcomes of the keys of the buckets of
+// bucketType synced so far.
+func (m *Migrator) typeCounters(bucketType string) *counters {
+	m.typeStatsMu.Lock()
+	defer m.typeStatsMu.Unlock()
+	if m.typeStats == nil {
+		m.typeStats = make(map[string]*counters)
+	}
+	c := m.typeStats[bucketType]
+	if c == nil {
+		c = &counters{}
+		m.typeStats[bucketType] = c
+	}
+	return c
+}
+
+// throughput accumulates the key GETs and PUTs of a bucket and the bytes
+// of the values fetched, for its progress lines. It is safe for
+// concurrent use.
+type throughput struct {
+	gets, getNanos int64
+	puts, putNanos int64
+	bytes          int64
+}
+
+func (t *throughput) get(d time.Duration) {
+	atomic.AddInt64(&t.gets, 1)
+	atomic.AddInt64(&t.getNanos, int64(d))
+}
+
+func (t *throughput) put(d time.Duration) {
+	atomic.AddInt64(&t.puts, 1)
+	atomic.AddInt64(&t.putNanos, int64(d))
+}
+
+func (t *throughput) snapshot() throughput {
+	return throughput{
+		gets:     atomic.LoadInt64(&t.gets),
+		getNanos: atomic.LoadInt64(&t.getNanos),
+		puts:     atomic.LoadInt64(&t.puts),
+		putNanos: atomic.LoadInt64(&t.putNanos),
+		bytes:    atomic.LoadInt64(&t.bytes),
+	}
+}
+
+// since formats the rates between the snapshots prev and t taken elapsed
+// apart, keys having been processed meanwhile, e.g. "120.0 keys/s,
+// 1.5 MB/s, get 8.1ms, put 21.3ms". Latencies are left out without
+// requests.
+func (t throughput) since(prev throughput, keys int64, elapsed time.Duration) string {
+	secs := elapsed.Seconds()
+	line := fmt.Sprintf("%.1f keys/s, %.1f MB/s", float64(keys)/secs, float64(t.bytes-prev.bytes)/secs/(1<<20))
+	if n := t.gets - prev.gets; n > 0 {
+		line += fmt.Sprintf(", get %s", time.Duration((t.getNanos-prev.getNanos)/n).Round(100*time.Microsecond))
+	}
+	if n := t.puts - prev.puts; n > 0 {
+		line += fmt.Sprintf(", put %s", time.Duration((t.putNanos-prev.putNanos)/n).Round(100*time.Microsecond))
+	}
+	return line
+}
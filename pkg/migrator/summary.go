@@ -0,0 +1,107 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// summaryErrors is the number of example errors kept per bucket.
+const summaryErrors = 10
+
+// Summary is what the last operation of a Migrator did, for reports.
+type Summary struct {
+	// RunID is the ID in the X-Request-Id headers of the run.
+	RunID string `json:"run_id"`
+	// Keys counts the keys by outcome, e.g. "copied" or "skipped
+	// existing", and Failed the keys that failed.
+	Keys   map[string]int64 `json:"keys"`
+	Failed int64            `json:"failed"`
+	// BucketTypes counts the keys of every bucket type by outcome.
+	BucketTypes map[string]map[string]int64 `json:"bucket_types,omitempty"`
+	// Buckets has the buckets synced by a migration or backup, in the
+	// order they finished.
+	Buckets []BucketSummary `json:"buckets,omitempty"`
+	// SourceRing is the check of the source ring before the run.
+	SourceRing *RingCheck `json:"source_ring,omitempty"`
+	// FsyncSeconds is the time backups spent syncing files with Fsync.
+	FsyncSeconds float64 `json:"fsync_seconds,omitempty"`
+	// Latencies has the latency percentiles of the requests for keys, by
+	// bucket type and operation.
+	Latencies []LatencySummary `json:"latencies,omitempty"`
+}
+
+// BucketSummary is what a migration or backup did with a bucket.
+type BucketSummary struct {
+	BucketType string           `json:"bucket_type"`
+	Bucket     string           `json:"bucket"`
+	Keys       map[string]int64 `json:"keys"`
+	Failed     int              `json:"failed"`
+	// Errors has up to summaryErrors errors of the bucket.
+	Errors []string `json:"errors,omitempty"`
+	// Bytes is the size of the values fetched from the source.
+	Bytes    int64     `json:"bytes"`
+	Started  time.Time `json:"started"`
+	Duration float64   `json:"duration_seconds"`
+}
+
+// Summary returns what the last operation did so far. It is safe to call
+// while the operation runs.
+func (m *Migrator) Summary() Summary {
+	m.bucketsMu.Lock()
+	buckets := append([]BucketSummary(nil), m.buckets...)
+	ring := m.ring
+	m.bucketsMu.Unlock()
+	var types map[string]map[string]int64
+	m.typeStatsMu.Lock()
+	for bucketType, stats := range m.typeStats {
+		if types == nil {
+			types = make(map[string]map[string]int64)
+		}
+		types[bucketType] = stats.byName()
+	}
+	m.typeStatsMu.Unlock()
+
+	return Summary{
+		RunID:       m.cfg.RunID,
+		Keys:        m.totals.byName(),
+		Failed:      atomic.LoadInt64(&m.failed),
+		BucketTypes: types,
+		Buckets:     buckets,
+		SourceRing:  ring,
+
+		FsyncSeconds: m.fsync.spent().Seconds(),
+		Latencies:    m.latencies.summaries(),
+	}
+}
+
+// summarizeBucket records the summary of a bucket synced since started,
+// err being the error its sync returned.
+func (m *Migrator) summarizeBucket(bucketType, bucket string, job *bucketJob, started time.Time, err error) {
+	s := BucketSummary{
+		BucketType: bucketType,
+		Bucket:     bucket,
+		Keys:       job.stats.byName(),
+		Bytes:      atomic.LoadInt64(&job.throughput.bytes),
+		Started:    started,
+		Duration:   time.Since(started).Seconds(),
+	}
+
+	job.mu.Lock()
+	s.Failed = len(job.failures)
+	for _, failure := range job.failures {
+		if len(s.Errors) == summaryErrors {
+			break
+		}
+		s.Errors = append(s.Errors, failure.Error())
+	}
+	job.mu.Unlock()
+	if s.Failed == 0 && err != nil && !errors.Is(err, context.Canceled) {
+		s.Errors = []string{err.Error()}
+	}
+
+	m.bucketsMu.Lock()
+	m.buckets = append(m.buckets, s)
+	m.bucketsMu.Unlock()
+}
@@ -0,0 +1,357 @@
+package migrator
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Span kinds and the error status code of OTLP.
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+	spanStatusError  = 2
+)
+
+const (
+	// telemetryQueue is the number of ended spans waiting for export, more
+	// are dropped.
+	telemetryQueue = 8192
+	// telemetryBatch is the most spans exported in a request, and
+	// telemetryInterval the longest an ended span waits for its export.
+	telemetryBatch    = 512
+	telemetryInterval = 5 * time.Second
+	// telemetryTimeout bounds an export request.
+	telemetryTimeout = 10 * time.Second
+)
+
+// spanCtxKey holds the span of a context, the parent of the request
+// spans of its requests.
+type spanCtxKey struct{}
+
+// tracer records the spans of a run and exports them to an OpenTelemetry
+// collector over OTLP/HTTP with JSON encoding. A nil tracer records none,
+// so is every nil span.
+type tracer struct {
+	url    string
+	sample float64
+	client *http.Client
+	log    *log.Logger
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+
+	spans   chan *span
+	dropped int64
+}
+
+// newTracer returns a tracer exporting to the collector at endpoint, e.g.
+// http://collector:4318, tracing the share sample of the keys.
+func newTracer(endpoint string, sample float64, logger *log.Logger) *tracer {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	var seed [8]byte
+	_, _ = crand.Read(seed[:])
+	return &tracer{
+		url:    url,
+		sample: sample,
+		client: &http.Client{Timeout: telemetryTimeout},
+		log:    logger,
+		rand:   rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(seed[:])))),
+		spans:  make(chan *span, telemetryQueue),
+	}
+}
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+func stringAttr(key, value string) attribute    { return attribute{key, value} }
+func intAttr(key string, value int64) attribute { return attribute{key, value} }
+
+// span is an operation of a run. Its fields are only written by the
+// goroutine ending it.
+type span struct {
+	tracer  *tracer
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   []attribute
+	err     string
+	// keyAttrs name the key of a key span, its request spans carry them
+	// too.
+	keyAttrs []attribute
+}
+
+// start starts a span, a child of parent unless nil, and returns ctx
+// holding it.
+func (t *tracer) start(ctx context.Context, parent *span, name string, kind int, attrs ...attribute) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now(), attrs: attrs}
+	t.randMu.Lock()
+	if parent != nil {
+		s.traceID, s.parent = parent.traceID, parent.id
+	} else {
+		t.rand.Read(s.traceID[:])
+	}
+	t.rand.Read(s.id[:])
+	t.randMu.Unlock()
+	return context.WithValue(ctx, spanCtxKey{}, s), s
+}
+
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanCtxKey{}).(*span)
+	return s
+}
+
+// startKey starts the span of a key processed for the bucket span parent,
+// for the sampled share of the keys only.
+func (t *tracer) startKey(ctx context.Context, parent *span, bucketType, bucket, key string) (context.Context, *span) {
+	if t == nil || parent == nil {
+		return ctx, nil
+	}
+	t.randMu.Lock()
+	sampled := t.rand.Float64() < t.sample
+	t.randMu.Unlock()
+	if !sampled {
+		return ctx, nil
+	}
+	keyAttrs := []attribute{
+		stringAttr("riak.bucket_type", bucketType),
+		stringAttr("riak.bucket", bucket),
+		stringAttr("riak.key", key),
+	}
+	ctx, s := t.start(ctx, parent, "sync key", spanKindInternal, keyAttrs...)
+	s.keyAttrs = keyAttrs
+	return ctx, s
+}
+
+// startRequest starts the span of req when its context holds a span, and
+// propagates it to the cluster in a W3C traceparent header.
+func (t *tracer) startRequest(req *http.Request) *span {
+	if t == nil {
+		return nil
+	}
+	parent := spanFrom(req.Context())
+	if parent == nil {
+		return nil
+	}
+	attrs := append([]attribute{
+		stringAttr("http.request.method", req.Method),
+		stringAttr("url.full", req.URL.Redacted()),
+		stringAttr("server.address", req.URL.Hostname()),
+	}, parent.keyAttrs...)
+	_, s := t.start(req.Context(), parent, req.Method, spanKindClient, attrs...)
+	req.Header.Set("traceparent", fmt.Sprintf("00-%x-%x-01", s.traceID, s.id))
+	return s
+}
+
+// setAttr adds an attribute to s.
+func (s *span) setAttr(attr attribute) {
+	if s != nil {
+		s.attrs = append(s.attrs, attr)
+	}
+}
+
+// status records the status code of the response of a request span, 4xx
+// and 5xx ones failing it.
+func (s *span) status(code int) {
+	if s == nil {
+		return
+	}
+	s.setAttr(intAttr("http.response.status_code", int64(code)))
+	if code >= 400 {
+		s.err = http.StatusText(code)
+	}
+}
+
+// finish ends s, failed when err isn't nil, and queues it for export.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	select {
+	case s.tracer.spans <- s:
+	default:
+		atomic.AddInt64(&s.tracer.dropped, 1)
+	}
+}
+
+// run exports the queued spans until the returned func is called, which
+// exports the remaining ones and waits for that.
+func (t *tracer) run() func() {
+	if t == nil {
+		return func() {}
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		tick := time.NewTicker(telemetryInterval)
+		defer tick.Stop()
+		batch := make([]*span, 0, telemetryBatch)
+		add := func(s *span) {
+			if batch = append(batch, s); len(batch) == telemetryBatch {
+				t.export(batch)
+				batch = batch[:0]
+			}
+		}
+		for {
+			select {
+			case s := <-t.spans:
+				add(s)
+			case <-tick.C:
+				t.export(batch)
+				batch = batch[:0]
+			case <-stop:
+				for {
+					select {
+					case s := <-t.spans:
+						add(s)
+					default:
+						t.export(batch)
+						return
+					}
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		if n := atomic.SwapInt64(&t.dropped, 0); n > 0 {
+			t.log.Printf("WARN: telemetry: dropped %d spans, the export didn't keep up\n", n)
+		}
+	}
+}
+
+// export sends spans to the collector. A failed export is logged, its
+// spans are lost.
+func (t *tracer) export(spans []*span) {
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(otlpTraces(spans))
+	if err == nil {
+		err = t.post(body)
+	}
+	if err != nil {
+		t.log.Printf("WARN: telemetry: export %d spans: %s\n", len(spans), err)
+	}
+}
+
+func (t *tracer) post(body []byte) error {
+	res, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("collector responded %s", res.Status)
+	}
+	return nil
+}
+
+// otlpTraces is the ExportTraceServiceRequest of spans, in the JSON
+// encoding of OTLP: IDs in hex, 64 bit integers as strings.
+func otlpTraces(spans []*span) map[string]interface{} {
+	encoded := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		e := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.id[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parent != ([8]byte{}) {
+			e["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != "" {
+			e["status"] = map[string]interface{}{"code": spanStatusError, "message": s.err}
+		}
+		encoded = append(encoded, e)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes([]attribute{stringAttr("service.name", "riak-migrator")}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/tufitko/riak-migrator"},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attrs []attribute) []interface{} {
+	encoded := make([]interface{}, 0, len(attrs))
+	for _, a := range attrs {
+		var value interface{}
+		switch v := a.value.(type) {
+		case int64:
+			value = map[string]string{"intValue": strconv.FormatInt(v, 10)}
+		default:
+			value = map[string]interface{}{"stringValue": v}
+		}
+		encoded = append(encoded, map[string]interface{}{"key": a.key, "value": value})
+	}
+	return encoded
+}
+
+// traceRun starts the root span of a run and the export of its spans. The
+// returned func ends the span with the outcome of the run and exports the
+// spans left.
+func (m *Migrator) traceRun(ctx context.Context, types []string) (context.Context, func(error)) {
+	if m.tracer == nil {
+		return ctx, func(error) {}
+	}
+	stop := m.tracer.run()
+	ctx, s := m.tracer.start(ctx, nil, m.runSpanName(), spanKindInternal,
+		stringAttr("riak.bucket_types", strings.Join(types, ",")))
+	return ctx, func(err error) {
+		s.setAttr(intAttr("riak.keys.failed", atomic.LoadInt64(&m.failed)))
+		s.finish(err)
+		stop()
+	}
+}
+
+// runSpanName names the root span of a run after its mode.
+func (m *Migrator) runSpanName() string {
+	switch m.mode {
+	case modeBackupDir, modeBackupStream:
+		return "backup"
+	case modeDelete:
+		return "delete"
+	case modeEstimate:
+		return "estimate"
+	}
+	return "migrate"
+}
@@ -0,0 +1,168 @@
+package migrator
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// autoParallelStart is the number of workers AutoParallel starts with.
+	autoParallelStart = 2
+	// latencyWindow is the number of latest PUTs and failed keys the p95
+	// latency and error rate are taken over, checked every
+	// latencyCheckEvery of them.
+	latencyWindow     = 200
+	latencyCheckEvery = 50
+)
+
+// limiter bounds the number of workers syncing keys at once, below the
+// number of workers of the pool. It is safe for concurrent use.
+type limiter struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+func newLimiter(limit int) *limiter {
+	l := &limiter{limit: limit}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire waits until fewer than limit workers are active.
+func (l *limiter) acquire() {
+	l.mu.Lock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+	l.mu.Unlock()
+}
+
+func (l *limiter) release() {
+	l.mu.Lock()
+	l.active--
+	l.mu.Unlock()
+	l.cond.Signal()
+}
+
+func (l *limiter) get() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+func (l *limiter) set(limit int) {
+	l.mu.Lock()
+	l.limit = limit
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+// throttle adjusts the limit of workers to the health of the
+// destination, an additive increase, multiplicative decrease controller:
+// it halves the limit while the p95 latency of destination PUTs is over
+// threshold or the share of failed keys over maxErrors, and raises it by
+// one up to max once both are back under. Zero bounds aren't checked.
+type throttle struct {
+	log       *log.Logger
+	limit     *limiter
+	max       int
+	threshold time.Duration
+	maxErrors float64
+
+	mu      sync.Mutex
+	samples []sample
+	next    int
+	added   int
+}
+
+// sample is a destination PUT, or a failed key.
+type sample struct {
+	latency time.Duration
+	failed  bool
+}
+
+func newThrottle(logger *log.Logger, limit *limiter, max int, threshold time.Duration, maxErrors float64) *throttle {
+	return &throttle{
+		log:       logger,
+		limit:     limit,
+		max:       max,
+		threshold: threshold,
+		maxErrors: maxErrors,
+		samples:   make([]sample, 0, latencyWindow),
+	}
+}
+
+// observe records the latency of a destination PUT.
+func (t *throttle) observe(latency time.Duration) {
+	t.add(sample{latency: latency})
+}
+
+// fail records a failed key.
+func (t *throttle) fail() {
+	t.add(sample{failed: true})
+}
+
+func (t *throttle) add(s sample) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.samples) < latencyWindow {
+		t.samples = append(t.samples, s)
+	} else {
+		t.samples[t.next] = s
+		t.next = (t.next + 1) % latencyWindow
+	}
+	t.added++
+	if t.added < latencyCheckEvery {
+		return
+	}
+	t.added = 0
+
+	var latencies []time.Duration
+	failed := 0
+	for _, s := range t.samples {
+		if s.failed {
+			failed++
+		} else {
+			latencies = append(latencies, s.latency)
+		}
+	}
+	var p95 time.Duration
+	if len(latencies) > 0 {
+		p95 = percentile(latencies, 0.95).Round(100 * time.Microsecond)
+	}
+	errors := float64(failed) / float64(len(t.samples))
+
+	limit := t.limit.get()
+	status := fmt.Sprintf("destination p95 put latency %s, %.1f%% of keys failed", p95, 100*errors)
+	switch {
+	case t.threshold > 0 && p95 > t.threshold || t.maxErrors > 0 && errors > t.maxErrors:
+		if limit == 1 {
+			return
+		}
+		limit /= 2
+		t.log.Printf("WARN: %s, throttle to %d workers\n", status, limit)
+	case limit < t.max:
+		limit++
+		t.log.Printf("INFO: %s, unthrottle to %d workers\n", status, limit)
+	default:
+		return
+	}
+	t.limit.set(limit)
+	// Judge the new limit by the latencies it causes.
+	t.samples, t.next = t.samples[:0], 0
+}
+
+// percentile returns the p-th percentile of samples, which it doesn't
+// modify.
+func percentile(samples []time.Duration, p float64) time.Duration {
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(p*float64(len(sorted)-1))]
+}
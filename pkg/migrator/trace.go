@@ -0,0 +1,148 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// traceBodySize is how much of the bodies of traced requests and
+// responses is logged.
+const traceBodySize = 1024
+
+// traceCtxKey marks the context of the requests for a traced key, its
+// value being the key as type/bucket/key.
+type traceCtxKey struct{}
+
+// parseTraceKeys parses the type/bucket/key entries of TraceKeys, the key
+// being the rest after the bucket.
+func parseTraceKeys(entries []string) (map[string]bool, error) {
+	traced := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if parts := strings.SplitN(entry, "/", 3); len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid trace key '%s', want type/bucket/key", entry)
+		}
+		traced[entry] = true
+	}
+	return traced, nil
+}
+
+// trace returns ctx marked for tracing when the unescaped key is one of
+// TraceKeys.
+func (m *Migrator) trace(ctx context.Context, bucketType, bucket, key string) context.Context {
+	name := bucketType + "/" + bucket + "/" + key
+	if !m.traced[name] {
+		return ctx
+	}
+	return context.WithValue(ctx, traceCtxKey{}, name)
+}
+
+// requestTrace logs a request of a traced key and its response.
+type requestTrace struct {
+	log  *log.Logger
+	name string
+	body *traceBody
+}
+
+func newRequestTrace(ctx context.Context, logger *log.Logger) *requestTrace {
+	name, _ := ctx.Value(traceCtxKey{}).(string)
+	if name == "" || logger == nil {
+		return nil
+	}
+	return &requestTrace{log: logger, name: name}
+}
+
+func (t *requestTrace) printf(format string, args ...interface{}) {
+	t.log.Printf("TRACE: %s: "+format+"\n", append([]interface{}{t.name}, args...)...)
+}
+
+func (t *requestTrace) headers(prefix string, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		if name == "Authorization" || name == "Proxy-Authorization" {
+			value = "[redacted]"
+		}
+		t.printf("%s %s: %s", prefix, name, value)
+	}
+}
+
+// request wraps the body of req to keep its start, and logs the request
+// line and headers.
+func (t *requestTrace) request(req *http.Request) {
+	t.printf("> %s %s", req.Method, req.URL.Redacted())
+	t.headers(">", req.Header)
+	if req.Body != nil && req.Body != http.NoBody {
+		t.body = &traceBody{ReadCloser: req.Body}
+		req.Body = t.body
+	}
+}
+
+// response logs the request body read so far, and the status and headers
+// of res. Its body is logged once closed.
+func (t *requestTrace) response(res *http.Response, err error) {
+	if t.body != nil {
+		t.printf("> body: %s", t.body)
+	}
+	if err != nil {
+		t.printf("! %s", err)
+		return
+	}
+	t.printf("< %s", res.Status)
+	t.headers("<", res.Header)
+	res.Body = &traceBody{ReadCloser: res.Body, done: func(b *traceBody) {
+		t.printf("< body: %s", b)
+	}}
+}
+
+// traceBody keeps the first traceBodySize bytes read from a body, calling
+// done once it is closed.
+type traceBody struct {
+	io.ReadCloser
+	done func(*traceBody)
+
+	mu   sync.Mutex
+	head []byte
+	n    int64
+	once sync.Once
+}
+
+func (b *traceBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	if keep := traceBodySize - len(b.head); keep > 0 {
+		if keep > n {
+			keep = n
+		}
+		b.head = append(b.head, p[:keep]...)
+	}
+	b.n += int64(n)
+	b.mu.Unlock()
+	return n, err
+}
+
+func (b *traceBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.done != nil {
+		b.once.Do(func() { b.done(b) })
+	}
+	return err
+}
+
+func (b *traceBody) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.n > int64(len(b.head)) {
+		return fmt.Sprintf("%q (first %d of %d bytes read)", b.head, len(b.head), b.n)
+	}
+	return fmt.Sprintf("%q (%d bytes)", b.head, b.n)
+}
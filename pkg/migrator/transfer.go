@@ -0,0 +1,154 @@
+package migrator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultProbeBucket is the bucket the key probing the destination is
+// written to and deleted from, unless Config.GzipProbeBucket is set.
+const DefaultProbeBucket = "riak-migrator-probe"
+
+// errGzipStored is a destination storing gzip encoded PUT bodies as they
+// are instead of decoding them, as Riak itself does: it keeps the
+// Content-Encoding as metadata of the object.
+var errGzipStored = errors.New("destination stores gzip encoded values without decoding them")
+
+// transferStats counts the bytes of the values sent to the destination or
+// received from the source, logical ones before compression and wire ones
+// after it.
+type transferStats struct {
+	logical int64
+	wire    int64
+}
+
+// checkCompression probes once whether the destination takes gzip
+// encoded PUT bodies when CompressTransfer is set, and sends values
+// uncompressed from then on if it doesn't. Restores of several files at
+// once call it concurrently.
+func (m *Migrator) checkCompression(ctx context.Context) error {
+	m.gzipMu.Lock()
+	defer m.gzipMu.Unlock()
+	if !m.cfg.CompressTransfer || m.cfg.DryRun || m.gzipChecked {
+		return nil
+	}
+
+	err := m.probeGzip(ctx)
+	var se *statusError
+	switch {
+	case errors.As(err, &se) && se.code >= 400 && se.code < 500, errors.Is(err, errGzipStored):
+		m.log.Printf("WARN: destination doesn't take gzip encoded values, sending them uncompressed: %s\n", err)
+	case err != nil:
+		return fmt.Errorf("probe gzip: %w", err)
+	default:
+		m.log.Println("INFO: compressing values sent to the destination")
+		m.gzipPut = true
+	}
+	m.gzipChecked = true
+	return nil
+}
+
+// probeGzip writes a gzip encoded probe key to the destination and reads
+// it back, the destination must have stored it decoded.
+func (m *Migrator) probeGzip(ctx context.Context) error {
+	value := []byte(`{"probe":"gzip"}`)
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	_, _ = zw.Write(value)
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	bucketType, bucket := m.cfg.GzipProbeType, m.cfg.GzipProbeBucket
+	key := fmt.Sprintf("gzip-%d", time.Now().UnixNano())
+	m.log.Printf("INFO: probing gzip support of the destination with key '%s' of bucket '%s' (%s), deleted afterwards\n", key, bucket, bucketType)
+	header := http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {"gzip"}}
+	if err := m.destination.PutObject(ctx, bucketType, bucket, key, &body, header); err != nil {
+		return err
+	}
+	defer func() {
+		if err := m.destination.DeleteObject(ctx, bucketType, bucket, key); err != nil {
+			m.log.Printf("WARN: delete probe key '%s' of bucket '%s' (%s): %s\n", key, bucket, bucketType, err)
+		}
+	}()
+
+	// Accepting identity only keeps the transport from decoding a value
+	// stored encoded.
+	obj, err := m.destination.GetObject(ctx, bucketType, bucket, key, http.Header{"Accept-Encoding": {"identity"}})
+	if err != nil {
+		return fmt.Errorf("read back: %w", err)
+	}
+	defer obj.Body.Close()
+	got, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return fmt.Errorf("read back: %w", err)
+	}
+	if obj.Header.Get("Content-Encoding") != "" || !bytes.Equal(got, value) {
+		return errGzipStored
+	}
+	return nil
+}
+
+// putBody returns the body of a destination PUT of value, gzip encoded
+// when the destination takes it, setting Content-Encoding in header.
+func (m *Migrator) putBody(value io.Reader, header http.Header) io.Reader {
+	if !m.gzipPut {
+		return value
+	}
+	header.Set("Content-Encoding", "gzip")
+
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, &countingReader{r: value, n: &m.sent.logical})
+		if err == nil {
+			err = zw.Close()
+		}
+		_ = pw.CloseWithError(err)
+	}()
+	// The transport closes the body, which stops the encoding of a failed
+	// PUT.
+	return &countingReader{r: pr, n: &m.sent.wire}
+}
+
+// logTransfer logs the bytes of the values received, and the savings of
+// compressed PUTs, if any.
+func (m *Migrator) logTransfer() {
+	logical, wire := atomic.LoadInt64(&m.received.logical), atomic.LoadInt64(&m.received.wire)
+	if logical > 0 {
+		m.log.Printf("INFO: received %d bytes of values as %d bytes (%.1fx)\n",
+			logical, wire, float64(logical)/float64(wire))
+	}
+	logical, wire = atomic.LoadInt64(&m.sent.logical), atomic.LoadInt64(&m.sent.wire)
+	if m.gzipPut && logical > 0 {
+		m.log.Printf("INFO: sent %d bytes of values as %d bytes compressed (%.1fx)\n",
+			logical, wire, float64(logical)/float64(wire))
+	}
+}
+
+// countingReader adds the bytes read from r to n, and closes r if it is
+// a Closer.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	if closer, ok := c.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
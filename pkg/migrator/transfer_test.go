@@ -0,0 +1,85 @@
+package migrator
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCompressProbeBucket(t *testing.T) {
+	source, destination := newFakeRiak(t), newFakeRiak(t)
+	source.put("default", "b1", "k1", "v1")
+	m := newTestMigrator(t, Config{
+		Source:           source.URL,
+		Destination:      destination.URL,
+		CompressTransfer: true,
+		GzipProbeType:    "maps",
+		GzipProbeBucket:  "probes",
+	})
+	if err := m.Migrate(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	// The fake stores gzip encoded values as they are, as Riak does, so the
+	// probe fails and the key is copied uncompressed.
+	if m.gzipPut {
+		t.Error("values compressed for a destination storing them encoded")
+	}
+	for _, method := range []string{"PUT", "GET", "DELETE"} {
+		var probes []string
+		for _, p := range destination.requested(method) {
+			p, _, _ = strings.Cut(p, "?")
+			if matched, _ := path.Match("/types/maps/buckets/probes/keys/gzip-*", p); matched {
+				probes = append(probes, p)
+			}
+		}
+		if len(probes) != 1 {
+			t.Errorf("%s requests of the probe key: %q, want 1", method, probes)
+		}
+	}
+	if keys := destination.keys("maps", "probes"); len(keys) > 0 {
+		t.Errorf("probe keys left behind: %q", keys)
+	}
+	if got := destination.get("default", "b1", "k1"); got == nil || string(got.value) != "v1" {
+		t.Errorf("k1 on destination = %+v, want v1", got)
+	}
+}
+
+func TestSourceGzip(t *testing.T) {
+	for _, tc := range []struct {
+		noSourceGzip bool
+		want         string
+	}{
+		{false, "gzip"},
+		{true, "identity"},
+	} {
+		source, destination := newFakeRiak(t), newFakeRiak(t)
+		source.put("default", "b1", "k1", "v1")
+		var (
+			mu        sync.Mutex
+			encodings []string
+		)
+		handler := source.Config.Handler
+		source.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/keys/") {
+				mu.Lock()
+				encodings = append(encodings, r.Header.Get("Accept-Encoding"))
+				mu.Unlock()
+			}
+			handler.ServeHTTP(w, r)
+		})
+		m := newTestMigrator(t, Config{Source: source.URL, Destination: destination.URL, NoSourceGzip: tc.noSourceGzip})
+		if err := m.Migrate(context.Background()); err != nil {
+			t.Fatalf("migrate: %v", err)
+		}
+		if len(encodings) != 1 || encodings[0] != tc.want {
+			t.Errorf("NoSourceGzip %v: Accept-Encoding of key GETs %q, want %q", tc.noSourceGzip, encodings, tc.want)
+		}
+		if got := destination.get("default", "b1", "k1"); got == nil || string(got.value) != "v1" {
+			t.Errorf("NoSourceGzip %v: k1 on destination = %+v, want v1", tc.noSourceGzip, got)
+		}
+	}
+}
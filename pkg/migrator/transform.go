@@ -0,0 +1,166 @@
+package migrator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// defaultTransformTimeout bounds a TransformCmd run when TransformTimeout
+// is unset.
+const defaultTransformTimeout = 30 * time.Second
+
+// transformStderr is how much of the stderr of a failed TransformCmd is
+// kept for its error.
+const transformStderr = 1024
+
+// transformError is a TransformCmd run that failed or timed out.
+type transformError struct {
+	err    error
+	stderr string
+}
+
+func (e *transformError) Error() string {
+	if e.stderr == "" {
+		return fmt.Sprintf("transform: %s", e.err)
+	}
+	return fmt.Sprintf("transform: %s: %s", e.err, e.stderr)
+}
+
+func (e *transformError) Unwrap() error { return e.err }
+
+// transformer runs TransformCmd, at most limit at once.
+type transformer struct {
+	cmd     string
+	timeout time.Duration
+	slots   chan struct{}
+}
+
+func newTransformer(cmd string, limit int, timeout time.Duration) *transformer {
+	if timeout <= 0 {
+		timeout = defaultTransformTimeout
+	}
+	return &transformer{cmd: cmd, timeout: timeout, slots: make(chan struct{}, limit)}
+}
+
+// run pipes value through the command and returns its stdout. The key is
+// passed unescaped in RIAK_KEY.
+func (t *transformer) run(ctx context.Context, bucketType, bucket, key string, value io.Reader) ([]byte, error) {
+	select {
+	case t.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-t.slots }()
+
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", t.cmd)
+	cmd.Env = append(os.Environ(), "RIAK_BUCKET_TYPE="+bucketType, "RIAK_BUCKET="+bucket, "RIAK_KEY="+key)
+
+	// The pipes are the migrator's to close: a process the command left
+	// behind may hold them open after the timeout kills the shell.
+	var pipes [3][2]*os.File
+	for i := range pipes {
+		r, w, err := os.Pipe()
+		if err != nil {
+			closePipes(pipes[:i])
+			return nil, err
+		}
+		pipes[i] = [2]*os.File{r, w}
+	}
+	defer closePipes(pipes[:])
+	stdin, stdout, stderr := pipes[0], pipes[1], pipes[2]
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin[0], stdout[1], stderr[1]
+	if err := cmd.Start(); err != nil {
+		return nil, &transformError{err: err}
+	}
+	_, _, _ = stdin[0].Close(), stdout[1].Close(), stderr[1].Close()
+
+	var (
+		out     []byte
+		errTail = &tailBuffer{max: transformStderr}
+		done    = make(chan struct{})
+	)
+	fed := make(chan struct{})
+	go func() {
+		defer close(fed)
+		_, _ = io.Copy(stdin[1], value)
+		_ = stdin[1].Close()
+	}()
+	// value is the caller's again once the pipes are closed.
+	defer func() {
+		closePipes(pipes[:])
+		<-fed
+	}()
+	go func() {
+		defer close(done)
+		copied := make(chan struct{})
+		go func() {
+			_, _ = io.Copy(errTail, stderr[0])
+			close(copied)
+		}()
+		out, _ = io.ReadAll(stdout[0])
+		<-copied
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		closePipes(pipes[:])
+		<-done
+	}
+
+	err := cmd.Wait()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s", t.timeout)
+	}
+	if err != nil {
+		return nil, &transformError{err: err, stderr: strings.TrimSpace(errTail.String())}
+	}
+	return out, nil
+}
+
+func closePipes(pipes [][2]*os.File) {
+	for _, p := range pipes {
+		_, _ = p[0].Close(), p[1].Close()
+	}
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = b.buf[len(b.buf)-b.max:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string { return string(b.buf) }
+
+// transform runs the value of obj through TransformCmd, replacing it with
+// the output. A failed run fails the key, or skips it with TransformSkip.
+// It reports copied when the key is to be copied.
+func (m *Migrator) transform(ctx context.Context, bucketType, bucket, key string, obj *object) (outcome, error) {
+	out, err := m.transformer.run(ctx, bucketType, bucket, key, obj.Body)
+	var te *transformError
+	if errors.As(err, &te) && m.cfg.TransformSkip {
+		m.log.Printf("WARN: skip key '%s' of bucket '%s': %s\n", key, bucket, err)
+		return skippedTransform, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	obj.Body, obj.Size = io.NopCloser(bytes.NewReader(out)), int64(len(out))
+	return copied, nil
+}
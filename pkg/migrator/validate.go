@@ -0,0 +1,66 @@
+package migrator
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+)
+
+// Policies for values failing ValidateJSON.
+const (
+	InvalidJSONWarn = "warn"
+	InvalidJSONSkip = "skip"
+	InvalidJSONFail = "fail"
+)
+
+var errInvalidJSON = errors.New("invalid JSON value")
+
+// invalidJSONRecord is a line of the invalid JSON report. Key is escaped
+// like in backups.
+type invalidJSONRecord struct {
+	BucketType  string `json:"bucket_type"`
+	Bucket      string `json:"bucket"`
+	Key         string `json:"key"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+// validateJSON checks the value of obj when its content type is JSON,
+// reading it into memory, and handles an invalid one as InvalidJSON says.
+// It reports copied when the key is to be copied.
+func (m *Migrator) validateJSON(bucketType, bucket, key string, obj *object) (outcome, error) {
+	contentType := obj.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	// Values stored compressed aren't JSON as such.
+	if mediaType != "application/json" || obj.Header.Get("Content-Encoding") != "" {
+		return copied, nil
+	}
+
+	buf, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return 0, fmt.Errorf("get key: %w", err)
+	}
+	obj.Body, obj.Size = io.NopCloser(bytes.NewReader(buf)), int64(len(buf))
+	if json.Valid(buf) {
+		return copied, nil
+	}
+
+	if m.jsonReport != nil {
+		rec := invalidJSONRecord{BucketType: bucketType, Bucket: bucket, Key: escapeKey(key), ContentType: contentType, Size: obj.Size}
+		if err = m.jsonReport.add(rec); err != nil {
+			return 0, err
+		}
+	}
+	switch m.cfg.InvalidJSON {
+	case InvalidJSONFail:
+		return 0, errInvalidJSON
+	case InvalidJSONSkip:
+		m.log.Printf("WARN: skip key '%s' of bucket '%s', its value is invalid JSON\n", key, bucket)
+		return skippedInvalidJSON, nil
+	}
+	m.log.Printf("WARN: key '%s' of bucket '%s' has an invalid JSON value, copying it anyway\n", key, bucket)
+	return copied, nil
+}
@@ -0,0 +1,80 @@
+package migrator
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// errUnmatched is a key whose value ValueMatch leaves out.
+var errUnmatched = errors.New("value doesn't match")
+
+// fieldCondition is the field=value form of ValueMatch, a dotted JSON
+// field path.
+var fieldCondition = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)*)=(.*)$`)
+
+// valueMatcher decides which values ValueMatch keeps.
+type valueMatcher struct {
+	re    *regexp.Regexp
+	path  []string
+	value string
+}
+
+func newValueMatcher(expr string) (*valueMatcher, error) {
+	if m := fieldCondition.FindStringSubmatch(expr); m != nil {
+		return &valueMatcher{path: strings.Split(m[1], "."), value: m[2]}, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value match: %w", err)
+	}
+	return &valueMatcher{re: re}, nil
+}
+
+// match reports whether value is kept. A field condition only matches
+// JSON objects having the field: a string field is compared unquoted,
+// other values as their JSON text.
+func (vm *valueMatcher) match(value []byte) bool {
+	if vm.re != nil {
+		return vm.re.Match(value)
+	}
+	raw := json.RawMessage(value)
+	for _, field := range vm.path {
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(raw, &obj) != nil {
+			return false
+		}
+		var ok bool
+		if raw, ok = obj[field]; !ok {
+			return false
+		}
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s == vm.value
+	}
+	return string(bytes.TrimSpace(raw)) == vm.value
+}
+
+// matchValue reads the value of obj into memory and reports whether
+// ValueMatch keeps it. A key with siblings is kept if one of them is.
+func (m *Migrator) matchValue(obj *object) (bool, error) {
+	if len(obj.Siblings) > 0 {
+		for _, s := range obj.Siblings {
+			if m.matcher.match(s.Value) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	buf, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return false, fmt.Errorf("get key: %w", err)
+	}
+	obj.Body, obj.Size = io.NopCloser(bytes.NewReader(buf)), int64(len(buf))
+	return m.matcher.match(buf), nil
+}
@@ -0,0 +1,281 @@
+package migrator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// VerifyDir re-reads every key file of the directory backup in BackupDir
+// and checks it against the manifest written during the backup.
+func (m *Migrator) VerifyDir(ctx context.Context) error {
+	version, err := checkDirFormat(m.cfg.BackupDir)
+	if err != nil {
+		return err
+	}
+
+	entries, err := readManifest(m.cfg.BackupDir)
+	if err != nil {
+		return fmt.Errorf("read manifest: %w", err)
+	}
+
+	var (
+		mu         sync.Mutex
+		seen       = make(map[string]bool, len(entries))
+		extra      []string
+		mismatched []string
+		badProps   []string
+		checked    int64
+	)
+
+	paths := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < m.cfg.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for rel := range paths {
+				atomic.AddInt64(&checked, 1)
+
+				entry, ok := entries[rel]
+				if !ok {
+					mu.Lock()
+					extra = append(extra, rel)
+					mu.Unlock()
+					continue
+				}
+
+				size, sum, err := fileChecksum(filepath.Join(m.cfg.BackupDir, rel))
+
+				mu.Lock()
+				seen[rel] = true
+				switch {
+				case err != nil:
+					mismatched = append(mismatched, fmt.Sprintf("%s: %s", rel, err))
+				case size != entry.Size || sum != entry.SHA256:
+					mismatched = append(mismatched, fmt.Sprintf("%s: size %d sha256 %s, manifest size %d sha256 %s", rel, size, sum, entry.Size, entry.SHA256))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	tick := time.NewTicker(time.Second * 5)
+	defer tick.Stop()
+
+	err = filepath.WalkDir(m.cfg.BackupDir, func(path string, file fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(m.cfg.BackupDir, path)
+		if err != nil {
+			return err
+		}
+		if file.IsDir() {
+			// Bucket dirs of format 4 and newer have a props file.
+			if version >= 4 && strings.Count(rel, string(filepath.Separator)) == 1 {
+				err := checkPropsFile(path)
+				switch {
+				case errors.Is(err, fs.ErrNotExist):
+					m.log.Printf("WARN: bucket dir %s has no %s, it wasn't written by a backup\n", rel, propsName)
+				case err != nil:
+					badProps = append(badProps, fmt.Sprintf("%s: %s", rel, err))
+				}
+			}
+			return nil
+		}
+		if !isKeyFile(file.Name()) {
+			return nil
+		}
+
+		for sent := false; !sent; {
+			select {
+			case <-tick.C:
+				m.log.Printf("INFO: verify progress: %d/%d\n", atomic.LoadInt64(&checked), len(entries))
+			case paths <- rel:
+				sent = true
+			}
+		}
+		return nil
+	})
+	close(paths)
+	wg.Wait()
+	if err != nil {
+		return fmt.Errorf("walk backup dir: %w", err)
+	}
+
+	var missing []string
+	for rel := range entries {
+		if !seen[rel] {
+			missing = append(missing, rel)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	sort.Strings(mismatched)
+
+	for _, rel := range missing {
+		m.log.Printf("ERR: missing key file %s\n", rel)
+	}
+	for _, rel := range extra {
+		m.log.Printf("ERR: extra file %s is not in manifest\n", rel)
+	}
+	for _, problem := range mismatched {
+		m.log.Printf("ERR: checksum mismatch %s\n", problem)
+	}
+	for _, problem := range badProps {
+		m.log.Printf("ERR: invalid props file %s\n", problem)
+	}
+
+	m.log.Printf("INFO: verified %d files: %d missing, %d extra, %d mismatched, %d invalid props files\n", checked, len(missing), len(extra), len(mismatched), len(badProps))
+	if len(missing)+len(extra)+len(mismatched)+len(badProps) > 0 {
+		return fmt.Errorf("backup %s is inconsistent with its manifest", m.cfg.BackupDir)
+	}
+	return nil
+}
+
+// Verify checks the checksum of every record of an NDJSON backup read
+// from r. Records written before checksums existed are counted but can't
+// be verified.
+func (m *Migrator) Verify(ctx context.Context, r io.Reader) error {
+	type line struct {
+		n    int
+		data []byte
+	}
+
+	var (
+		mu        sync.Mutex
+		problems  []string
+		checked   int64
+		unchecked int64
+	)
+	report := func(format string, args ...interface{}) {
+		mu.Lock()
+		problems = append(problems, fmt.Sprintf(format, args...))
+		mu.Unlock()
+	}
+
+	lines := make(chan line)
+	var wg sync.WaitGroup
+	for i := 0; i < m.cfg.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for ln := range lines {
+				var kv record
+				if err := json.Unmarshal(ln.data, &kv); err != nil {
+					report("line %d: malformed record: %s", ln.n, err)
+					continue
+				}
+				if err := checkFormat(kv.Format); err != nil {
+					report("line %d: %s", ln.n, err)
+					continue
+				}
+
+				if len(kv.Siblings) > 0 {
+					atomic.AddInt64(&checked, 1)
+					for i, s := range kv.Siblings {
+						if sum := checksum(s.Value); s.SHA256 != "" && sum != s.SHA256 {
+							report("line %d: %s/%s/%s: sibling %d: sha256 %s, recorded %s", ln.n, kv.BucketType, kv.Bucket, kv.Key, i, sum, s.SHA256)
+						}
+					}
+					continue
+				}
+				if kv.SHA256 == "" {
+					atomic.AddInt64(&unchecked, 1)
+					continue
+				}
+				atomic.AddInt64(&checked, 1)
+				if sum := checksum(kv.Value); sum != kv.SHA256 {
+					report("line %d: %s/%s/%s: sha256 %s, recorded %s", ln.n, kv.BucketType, kv.Bucket, kv.Key, sum, kv.SHA256)
+				}
+			}
+		}()
+	}
+
+	var err error
+	records := NewLineIterator(r)
+	for n := 1; err == nil; n++ {
+		var data []byte
+		if data, err = records.Next(); err != nil {
+			break
+		}
+		select {
+		case lines <- line{n, data}:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	close(lines)
+	wg.Wait()
+	if err != io.EOF {
+		return fmt.Errorf("read backup: %w", err)
+	}
+
+	for _, problem := range problems {
+		m.log.Printf("ERR: %s\n", problem)
+	}
+
+	m.log.Printf("INFO: verified %d records, %d without checksum, %d problems\n", checked, unchecked, len(problems))
+	if len(problems) > 0 {
+		return fmt.Errorf("backup has %d problems", len(problems))
+	}
+	return nil
+}
+
+// errChanged is a key changed on the source since it was backed up.
+var errChanged = errors.New("changed on source")
+
+// checkBackedUp reads the file a directory backup just wrote for the key
+// of item again, against the checksum written to the manifest, and
+// compares it with the source, describing how they differ, empty when
+// they don't. A key changed on the source since is reported as
+// errChanged, a deleted one as errNotFound.
+func (m *Migrator) checkBackedUp(ctx context.Context, item workItem) (string, error) {
+	item.job.mu.Lock()
+	entry := item.job.backedUp[item.key]
+	item.job.mu.Unlock()
+
+	size, sum, err := fileChecksum(filepath.Join(m.cfg.BackupDir, entry.path()))
+	if err != nil {
+		return "", fmt.Errorf("read backup: %w", err)
+	}
+	if size != entry.Size || sum != entry.SHA256 {
+		return fmt.Sprintf("has a corrupt backup file: size %d sha256 %s, written with size %d sha256 %s",
+			size, sum, entry.Size, entry.SHA256), nil
+	}
+
+	ctx = m.trace(ctx, item.bucketType, item.bucket, item.key)
+	obj, err := m.source.GetObject(ctx, item.bucketType, item.bucket, item.key, nil)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Body.Close()
+	h := sha256.New()
+	if size, err = io.Copy(h, obj.Body); err != nil {
+		return "", err
+	}
+	switch {
+	case size == entry.Size && hex.EncodeToString(h.Sum(nil)) == entry.SHA256:
+		return "", nil
+	case obj.Header.Get("Last-Modified") != entry.LastModified || obj.Header.Get("ETag") != entry.ETag:
+		return "", errChanged
+	}
+	return fmt.Sprintf("differs: %d bytes on source, %d bytes in backup", size, entry.Size), nil
+}
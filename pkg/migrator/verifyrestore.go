@@ -0,0 +1,241 @@
+package migrator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// restoredValue is the value a restore wrote to a key, as recorded by the
+// backup. A key file without a manifest entry only has its path, its
+// checksum is computed by the worker.
+type restoredValue struct {
+	// name is the key in the backup, for the report.
+	name   string
+	size   int64
+	sha256 string
+	path   string
+}
+
+// VerifyRestoreDir checks that every key file of the directory backup in
+// BackupDir kept by the restore filters is on the destination with the
+// same value, against the checksums of the manifest. It returns
+// ErrDifferent when keys are missing or differ.
+func (m *Migrator) VerifyRestoreDir(ctx context.Context) error {
+	dir := m.cfg.BackupDir
+	version, err := checkDirFormat(dir)
+	if err != nil {
+		return err
+	}
+	entries, err := readManifest(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		m.log.Println("WARN: no manifest in the backup dir, checksumming the key files")
+	} else if err != nil {
+		return fmt.Errorf("read manifest: %w", err)
+	}
+
+	return m.verifyRestored(ctx, func(dispatch func(bucketType, bucket, key string, value restoredValue) error) error {
+		// The long keys of the bucket dir being walked.
+		var (
+			longKeysDir string
+			longKeys    map[string]string
+		)
+		return filepath.WalkDir(dir, func(path string, file fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if file.IsDir() || !isKeyFile(file.Name()) {
+				return nil
+			}
+
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			bucketType, bucket, key, err := parseBackupPath(rel, version)
+			if err != nil {
+				m.log.Printf("WARN: skip '%s': %s\n", rel, err)
+				return nil
+			}
+			if isHashedFileName(key) {
+				if dir := filepath.Dir(path); dir != longKeysDir {
+					if longKeys, err = readLongKeys(dir); err != nil {
+						return err
+					}
+					longKeysDir = dir
+				}
+				if key = longKeys[key]; key == "" {
+					m.log.Printf("WARN: skip '%s', its key is missing from %s\n", rel, longKeysName)
+					return nil
+				}
+			}
+
+			value := restoredValue{name: rel, path: path}
+			if entry, ok := entries[rel]; ok {
+				value.size, value.sha256 = entry.Size, entry.SHA256
+			}
+			return dispatch(bucketType, bucket, key, value)
+		})
+	})
+}
+
+// VerifyRestore checks that every record of an NDJSON backup read from r
+// kept by the restore filters is on the destination with the same value.
+// It returns ErrDifferent when keys are missing or differ.
+func (m *Migrator) VerifyRestore(ctx context.Context, r io.Reader) error {
+	return m.verifyRestored(ctx, func(dispatch func(bucketType, bucket, key string, value restoredValue) error) error {
+		lines := NewLineIterator(r)
+		for n := 1; ; n++ {
+			line, err := lines.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			var kv record
+			if err = json.Unmarshal(line, &kv); err == nil {
+				err = checkFormat(kv.Format)
+			}
+			if err != nil {
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+			// A restore writes the last modified sibling.
+			kv = kv.resolve()
+			value := restoredValue{
+				name:   fmt.Sprintf("line %d", n),
+				size:   int64(len(kv.Value)),
+				sha256: checksum(kv.Value),
+			}
+			if err = dispatch(kv.BucketType, kv.Bucket, kv.Key, value); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// verifyRestored checks the keys walk passes to dispatch on the worker
+// pool, mapped to the destination as a restore does. key is escaped.
+func (m *Migrator) verifyRestored(ctx context.Context, walk func(dispatch func(bucketType, bucket, key string, value restoredValue) error) error) error {
+	m.setPhase(phaseVerifying)
+	closePool := m.startPool(ctx)
+	defer closePool()
+
+	dispatchCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	job := &bucketJob{stop: stop}
+
+	tick := time.NewTicker(time.Second * 5)
+	defer tick.Stop()
+
+	var skipped counters
+	err := walk(func(bucketType, bucket, key string, value restoredValue) error {
+		if !m.restoreFilter(bucketType, bucket, key) {
+			skipped.add(skippedFiltered)
+			return nil
+		}
+		raw, err := unescapeKey(key)
+		if err != nil {
+			m.log.Printf("WARN: skip '%s': unescape key: %s\n", value.name, err)
+			return nil
+		}
+		dstKey, ok := m.destKey(raw)
+		if !ok {
+			skipped.add(skippedUnprefixed)
+			return nil
+		}
+
+		item := workItem{bucketType: m.destType(bucketType), bucket: m.destBucket(bucket), key: dstKey, job: job, restored: &value}
+		job.pending.Add(1)
+		for {
+			select {
+			case <-dispatchCtx.Done():
+				job.pending.Done()
+				return dispatchCtx.Err()
+			case <-tick.C:
+				m.log.Printf("INFO: verify restore progress: %d keys (%s)\n", atomic.LoadInt64(&job.done), &job.stats)
+			case m.work <- item:
+				return nil
+			}
+		}
+	})
+	job.pending.Wait()
+
+	job.stats.merge(&skipped)
+	m.totals.merge(&job.stats)
+	m.logRetries()
+	m.log.Printf("INFO: verify restore: %d keys (%s)\n", atomic.LoadInt64(&job.done), &job.stats)
+	if failure := job.err(); failure != nil {
+		return failure
+	}
+	if err != nil {
+		return err
+	}
+	if n := job.stats.get(mismatched); n > 0 {
+		return fmt.Errorf("%d restored keys missing or different: %w", n, ErrDifferent)
+	}
+	return nil
+}
+
+// verifyRestoredItem compares a restored key on the destination with its
+// value in the backup.
+func (m *Migrator) verifyRestoredItem(ctx context.Context, item workItem) {
+	ctx = m.trace(ctx, item.bucketType, item.bucket, item.key)
+	ctx, requestID := m.keyRequest(ctx)
+	expected := item.restored
+	if expected.sha256 == "" {
+		size, sum, err := fileChecksum(expected.path)
+		if err != nil {
+			item.job.fail(fmt.Errorf("checksum '%s': %w", expected.name, err))
+			return
+		}
+		expected.size, expected.sha256 = size, sum
+	}
+
+	var size int64
+	var sum string
+	err := m.retry(ctx, func() error {
+		obj, err := m.destination.GetObject(ctx, item.bucketType, item.bucket, item.key, nil)
+		if err != nil {
+			return err
+		}
+		defer obj.Body.Close()
+		h := sha256.New()
+		if size, err = io.Copy(h, obj.Body); err != nil {
+			return err
+		}
+		sum = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+
+	var problem string
+	switch {
+	case errors.Is(err, errNotFound):
+		problem = "is missing on destination"
+	case err != nil:
+		item.job.fail(fmt.Errorf("verify key '%s' (request %s) err: %w", item.key, requestID, err))
+		atomic.AddInt64(&m.failed, 1)
+		return
+	case size != expected.size || sum != expected.sha256:
+		problem = fmt.Sprintf("differs: size %d sha256 %s on destination, size %d sha256 %s in backup",
+			size, sum, expected.size, expected.sha256)
+	}
+	if problem != "" {
+		m.log.Printf("ERR: restored key '%s' of bucket '%s' (%s) %s\n", item.key, item.bucket, expected.name, problem)
+		item.job.stats.add(mismatched)
+	} else {
+		item.job.stats.add(verified)
+	}
+	atomic.AddInt64(&item.job.done, 1)
+	atomic.AddInt64(&m.progress.keys, 1)
+}
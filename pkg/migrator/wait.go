@@ -0,0 +1,64 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// The wait between probes of WaitForDestination doubles from
+// waitBackoffMin up to waitBackoffMax.
+const (
+	waitBackoffMin = time.Second
+	waitBackoffMax = 30 * time.Second
+)
+
+// WaitForDestination probes the destination until it answers its ping and
+// has every one of bucketTypes, or timeout passes, e.g. while its nodes
+// start. Every failed probe is logged.
+func (m *Migrator) WaitForDestination(ctx context.Context, timeout time.Duration, bucketTypes []string) error {
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	backoff := waitBackoffMin
+	for attempt := 1; ; attempt++ {
+		err := m.probeDestination(ctx, bucketTypes)
+		if err == nil {
+			if attempt > 1 {
+				m.log.Printf("INFO: destination ready after %s\n", time.Since(started).Round(time.Second))
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("destination not ready after %s: %w", timeout, err)
+		}
+		m.log.Printf("INFO: waiting for the destination, %s of %s, probe %d: %s\n",
+			time.Since(started).Round(time.Second), timeout, attempt, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("destination not ready after %s: %w", timeout, err)
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > waitBackoffMax {
+			backoff = waitBackoffMax
+		}
+	}
+}
+
+func (m *Migrator) probeDestination(ctx context.Context, bucketTypes []string) error {
+	if err := m.destination.Ping(ctx); err != nil {
+		return fmt.Errorf("ping: %w", err)
+	}
+	for _, bucketType := range bucketTypes {
+		ok, err := m.destination.BucketTypeExists(ctx, bucketType)
+		if err != nil {
+			return fmt.Errorf("bucket type '%s': %w", bucketType, err)
+		}
+		if !ok {
+			return fmt.Errorf("bucket type '%s' doesn't exist", bucketType)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Watch runs Migrate in passes, waiting interval after the end of each
+// one, until ctx is done. A failed pass is logged and the next one runs;
+// Watch only gives up with the last error after maxFailures passes in a
+// row failed, never when maxFailures is 0. It returns nil when stopped
+// between passes. With Delta, passes only copy the keys that changed.
+func (m *Migrator) Watch(ctx context.Context, interval time.Duration, maxFailures int) error {
+	failed := 0
+	for pass := 1; ; pass++ {
+		m.totals, m.retries, m.failed = counters{}, retryStats{}, 0
+		m.sent, m.received = transferStats{}, transferStats{}
+		atomic.StoreInt64(&m.progress.buckets, 0)
+		atomic.StoreInt64(&m.progress.bucketsDone, 0)
+		start := time.Now()
+		err := m.Migrate(ctx)
+		if ctx.Err() != nil {
+			return err
+		}
+
+		took := time.Since(start).Round(time.Second)
+		if err != nil {
+			failed++
+			m.log.Printf("ERR: watch pass %d failed after %s (%d in a row): %s\n", pass, took, failed, err)
+			if maxFailures > 0 && failed >= maxFailures {
+				return fmt.Errorf("%d passes in a row failed, last: %w", failed, err)
+			}
+		} else {
+			failed = 0
+			m.log.Printf("INFO: watch pass %d done in %s: %s\n", pass, took, &m.totals)
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
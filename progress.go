@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tufitko/riak-migrator/pkg/migrator"
+)
+
+const (
+	// barRefresh is the interval the progress bar is redrawn at.
+	barRefresh = 250 * time.Millisecond
+	barWidth   = 20
+)
+
+// useProgressBar reports whether -progress=bar can draw on stdout: it must
+// be a terminal not carrying the data of the run.
+func useProgressBar() bool {
+	if *progressMode != "bar" {
+		return false
+	}
+	if *backup && *backupStdout || *listKeysOut == "-" || *diff && *diffOut == "-" || *convert && *toNDJSON == "-" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// progressBar draws the progress of a run on the last line of the
+// terminal. Logs written through it are printed to logs above the bar, so
+// the two never interleave.
+type progressBar struct {
+	m    *migrator.Migrator
+	out  io.Writer
+	logs io.Writer
+
+	mu   sync.Mutex
+	line string
+
+	done     chan struct{}
+	finished chan struct{}
+}
+
+func startProgressBar(m *migrator.Migrator, out, logs io.Writer) *progressBar {
+	b := &progressBar{m: m, out: out, logs: logs, done: make(chan struct{}), finished: make(chan struct{})}
+	go b.run()
+	return b
+}
+
+// Write prints a log line above the bar.
+func (b *progressBar) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clear()
+	n, err := b.logs.Write(p)
+	_, _ = io.WriteString(b.out, b.line)
+	return n, err
+}
+
+// Stop stops drawing and erases the bar.
+func (b *progressBar) Stop() {
+	close(b.done)
+	<-b.finished
+	b.mu.Lock()
+	b.clear()
+	b.line = ""
+	b.mu.Unlock()
+}
+
+func (b *progressBar) clear() {
+	if b.line != "" {
+		_, _ = io.WriteString(b.out, "\r\033[K")
+	}
+}
+
+func (b *progressBar) run() {
+	defer close(b.finished)
+	tick := time.NewTicker(barRefresh)
+	defer tick.Stop()
+
+	start := time.Now()
+	// rate is smoothed over the refreshes, keys/s.
+	var rate float64
+	prevKeys, prevAt := int64(0), start
+	for {
+		select {
+		case <-b.done:
+			return
+		case now := <-tick.C:
+			p := b.m.Progress()
+			if elapsed := now.Sub(prevAt).Seconds(); elapsed > 0 {
+				current := float64(p.Keys-prevKeys) / elapsed
+				if rate == 0 {
+					rate = current
+				}
+				rate = 0.8*rate + 0.2*current
+			}
+			prevKeys, prevAt = p.Keys, now
+
+			line := renderProgress(p, rate, now.Sub(start))
+			b.mu.Lock()
+			b.clear()
+			b.line = line
+			_, _ = io.WriteString(b.out, line)
+			b.mu.Unlock()
+		}
+	}
+}
+
+// renderProgress formats a progress bar line: the first active bucket with
+// its bar, percentage and ETA, then the whole run.
+func renderProgress(p migrator.Progress, rate float64, elapsed time.Duration) string {
+	var parts []string
+	if len(p.Active) > 0 {
+		bucket := p.Active[0]
+		var fraction float64
+		if bucket.Listed > 0 {
+			fraction = float64(bucket.Done) / float64(bucket.Listed)
+		}
+		filled := int(fraction * barWidth)
+		part := fmt.Sprintf("%s [%s%s] %3.0f%% %d/%d", bucket.Bucket,
+			strings.Repeat("#", filled), strings.Repeat(".", barWidth-filled), fraction*100, bucket.Done, bucket.Listed)
+		if p.Phase != "listing" && rate > 0 {
+			eta := time.Duration(float64(bucket.Listed-bucket.Done) / rate * float64(time.Second))
+			part += " ETA " + eta.Round(time.Second).String()
+		}
+		if len(p.Active) > 1 {
+			part += fmt.Sprintf(" (+%d buckets)", len(p.Active)-1)
+		}
+		parts = append(parts, part)
+	}
+
+	overall := fmt.Sprintf("%s: %d keys, %.0f keys/s, %s", p.Phase, p.Keys, rate, elapsed.Round(time.Second))
+	if p.Buckets > 0 {
+		overall = fmt.Sprintf("%s: %d/%d buckets, %d keys, %.0f keys/s, %s",
+			p.Phase, p.BucketsDone, p.Buckets, p.Keys, rate, elapsed.Round(time.Second))
+	}
+	parts = append(parts, overall)
+
+	line := strings.Join(parts, " | ")
+	if width := terminalWidth(); len(line) > width-1 {
+		line = line[:width-1]
+	}
+	return "\r" + line
+}
+
+// terminalWidth returns the width of the terminal from COLUMNS, 80 when
+// unset.
+func terminalWidth() int {
+	if width, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && width > 0 {
+		return width
+	}
+	return 80
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// newClusterClient returns a client for a cluster with its own transport,
+// going through the proxy at proxyURL, or else through the proxy the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables pick.
+// Credentials in the proxy URL authenticate to the proxy.
+func newClusterClient(proxyURL string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxyURL != "" {
+		proxy, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		switch proxy.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("invalid proxy URL '%s', want an http, https or socks5 one", proxy.Redacted())
+		}
+		if proxy.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL '%s', it has no host", proxy.Redacted())
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	// Requests are bounded by the timeouts, not by the client.
+	return &http.Client{Transport: proxyTransport{transport}}, nil
+}
+
+// proxyTransport names the proxy a failed request went through in its
+// error. A proxy refusing its credentials fails the request too, Riak
+// never asks for proxy authentication.
+type proxyTransport struct {
+	*http.Transport
+}
+
+func (t proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.Transport.RoundTrip(req)
+	if err == nil && res.StatusCode != http.StatusProxyAuthRequired {
+		return res, nil
+	}
+	proxy, _ := t.Proxy(req)
+	if proxy == nil {
+		return res, err
+	}
+	if err == nil {
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("via proxy %s: %s", proxy.Redacted(), res.Status)
+	}
+	return nil, fmt.Errorf("via proxy %s: %w", proxy.Redacted(), err)
+}
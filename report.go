@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tufitko/riak-migrator/pkg/migrator"
+)
+
+// runReport is the JSON document written by -report.
+type runReport struct {
+	Mode     string            `json:"mode"`
+	Status   string            `json:"status"`
+	Error    string            `json:"error,omitempty"`
+	Started  time.Time         `json:"started"`
+	Finished time.Time         `json:"finished"`
+	Config   map[string]string `json:"config"`
+	*migrator.Summary
+}
+
+// writeReport writes the report of a run started at start which ended
+// with err to path. m is nil when the run wasn't configured.
+func writeReport(path string, m *migrator.Migrator, start time.Time, err error, interrupted bool) error {
+	report := runReport{
+		Mode:     runMode(),
+		Status:   runStatus(err, interrupted),
+		Started:  start,
+		Finished: time.Now(),
+		Config:   effectiveConfig(),
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	if m != nil {
+		summary := m.Summary()
+		report.Summary = &summary
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// runMode names the operation the flags select, as run picks it.
+func runMode() string {
+	switch {
+	case *convert:
+		return "convert"
+	case *deleteRun:
+		return "delete"
+	case *restoreStdin, *restoreURL != "", *restoreBackup, *restoreFiles != "":
+		return "restore"
+	case *verifyRestIn, *verifyRestore:
+		return "verify-restore"
+	case *verifyStdin, *verifyBackup:
+		return "verify-backup"
+	case *resumeFails:
+		return "resume-failures"
+	case *propsOnly:
+		return "props"
+	case *estimate:
+		return "estimate"
+	case *count:
+		return "count"
+	case *listKeysOut != "":
+		return "list-keys"
+	case *diff:
+		return "diff"
+	case *backup:
+		return "backup"
+	case *coordinate != "":
+		return "coordinate"
+	case *join != "":
+		return "join"
+	case *watch:
+		return "watch"
+	case sampleOnly():
+		return "verify-sample"
+	default:
+		return "migrate"
+	}
+}
+
+// sampleOnly reports whether -verify-sample or -verify-count verify a
+// sample on their own, rather than the keys of -verify-after or
+// -verify-backup-after.
+func sampleOnly() bool {
+	return (verifySample > 0 || *verifyCount > 0) && !*verifyAfter && !*verifyBkAfter
+}
+
+// runStatus describes how a run ended, following its exit code.
+func runStatus(err error, interrupted bool) string {
+	switch exitCode(err, interrupted) {
+	case exitOK:
+		return "succeeded"
+	case exitInterrupted:
+		return "interrupted"
+	case exitPartial:
+		return "partial"
+	case exitDifferent:
+		return "different"
+	default:
+		return "failed"
+	}
+}
+
+// secretFlags are words of the names of flags whose values are redacted
+// from reports. Webhook URLs, e.g. Slack ones, are secrets themselves, and
+// headers usually carry credentials.
+var secretFlags = []string{"password", "secret", "token", "notify-url", "header"}
+
+// effectiveConfig returns the value of every flag, set from the command
+// line, the environment or left at its default. Secrets are redacted, and
+// so are the passwords of URLs.
+func effectiveConfig() map[string]string {
+	config := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		for _, word := range secretFlags {
+			if strings.Contains(f.Name, word) && value != "" {
+				value = "REDACTED"
+			}
+		}
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			value = u.Redacted()
+		}
+		config[f.Name] = value
+	})
+	return config
+}
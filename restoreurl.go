@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tufitko/riak-migrator/pkg/migrator"
+)
+
+// urlProgressInterval is how often a -restore-url restore logs the bytes
+// of the backup it read.
+const urlProgressInterval = 10 * time.Second
+
+// restoreFromURL restores the NDJSON backup, gzipped or not, at
+// -restore-url, streaming it without storing it.
+func restoreFromURL(ctx context.Context, m *migrator.Migrator) error {
+	client, err := newClusterClient("")
+	if err != nil {
+		return err
+	}
+	body := &remoteBody{ctx: ctx, client: client, url: *restoreURL, size: -1}
+	defer body.Close()
+	if err = body.open(); err != nil {
+		return err
+	}
+	r, err := decompress(body, "auto")
+	if err != nil {
+		return err
+	}
+	return m.Restore(ctx, r)
+}
+
+// remoteBody reads the body of a backup at a URL. When the connection
+// drops, it requests the rest of the body with a Range request, up to
+// -retries times in a row without reading anything.
+type remoteBody struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+
+	body io.ReadCloser
+	// validator is the ETag or Last-Modified of the first response, which
+	// a resumed response must still have.
+	validator string
+	// n is the bytes read, size the size of the body, -1 if unknown.
+	n, size int64
+
+	failures int
+	loggedAt time.Time
+}
+
+// open requests the body from byte n on.
+func (b *remoteBody) open() error {
+	req, err := http.NewRequestWithContext(b.ctx, http.MethodGet, b.url, nil)
+	if err != nil {
+		return err
+	}
+	for _, header := range urlHeaders {
+		name, value, _ := strings.Cut(header, ":")
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	// The offsets of Range requests are those of the stored body, which a
+	// transparently decompressed one would hide.
+	req.Header.Set("Accept-Encoding", "identity")
+	if b.n > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.n))
+		if b.validator != "" {
+			req.Header.Set("If-Range", b.validator)
+		}
+	}
+
+	res, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("get %s: %w", redactURL(b.url), err)
+	}
+	switch {
+	case res.StatusCode == http.StatusPartialContent && b.n > 0:
+		var start int64
+		if _, err = fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != b.n {
+			_ = res.Body.Close()
+			return fmt.Errorf("get %s: resumed at byte %d instead of %d", redactURL(b.url), start, b.n)
+		}
+	case res.StatusCode == http.StatusOK && b.n > 0:
+		_ = res.Body.Close()
+		return fmt.Errorf("get %s: %s, the server can't resume the backup at byte %d or it changed", redactURL(b.url), res.Status, b.n)
+	case res.StatusCode == http.StatusOK:
+		b.size = res.ContentLength
+		if b.validator = res.Header.Get("ETag"); b.validator == "" || strings.HasPrefix(b.validator, "W/") {
+			b.validator = res.Header.Get("Last-Modified")
+		}
+		if b.size >= 0 {
+			log.Printf("INFO: restore url: reading %d bytes from %s\n", b.size, redactURL(b.url))
+		}
+	default:
+		_ = res.Body.Close()
+		return fmt.Errorf("get %s: %s", redactURL(b.url), res.Status)
+	}
+	b.body = res.Body
+	return nil
+}
+
+func (b *remoteBody) Read(p []byte) (int, error) {
+	for {
+		if b.body == nil {
+			if err := b.open(); err != nil {
+				if b.resumable(err) {
+					continue
+				}
+				return 0, err
+			}
+		}
+
+		n, err := b.body.Read(p)
+		b.n += int64(n)
+		if n > 0 {
+			b.failures = 0
+			b.logProgress()
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		_ = b.body.Close()
+		b.body = nil
+		if n > 0 {
+			return n, nil
+		}
+		if !b.resumable(err) {
+			return 0, err
+		}
+	}
+}
+
+// resumable reports whether the body is requested again after err,
+// waiting a moment longer every time it fails in a row first.
+func (b *remoteBody) resumable(err error) bool {
+	if b.ctx.Err() != nil || b.failures >= *retries {
+		return false
+	}
+	b.failures++
+	log.Printf("WARN: restore url: read failed at byte %d, resuming (%d of %d): %s\n", b.n, b.failures, *retries, err)
+	select {
+	case <-b.ctx.Done():
+		return false
+	case <-time.After(time.Duration(b.failures) * time.Second):
+		return true
+	}
+}
+
+// logProgress logs the bytes read of a body of known size every
+// urlProgressInterval.
+func (b *remoteBody) logProgress() {
+	if b.size <= 0 || time.Since(b.loggedAt) < urlProgressInterval {
+		return
+	}
+	if !b.loggedAt.IsZero() {
+		log.Printf("INFO: restore url: %d of %d bytes read (%.1f%%)\n", b.n, b.size, float64(b.n)*100/float64(b.size))
+	}
+	b.loggedAt = time.Now()
+}
+
+func (b *remoteBody) Close() error {
+	if b.body == nil {
+		return nil
+	}
+	err := b.body.Close()
+	b.body = nil
+	return err
+}
+
+// redactURL returns u without the password of its user.
+func redactURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	return parsed.Redacted()
+}
+
+// checkURLHeader checks that a -restore-url-header is a Name: value pair.
+func checkURLHeader(header string) error {
+	name, _, ok := strings.Cut(header, ":")
+	if !ok || strings.TrimSpace(name) == "" || strings.ContainsAny(strings.TrimSpace(name), " \t") {
+		return fmt.Errorf("invalid -restore-url-header '%s', want Name: value", header)
+	}
+	return nil
+}
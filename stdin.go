@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+)
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// stdin returns the NDJSON backup read from stdin, decompressed as
+// -stdin-compression says: auto detects gzip by its magic number.
+func stdin() (io.Reader, error) {
+	return decompress(os.Stdin, *stdinCompress)
+}
+
+func decompress(r io.Reader, compression string) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if compression == "auto" {
+		magic, err := br.Peek(len(gzipMagic))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		compression = "none"
+		if bytes.Equal(magic, gzipMagic) {
+			compression = "gzip"
+		}
+	}
+	if compression == "none" {
+		return br, nil
+	}
+
+	in := &countingByteReader{r: br}
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, fmt.Errorf("gzip input: %w", err)
+	}
+	return &gzipInput{zr: zr, in: in}, nil
+}
+
+// gzipInput names the offset in the compressed input of the errors of a
+// gzip stream.
+type gzipInput struct {
+	zr *gzip.Reader
+	in *countingByteReader
+}
+
+func (g *gzipInput) Read(p []byte) (int, error) {
+	n, err := g.zr.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("corrupt gzip input at byte %d: %w", g.in.n, err)
+	}
+	return n, err
+}
+
+// countingByteReader counts the bytes read from r. It is an io.ByteReader,
+// so the decompressor reads no more than it consumes and the count is the
+// offset it got to.
+type countingByteReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingByteReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingByteReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
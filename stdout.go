@@ -0,0 +1,106 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// gzipFlushInterval is how often a gzip backup stream is flushed, so a
+// consumer sees the backup progress.
+const gzipFlushInterval = 5 * time.Second
+
+// gzipOutput gzips a backup stream to out, flushing it every
+// gzipFlushInterval and naming it name in its logs. Close must be called,
+// also on errors and signals, to end the gzip member.
+type gzipOutput struct {
+	name string
+	mu   sync.Mutex
+	zw   *gzip.Writer
+	out  *countingWriter
+	raw  int64
+	// sync, when set, makes what was written to out durable.
+	sync func() error
+
+	done     chan struct{}
+	finished chan struct{}
+}
+
+func newGzipOutput(out io.Writer, name string) *gzipOutput {
+	counted := &countingWriter{w: out}
+	g := &gzipOutput{
+		name:     name,
+		zw:       gzip.NewWriter(counted),
+		out:      counted,
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go g.flushLoop()
+	return g
+}
+
+func (g *gzipOutput) Write(p []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n, err := g.zw.Write(p)
+	g.raw += int64(n)
+	return n, err
+}
+
+// Flush writes the data gzipped so far to out, syncing it when sync is
+// set. The resume index flushes the backup before recording its keys.
+func (g *gzipOutput) Flush() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.zw.Flush(); err != nil || g.sync == nil {
+		return err
+	}
+	return g.sync()
+}
+
+func (g *gzipOutput) flushLoop() {
+	defer close(g.finished)
+	tick := time.NewTicker(gzipFlushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-tick.C:
+			g.mu.Lock()
+			err := g.zw.Flush()
+			g.mu.Unlock()
+			if err != nil {
+				log.Printf("WARN: flush gzip %s: %s\n", g.name, err)
+			}
+		}
+	}
+}
+
+// Close ends the gzip stream and logs its raw and compressed sizes.
+func (g *gzipOutput) Close() error {
+	close(g.done)
+	<-g.finished
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	err := g.zw.Close()
+	if g.raw > 0 {
+		log.Printf("INFO: %s: %d bytes gzipped to %d bytes (%.1fx)\n",
+			g.name, g.raw, g.out.n, float64(g.raw)/float64(g.out.n))
+	}
+	return err
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
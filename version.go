@@ -0,0 +1,20 @@
+package main
+
+import rtdebug "runtime/debug"
+
+// version is the version of the build, set with
+// -ldflags "-X main.version=v1.2.3". The module version of the binary is
+// used when unset, e.g. for go install.
+var version string
+
+// toolVersion returns the version of the build, devel for one from a
+// source tree.
+func toolVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := rtdebug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "devel"
+}